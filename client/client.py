@@ -11,6 +11,7 @@ import device
 import getopt
 import configparser
 import random
+import json
 
 
 CONFIG = configparser.ConfigParser()
@@ -20,6 +21,26 @@ client_config_file = os.path.join(project_root, "client.ini")
 csv_directory = os.path.join(project_root, "csv")
 sets_directory = os.path.join(csv_directory, "sets")
 
+# PROTOCOL_VERSION is the version of the hello handshake this client speaks
+PROTOCOL_VERSION = 1
+
+# CAPABILITIES are the capabilities this client reports in its hello
+CAPABILITIES = "commands,config"
+
+# COMMANDS_HEADER is the response header the server sends queued commands in
+COMMANDS_HEADER = "X-Device-Commands"
+
+# CONFIG_VERSION_HEADER is the response header the server sends the version
+# of the client config this device should have in
+CONFIG_VERSION_HEADER = "X-Device-Config-Version"
+
+# MANAGED_CONFIG_KEYS are the client.ini settings the server can override
+# through the client config, the device's own value of each one is kept
+# in the device section as local_<key> while it is overridden
+# A password from the server is kept once it's no longer overridden, the
+# server stops accepting the old one once it's changed there
+MANAGED_CONFIG_KEYS = ["sleep", "ip_address", "port", "https", "password"]
+
 
 def _check_in_device(pi_device):
     """
@@ -35,17 +56,41 @@ def _check_in_device(pi_device):
     """
 
     payload = {"password": pi_device.password, "deviceName": pi_device.device_name}
-    check_in_url = pi_device.protocol + pi_device.ip_address + pi_device.port + "/check-in-handler/"
-    print("checkin url " + check_in_url)
+    server_url = pi_device.protocol + pi_device.ip_address + pi_device.port
+    hello_url = server_url + "/api/device/hello"
+    check_in_url = server_url + "/check-in-handler/"
+    print("hello url " + hello_url)
     try:
-        print("sending request to check in")
-        r = requests.post(check_in_url, data=payload)
-        result = r._content.decode('UTF-8')
+        print("sending hello to check in")
+        hello_payload = dict(
+            payload,
+            protocolVersion=PROTOCOL_VERSION,
+            capabilities=CAPABILITIES,
+            appliedVersion=CONFIG["device"].get("config_version", "0")
+        )
+        r = requests.post(hello_url, data=hello_payload)
+
+        # Servers from before the hello handshake only know the legacy check in
+        if r.status_code == 404:
+            print("server has no hello, checking in at " + check_in_url)
+            r = requests.post(check_in_url, data=payload)
+            already_checked_in = r._content.decode('UTF-8') == "Device already checked in"
+        else:
+            # Saying hello again while checked in is a new handshake
+            reply = r.json()
+            already_checked_in = False
+
+            if r.status_code == 200:
+                _apply_server_config(pi_device, reply["config"])
+                _run_commands(pi_device, reply["commands"])
+                _apply_client_config(pi_device, reply["clientConfig"])
+            elif not already_checked_in:
+                print("hello refused: " + reply.get("message", ""))
 
         # If server responds that device is already checked in, we will continue
         # to write locally 
         # Else we tell current device it is signed in
-        if result == "Already checked in":
+        if already_checked_in:
             CONFIG["device"]["is_checked_in"] = "False"
             print("Device name is already in use, not sending to server but still running locally...")
         else:
@@ -65,6 +110,188 @@ def _check_in_device(pi_device):
         CONFIG.write(config_file)
     
 
+def _apply_server_config(pi_device, config):
+    """
+    Takes an instance of Device and the config the server sent back from
+    hello and applies it, the server decides how often to read the sensor
+    and whether to record
+    """
+
+    pi_device.sleep = float(config["sleepInterval"])
+    pi_device.is_recording = bool(config["recording"])
+    CONFIG["device"]["is_recording"] = str(pi_device.is_recording)
+
+
+def _post_client_config(pi_device, applied_version=""):
+    """
+    Takes an instance of Device and fetches the client config the server
+    holds for it, telling the server which version was applied if given
+    """
+
+    config_url = pi_device.protocol + pi_device.ip_address + pi_device.port + "/api/device/config"
+    r = requests.post(config_url, data={
+        "password": pi_device.password,
+        "deviceName": pi_device.device_name,
+        "appliedVersion": applied_version,
+    })
+    return r.json()
+
+
+def _apply_client_config(pi_device, client_config):
+    """
+    Takes an instance of Device and the client config the server holds for
+    it and, if that version isn't applied yet, writes it to client.ini and
+    tells the server
+    Values holds every setting the server overrides, settings it no longer
+    overrides go back to the device's own value, except the password
+    The server is told before switching to a new address or password so it
+    reaches the server the config came from
+    """
+
+    version = str(client_config["version"])
+
+    if version == CONFIG["device"].get("config_version", "0"):
+        return
+
+    values = client_config["values"]
+    print("applying client config version " + version)
+
+    changed = []
+
+    for key in MANAGED_CONFIG_KEYS:
+        local_key = "local_" + key
+
+        if key in values:
+            if key != "password" and local_key not in CONFIG["device"]:
+                CONFIG["device"][local_key] = CONFIG["DEFAULT"][key]
+            CONFIG["DEFAULT"][key] = values[key]
+            changed.append(key)
+        elif local_key in CONFIG["device"]:
+            CONFIG["DEFAULT"][key] = CONFIG["device"][local_key]
+            CONFIG.remove_option("device", local_key)
+            changed.append(key)
+
+    CONFIG["device"]["config_version"] = version
+
+    with open(client_config_file, "w+") as config_file:
+        CONFIG.write(config_file)
+
+    _post_client_config(pi_device, version)
+
+    if "sleep" in changed:
+        pi_device.sleep = float(CONFIG["DEFAULT"]["sleep"])
+    if "ip_address" in changed:
+        pi_device.ip_address = CONFIG["DEFAULT"]["ip_address"]
+    if "port" in changed:
+        pi_device.port = CONFIG["DEFAULT"]["port"]
+    if "https" in changed:
+        pi_device.protocol = "https://" if CONFIG["DEFAULT"]["https"].lower() == "true" else "http://"
+    if "password" in changed:
+        pi_device.password = CONFIG["DEFAULT"]["password"]
+
+
+def _check_client_config(pi_device, r):
+    """
+    Takes an instance of Device and the reply to one of its pings and
+    fetches and applies its client config if the server says it changed
+    """
+
+    version = r.headers.get(CONFIG_VERSION_HEADER)
+
+    if version is not None and version != CONFIG["device"].get("config_version", "0"):
+        _apply_client_config(pi_device, _post_client_config(pi_device))
+
+
+def _upload_csv(pi_device):
+    """
+    Takes an instance of Device and resends its whole local csv file to the
+    server so the server is up to date with everything recorded locally
+    """
+
+    payload = {"password": pi_device.password, "fileName": pi_device.device_name + ".csv"}
+    reload_url = pi_device.protocol + pi_device.ip_address + pi_device.port + "/reload-csv/"
+
+    with open(pi_device.csv_file, 'rb') as f:
+        return requests.post(reload_url, payload, files={"uploadFile": f})
+
+
+def _run_command(pi_device, command):
+    """
+    Takes an instance of Device and a command queued on the server and
+    carries it out, returning whether it worked and a result to report
+    """
+
+    name = command["name"]
+    args = command.get("args", "")
+
+    if name == "set-sleep-interval":
+        pi_device.sleep = float(args)
+        CONFIG["DEFAULT"]["sleep"] = args
+        return True, "sleep is now " + args
+    if name == "upload-csv":
+        r = _upload_csv(pi_device)
+        return r.status_code == 200, r._content.decode("utf-8")
+    if name == "resync-clock":
+        status = os.system("sudo timedatectl set-ntp true")
+        return status == 0, "timedatectl exited with " + str(status)
+    if name == "diagnostic":
+        usage = shutil.disk_usage(project_root)
+        return True, json.dumps({
+            "sleep": pi_device.sleep,
+            "set": pi_device.current_set,
+            "recording": pi_device.is_recording,
+            "csvBytes": os.path.getsize(pi_device.csv_file),
+            "diskFreeBytes": usage.free,
+            "time": datetime.now().isoformat(),
+        })
+
+    return False, "unknown command " + name
+
+
+def _ack_command(pi_device, command_id, ok, result):
+    """
+    Takes an instance of Device and tells the server whether the command
+    with command_id worked so the server stops sending it
+    """
+
+    ack_url = pi_device.protocol + pi_device.ip_address + pi_device.port + "/api/device/ack"
+    requests.post(ack_url, data={
+        "password": pi_device.password,
+        "deviceName": pi_device.device_name,
+        "id": command_id,
+        "status": "done" if ok else "failed",
+        "result": result,
+    })
+
+
+def _run_commands(pi_device, commands):
+    """
+    Takes an instance of Device and the commands the server sent and
+    carries out and acknowledges each one queued from the dashboard
+    A reboot is acknowledged before it happens as the device can't answer
+    afterwards
+    """
+
+    for command in commands:
+        # Commands without an id, such as new-set, aren't acknowledged
+        if "id" not in command:
+            continue
+
+        print("running command " + command["name"])
+
+        if command["name"] == "reboot":
+            _ack_command(pi_device, command["id"], True, "rebooting")
+            os.system("sudo reboot")
+            continue
+
+        try:
+            ok, result = _run_command(pi_device, command)
+        except Exception as e:
+            ok, result = False, str(e)
+
+        _ack_command(pi_device, command["id"], ok, result)
+
+
 def _get_pi_device():
     """
     Initialize a pi device instance with info from the CONFIG file
@@ -185,6 +412,7 @@ def _get_pi_device():
     pi_device = device.Device(
         device_name=device_name,
         ip_address=ip_address,
+        port=port,
         sleep=sleep, 
         is_recording=is_recording,
         has_internet=has_internet,
@@ -269,15 +497,7 @@ def init(pi_device):
 
             if pi_device.has_internet and not pi_device.had_internet_before:
                 print("reloading csv file")
-                with open(pi_device.csv_file, 'rb') as f:
-                    payload.update({"fileName": pi_device.device_name + ".csv"})
-                    reload_url = pi_device.protocol + pi_device.ip_address + pi_device.port + "/reload-csv/"
-                    print(str(payload))
-                    r = requests.post(
-                        reload_url, 
-                        payload,
-                        files={"uploadFile": f}
-                    )
+                _upload_csv(pi_device)
 
                 pi_device.had_internet_before = True
                 CONFIG["device"]["had_internet_before"] = "True"
@@ -317,6 +537,8 @@ def init(pi_device):
                     print("Sending to server...")
                     response = str(r._content.decode("utf-8")).split(",")
                     print("response " + str(response))
+                    _run_commands(pi_device, json.loads(r.headers.get(COMMANDS_HEADER, "[]")))
+                    _check_client_config(pi_device, r)
 
                     for item in response:
                         if item == "Stop Recording":
@@ -358,6 +580,8 @@ def init(pi_device):
                 )
                 print("Not recording but still going...")
                 response = str(r._content.decode("utf-8")).split(",")
+                _run_commands(pi_device, json.loads(r.headers.get(COMMANDS_HEADER, "[]")))
+                _check_client_config(pi_device, r)
 
                 # Response we will receive from server are:
                 #   - Record: Indicates that the device should start recording again
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errSetNotFound        = errors.New("Set does not exist")
+	errNotActivityChannel = errors.New("Channel must be a motion or contact channel")
+)
+
+// bout is a run of readings no further apart than the bout gap
+type bout struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Seconds  float64   `json:"seconds"`
+	Readings int       `json:"readings"`
+}
+
+// activitySummary holds the statistics of one channel of a set
+// Histogram counts readings per hour of the day in the display timezone
+// LatencySeconds is the time from the start of the range to the first
+// reading and DayNightRatio is day readings over night readings, both
+// are nil when they can't be worked out
+type activitySummary struct {
+	DeviceName         string   `json:"deviceName"`
+	Set                int      `json:"set"`
+	Channel            string   `json:"channel"`
+	Readings           int      `json:"readings"`
+	Bouts              []bout   `json:"bouts"`
+	BoutCount          int      `json:"boutCount"`
+	ActiveSeconds      float64  `json:"activeSeconds"`
+	MeanBoutSeconds    float64  `json:"meanBoutSeconds"`
+	LongestBoutSeconds float64  `json:"longestBoutSeconds"`
+	LatencySeconds     *float64 `json:"latencySeconds"`
+	Histogram          [24]int  `json:"histogram"`
+	DayReadings        int      `json:"dayReadings"`
+	NightReadings      int      `json:"nightReadings"`
+	DayNightRatio      *float64 `json:"dayNightRatio"`
+}
+
+// parseDayHours parses the day_hours setting, e.g. "7-19"
+// The start can be after the end for days that wrap past midnight
+func parseDayHours(value string) (start int, end int, err error) {
+	parts := strings.Split(value, "-")
+
+	if len(parts) == 2 {
+		start, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+
+		if err == nil {
+			end, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		}
+	}
+
+	if len(parts) != 2 || err != nil || start < 0 || start > 23 || end < 0 || end > 23 || start == end {
+		return 0, 0, errors.New("must be two different hours from 0 to 23 as <start>-<end>, e.g. 7-19")
+	}
+
+	return start, end, nil
+}
+
+// isDayHour determines if hour falls within the day from dayStart up to
+// dayEnd
+func isDayHour(hour int, dayStart int, dayEnd int) bool {
+	if dayStart < dayEnd {
+		return hour >= dayStart && hour < dayEnd
+	}
+
+	return hour >= dayStart || hour < dayEnd
+}
+
+// summarizeActivity works out the statistics of readings, which must be
+// sorted by time
+// Readings no more than gap apart belong to the same bout
+// start is where latency is measured from, zero if unknown
+func summarizeActivity(readings []reading, gap time.Duration, dayStart int, dayEnd int, start time.Time) activitySummary {
+	summary := activitySummary{
+		Readings: len(readings),
+		Bouts:    make([]bout, 0),
+	}
+
+	for i, reading := range readings {
+		t := reading.Time.In(setting.DisplayLocation)
+		summary.Histogram[t.Hour()]++
+
+		if isDayHour(t.Hour(), dayStart, dayEnd) {
+			summary.DayReadings++
+		} else {
+			summary.NightReadings++
+		}
+
+		if i > 0 && reading.Time.Sub(readings[i-1].Time) <= gap {
+			current := &summary.Bouts[len(summary.Bouts)-1]
+			current.End = t
+			current.Readings++
+			continue
+		}
+
+		summary.Bouts = append(summary.Bouts, bout{Start: t, End: t, Readings: 1})
+	}
+
+	for i := range summary.Bouts {
+		seconds := summary.Bouts[i].End.Sub(summary.Bouts[i].Start).Seconds()
+		summary.Bouts[i].Seconds = seconds
+		summary.ActiveSeconds += seconds
+
+		if seconds > summary.LongestBoutSeconds {
+			summary.LongestBoutSeconds = seconds
+		}
+	}
+
+	summary.BoutCount = len(summary.Bouts)
+
+	if summary.BoutCount > 0 {
+		summary.MeanBoutSeconds = summary.ActiveSeconds / float64(summary.BoutCount)
+	}
+
+	if !start.IsZero() && len(readings) > 0 {
+		latency := readings[0].Time.Sub(start).Seconds()
+		summary.LatencySeconds = &latency
+	}
+
+	if summary.NightReadings > 0 {
+		ratio := float64(summary.DayReadings) / float64(summary.NightReadings)
+		summary.DayNightRatio = &ratio
+	}
+
+	return summary
+}
+
+// readActivity returns deviceName and the readings of channel in set
+// between start and end, sorted by time
+// channel must be binary as only the times it was active are stored
+func readActivity(deviceName string, channel string, set int, start time.Time, end time.Time) (device, []reading, error) {
+	dev, ok := registry.Get(deviceName)
+
+	if !ok {
+		return device{}, nil, errDeviceNotFound
+	}
+
+	if set < 0 {
+		return device{}, nil, errSetNotFound
+	}
+
+	// The set files are looked for rather than comparing with SetNum, which
+	// starts over when the database is wiped while the sets are kept
+	if set != currentSet {
+		exists, err := setExists(deviceName, set)
+
+		if err != nil {
+			return device{}, nil, err
+		}
+
+		if !exists {
+			return device{}, nil, errSetNotFound
+		}
+	}
+
+	if s, ok := sensors.Get(deviceName, channel); !ok || !s.IsBinary() {
+		return device{}, nil, errNotActivityChannel
+	}
+
+	readings, err := store.ReadRange(deviceName, channel, set, start, end)
+
+	if err != nil {
+		return device{}, nil, err
+	}
+
+	// Readings of late devices can be appended out of order
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Time.Before(readings[j].Time)
+	})
+
+	return dev, readings, nil
+}
+
+// writeActivityError writes an error returned by readActivity to w
+func writeActivityError(w http.ResponseWriter, deviceName string, err error) {
+	switch err {
+	case errDeviceNotFound, errSetNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case errNotActivityChannel:
+		w.WriteHeader(http.StatusNotAcceptable)
+	default:
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't read readings")
+		w.WriteHeader(http.StatusInternalServerError)
+		err = errors.New("Couldn't read readings")
+	}
+
+	w.Write([]byte(err.Error() + ": " + deviceName))
+}
+
+// writeActivityCSV writes one row per summary, leaving out the bouts
+func writeActivityCSV(w http.ResponseWriter, summaries []activitySummary) error {
+	optional := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+
+	header := []string{
+		"device", "set", "channel", "readings", "bouts", "active_seconds", "mean_bout_seconds",
+		"longest_bout_seconds", "latency_seconds", "day_readings", "night_readings", "day_night_ratio",
+	}
+
+	for hour := 0; hour < 24; hour++ {
+		header = append(header, fmt.Sprintf("hour_%02d", hour))
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=analytics.csv")
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, summary := range summaries {
+		row := []string{
+			summary.DeviceName,
+			strconv.Itoa(summary.Set),
+			summary.Channel,
+			strconv.Itoa(summary.Readings),
+			strconv.Itoa(summary.BoutCount),
+			strconv.FormatFloat(summary.ActiveSeconds, 'f', -1, 64),
+			strconv.FormatFloat(summary.MeanBoutSeconds, 'f', -1, 64),
+			strconv.FormatFloat(summary.LongestBoutSeconds, 'f', -1, 64),
+			optional(summary.LatencySeconds),
+			strconv.Itoa(summary.DayReadings),
+			strconv.Itoa(summary.NightReadings),
+			optional(summary.DayNightRatio),
+		}
+
+		for _, count := range summary.Histogram {
+			row = append(row, strconv.Itoa(count))
+		}
+
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// analyticsHandler is an api endpoint that returns activity statistics of
+// one or more devices (deviceName can be repeated) for set, the current
+// readings by default, as json or csv with format=csv
+// channel picks a binary channel, motion by default, start and end (RFC
+// 3339) narrow the range and gap and dayHours override the bout_gap and
+// day_hours settings
+// Latency is measured from start, or for the current set from when it
+// was started
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	deviceNames := r.Form["deviceName"]
+	channel := r.Form.Get("channel")
+	set := currentSet
+	gap := time.Duration(setting.BoutGap) * time.Second
+	dayStart, dayEnd := setting.DayStartHour, setting.DayEndHour
+	var start, end time.Time
+	var err error
+
+	if channel == "" {
+		channel = motionChannel
+	}
+
+	if len(deviceNames) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Must pass at least one deviceName"))
+		return
+	}
+
+	if value := r.Form.Get("set"); value != "" {
+		if set, err = strconv.Atoi(value); err != nil || set < 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("set must be a set number, or 0 for the current readings"))
+			return
+		}
+	}
+
+	if value := r.Form.Get("gap"); value != "" {
+		seconds, err := parsePositiveInt(value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("gap " + err.Error()))
+			return
+		}
+
+		gap = time.Duration(seconds) * time.Second
+	}
+
+	if value := r.Form.Get("dayHours"); value != "" {
+		if dayStart, dayEnd, err = parseDayHours(value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("dayHours " + err.Error()))
+			return
+		}
+	}
+
+	if value := r.Form.Get("start"); value != "" {
+		if start, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("start must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	if value := r.Form.Get("end"); value != "" {
+		if end, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("end must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	summaries := make([]activitySummary, 0, len(deviceNames))
+
+	for _, deviceName := range deviceNames {
+		dev, readings, err := readActivity(deviceName, channel, set, start, end)
+
+		if err != nil {
+			writeActivityError(w, deviceName, err)
+			return
+		}
+
+		since := start
+
+		if since.IsZero() && set == currentSet && dev.SetStartedAt != nil {
+			since = *dev.SetStartedAt
+		}
+
+		summary := summarizeActivity(readings, gap, dayStart, dayEnd, since)
+		summary.DeviceName = deviceName
+		summary.Set = set
+		summary.Channel = channel
+		summaries = append(summaries, summary)
+	}
+
+	if r.Form.Get("format") == "csv" {
+		if err = writeActivityCSV(w, summaries); err != nil {
+			logger.WithError(err).Error("Couldn't write analytics csv")
+		}
+		return
+	}
+
+	sendPayload(w, summaries)
+}
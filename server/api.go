@@ -2,11 +2,9 @@ package main
 
 import (
 	"archive/tar"
-	"bufio"
+	"bytes"
 	"compress/gzip"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,14 +15,84 @@ import (
 
 // mainView displays the main html page with charts
 func mainView(w http.ResponseWriter, r *http.Request) {
-	context := map[string]interface{}{
-		"deviceCenter": deviceCenter,
-	}
+	context := dashboardContext(r)
+	context["devices"] = registry.Snapshot()
 	tpl.ExecuteTemplate(w, "index.html", context)
 }
 
+// writeDevicesTar writes every set of each device in deviceNames into
+// /tmp/<fileName>.tar.gz for downloadTarHandler to send
+// If withDirectory is true, each set is put in a directory named after
+// its device
+func writeDevicesTar(fileName string, deviceNames []string, withDirectory bool) error {
+	mainFile, err := os.Create(filepath.Join("/tmp", fileName+".tar.gz"))
+
+	if err != nil {
+		return err
+	}
+
+	defer mainFile.Close()
+	// set up the gzip writer
+	gw := gzip.NewWriter(mainFile)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	for _, deviceName := range deviceNames {
+		sets, err := store.ListSets(deviceName)
+
+		if err != nil {
+			return err
+		}
+
+		for _, set := range sets {
+			for _, s := range sensors.Channels(deviceName) {
+				var buffer bytes.Buffer
+				filePath := strconv.Itoa(set.Number) + ".csv"
+
+				if s.Channel != motionChannel {
+					filePath = strconv.Itoa(set.Number) + "." + s.Channel + ".csv"
+				}
+
+				if withDirectory {
+					filePath = filepath.Join(deviceName, filePath)
+				}
+
+				if err = store.WriteSetCSV(deviceName, s.Channel, set.Number, &buffer); err != nil {
+					// Channels added after a set was finished have no file
+					if os.IsNotExist(err) && s.Channel != motionChannel {
+						continue
+					}
+					return err
+				}
+
+				if buffer.Len() == 0 && s.Channel != motionChannel {
+					continue
+				}
+
+				hdr := &tar.Header{
+					Name:    filePath,
+					Mode:    int64(fileMode),
+					Size:    int64(buffer.Len()),
+					ModTime: time.Now(),
+				}
+
+				if err = tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+
+				if _, err = io.Copy(tw, &buffer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func generateDeviceTarHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	err := handleDashboardPostRequests(w, r)
 
 	if err != nil {
 		return
@@ -38,53 +106,20 @@ func generateDeviceTarHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deviceDirectory := filepath.Join(setting.SetsDirectory, deviceName)
-	_, err = os.Stat(deviceDirectory)
+	_, deviceExists := registry.Get(deviceName)
 
-	if err != nil {
+	if !deviceExists {
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte("Device name does not exist"))
 		return
 	}
 
-	fileInfoArray, err := ioutil.ReadDir(deviceDirectory)
 	randomFileName := randomString(20)
-	tempFilePath := filepath.Join("/tmp", randomFileName)
-	mainFile, err := os.Create(tempFilePath + ".tar.gz")
-	if err != nil {
+
+	if err = writeDevicesTar(randomFileName, []string{deviceName}, false); err != nil {
 		unableToRetrieveFiles(w, err)
 		return
 	}
-	defer mainFile.Close()
-	// set up the gzip writer
-	gw := gzip.NewWriter(mainFile)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
-
-	for _, fileInfo := range fileInfoArray {
-		fullPath := filepath.Join(deviceDirectory, fileInfo.Name())
-		file, err := os.Open(fullPath)
-
-		if err == nil {
-			hdr := &tar.Header{
-				Name: fileInfo.Name(),
-				Mode: int64(fileMode),
-				Size: fileInfo.Size(),
-			}
-
-			if err := tw.WriteHeader(hdr); err != nil {
-				unableToRetrieveFiles(w, err)
-				return
-			}
-
-			if _, err := io.Copy(tw, file); err != nil {
-				unableToRetrieveFiles(w, err)
-				return
-			}
-			file.Close()
-		}
-	}
 
 	sendPayload(w, map[string]string{
 		"file": randomFileName,
@@ -94,61 +129,17 @@ func generateDeviceTarHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func generateAllDevicesTarHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	err := handleDashboardPostRequests(w, r)
 
 	if err != nil {
 		return
 	}
 
-	rootDirArray, err := ioutil.ReadDir(setting.SetsDirectory)
-	checkError(err, "", true)
 	randomFileName := randomString(20)
-	tempFilePath := filepath.Join("/tmp", randomFileName)
-	mainFile, err := os.Create(tempFilePath + ".tar.gz")
-	checkError(err, "", true)
-	defer mainFile.Close()
-	// set up the gzip writer
-	gw := gzip.NewWriter(mainFile)
-	defer gw.Close()
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
-
-	for _, dirInfo := range rootDirArray {
-		dirName := dirInfo.Name()
-		dirPath := filepath.Join(setting.SetsDirectory, dirName)
-		dirArray, err := ioutil.ReadDir(dirPath)
-
-		if err != nil {
-			unableToRetrieveFiles(w, err)
-			return
-		}
-
-		for _, fileInfo := range dirArray {
-			fileName := fileInfo.Name()
-			filePath := filepath.Join(dirName, fileName)
-			hdr := &tar.Header{
-				Name: filePath,
-				Mode: int64(fileMode),
-				Size: fileInfo.Size(),
-			}
-
-			if err := tw.WriteHeader(hdr); err != nil {
-				unableToRetrieveFiles(w, err)
-				return
-			}
-
-			file, err := os.Open(filepath.Join(dirPath, fileName))
-
-			if err != nil {
-				unableToRetrieveFiles(w, err)
-				return
-			}
 
-			if _, err := io.Copy(tw, file); err != nil {
-				unableToRetrieveFiles(w, err)
-				return
-			}
-		}
+	if err = writeDevicesTar(randomFileName, registry.Names(), true); err != nil {
+		unableToRetrieveFiles(w, err)
+		return
 	}
 
 	sendPayload(w, map[string]string{
@@ -180,59 +171,75 @@ func downloadTarHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // deviceCheckInHandler is an api endpoint that either adds new devices to our
-// global deviceCenter variable or checks in a device that already exists
+// registry or checks in a device that already exists
+// Devices with several sensors send them as sensors, e.g.
+// "pir2:motion,door:contact,temp:temperature:F"
 func deviceCheckInHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	deviceName := r.FormValue("deviceName")
+	err := handlePostRequests(w, r, deviceName)
 
 	if err != nil {
 		return
 	}
 
-	var sqlStatement string
-	deviceName := r.Form.Get("deviceName")
-	dev, deviceExists := deviceCenter.Devices[deviceName]
-	now := time.Now().UTC()
+	var declared []sensor
 
-	// If device already exists, update database
-	// Else insert the new device into database with default values
-	if deviceExists {
-		if dev.IsCheckedIn {
+	// A bad sensor declaration is refused before checking in, as readings
+	// of the channels it was meant to declare would be refused anyway
+	if declaration := r.Form.Get("sensors"); declaration != "" {
+		if declared, err = parseSensors(declaration); err != nil {
 			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte("Device already checked in"))
+			w.Write([]byte(err.Error()))
 			return
 		}
+	}
 
-		sqlStatement = "UPDATE device SET latest_check_in_time=?, is_checked_in=1 WHERE name=?"
-		deviceCenter.Lock()
-		deviceCenter.Devices[dev.Name].LatestCheckInTime = now
-		deviceCenter.Devices[dev.Name].IsCheckedIn = true
-		deviceCenter.Unlock()
+	err = registry.CheckIn(deviceName, time.Now().UTC())
 
-		err := execTXQuery(sqlStatement, now, deviceName)
-		checkError(err, "Update query error", true)
-	} else {
-		sqlStatement =
-			"INSERT INTO device (name, set_num, latest_check_in_time, is_new_set, is_recording, is_checked_in) " +
-				"VALUES (?,?,?,?,?,?);"
-
-		deviceCenter.Lock()
-		deviceCenter.Devices[deviceName] = &device{
-			Name:              deviceName,
-			SetNum:            0,
-			LatestCheckInTime: now,
-			IsNewSet:          false,
-			IsRecording:       true,
-			IsCheckedIn:       true,
+	if err == errAlreadyCheckedIn {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't check in device")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't check in device"))
+		return
+	}
+
+	applyDeviceDeclarations(deviceName, declared, r.Form.Get("timezone"))
+
+	// Devices checking in here are legacy devices, even if they said
+	// hello before
+	if err = registry.SetProtocol(deviceName, 0, nil); err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't record device protocol")
+	}
+}
+
+// applyDeviceDeclarations records the sensors and time zone a device
+// declared when checking in, logging anything that couldn't be recorded
+func applyDeviceDeclarations(deviceName string, declared []sensor, timezone string) {
+	var err error
+
+	// Devices with more than a motion sensor declare their channels
+	if len(declared) > 0 {
+		if err = sensors.Declare(deviceName, declared); err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't declare sensors")
 		}
-		deviceCenter.Unlock()
-		err := execTXQuery(sqlStatement, deviceName, 0, now, 0, 1, 1)
-		checkError(err, "", true)
 	}
 
-	// If current request is from new device, create directory with device
-	// name under the sets directory
-	err = os.MkdirAll(filepath.Join(setting.SetsDirectory, deviceName), os.ModePerm)
-	checkError(err, "Can't make sets directory", true)
+	// Devices can declare the time zone they send local times in
+	if timezone != "" {
+		if _, err = loadLocation(timezone); err == nil {
+			err = registry.SetTimezone(deviceName, timezone)
+		}
+
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Warn("Couldn't set time zone")
+		}
+	}
 }
 
 // newSetHandler is an api endpoint that signals that the server will start new
@@ -240,7 +247,7 @@ func deviceCheckInHandler(w http.ResponseWriter, r *http.Request) {
 // The devices contained in list will reset their local csv file the next time
 // they ping the sensorHandler api point
 func newSetHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	err := handleDashboardPostRequests(w, r)
 
 	if err != nil {
 		return
@@ -255,93 +262,29 @@ func newSetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var newFile *os.File
 	var message string
 	deviceArray := make([]device, 0)
-	// chartArray := make([]chartRow, 0)
-	sqlUpdate := "UPDATE device SET is_new_set=1, set_num=?, latest_set_time=? WHERE name=?"
 
 	for _, deviceName := range r.Form["new-set"] {
-		deviceCenter.RLock()
-		dev, deviceExists := deviceCenter.Devices[deviceName]
-		deviceCenter.RUnlock()
-
-		if deviceExists {
-			if dev.IsRecording {
-				message += deviceName + " is recording.  Can only start new set when " +
-					"device is NOT recording <br /> "
-				continue
-			}
-			if dev.IsNewSet {
-				message += deviceName + " still hasn't reset to new set <br /> "
-				continue
-			}
-
-			// now, _ := time.Parse("2006-01-02 15:04:05", time.Now().Format("2006-01-02 15:04:05"))
-			now := time.Now()
-			mu.Lock()
-			currentCSVFilePath := filepath.Join(setting.CsvDirectory, deviceName+".csv")
-			deviceSetDirectory := filepath.Join(setting.SetsDirectory, deviceName)
-			fileInfoArray, err := ioutil.ReadDir(deviceSetDirectory)
-			checkError(err, "Couldn't read device directory", true)
-
-			currentCSVFile, err := os.Open(currentCSVFilePath)
-			checkError(err, "Couldn't open csv file", true)
-
-			// If device directory has no files in it, then we insert the first
-			// csv file in the set
-			// Else calculate what the next file name should be.  Since file names
-			// are just numbers, we just simply increment from the last file name
-			if len(fileInfoArray) == 0 {
-				// newFile, err = os.OpenFile(filepath.Join(deviceSetDirectory, "1.csv"), os.O_WRONLY|os.O_CREATE, os.ModePerm)
-				newFile, err = os.Create(filepath.Join(deviceSetDirectory, "1.csv"))
-				checkError(err, "", true)
-
-				deviceArray = append(deviceArray, device{
-					Name:          deviceName,
-					SetNum:        1,
-					LatestSetTime: &now,
-				})
-
-				_, err := io.Copy(newFile, currentCSVFile)
-				checkError(err, "", true)
-			} else {
-				lastFileInfo := fileInfoArray[len(fileInfoArray)-1]
-				setNum, err := strconv.Atoi(strings.Split(lastFileInfo.Name(), ".")[0])
-				checkError(err, "", true)
-
-				setNum++
-				stringFileName := strconv.Itoa(setNum)
-				// newFile, err := os.OpenFile(filepath.Join(deviceSetDirectory, stringFileName+".csv"), os.O_WRONLY|os.O_CREATE, 0666)
-				newFile, err := os.Create(filepath.Join(deviceSetDirectory, stringFileName+".csv"))
-				checkError(err, "", true)
-
-				deviceArray = append(deviceArray, device{
-					Name:          deviceName,
-					SetNum:        setNum,
-					LatestSetTime: &now,
-				})
-				_, err = io.Copy(newFile, currentCSVFile)
-				checkError(err, "", true)
-			}
-
-			newFile.Close()
-			currentCSVFile.Close()
-
-			// Simply calling create to overwrite current file
-			_, err = os.Create(currentCSVFilePath)
-			checkError(err, "", true)
-			mu.Unlock()
-
-			newSetNum := dev.SetNum + 1
-			err = execTXQuery(sqlUpdate, newSetNum, now, deviceName)
-			checkError(err, "", true)
-
-			deviceCenter.Lock()
-			deviceCenter.Devices[deviceName].IsNewSet = true
-			deviceCenter.Devices[deviceName].SetNum = newSetNum
-			deviceCenter.Devices[deviceName].LatestSetTime = &now
-			deviceCenter.Unlock()
+		dev, err := registry.BeginNewSet(deviceName, time.Now(), store.RotateSet)
+
+		switch err {
+		case nil:
+			deviceArray = append(deviceArray, device{
+				Name:          deviceName,
+				SetNum:        dev.SetNum,
+				LatestSetTime: dev.LatestSetTime,
+				SetStartedAt:  dev.SetStartedAt,
+			})
+		case errDeviceNotFound:
+		case errDeviceRecording:
+			message += deviceName + " is recording.  Can only start new set when " +
+				"device is NOT recording <br /> "
+		case errNewSetPending:
+			message += deviceName + " still hasn't reset to new set <br /> "
+		default:
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't start new set")
+			message += "Couldn't start new set for " + deviceName + " <br /> "
 		}
 	}
 
@@ -351,6 +294,9 @@ func newSetHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// reloadCSVHandler is an api endpoint that devices use to resend their
+// whole local csv file after being offline, which replaces the current
+// readings of the device
 func reloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	file, handler, err := r.FormFile("uploadFile")
 
@@ -361,27 +307,31 @@ func reloadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer file.Close()
-	err = handlePostRequests(w, r)
+
+	// The device is named by the file rather than deviceName, so only the
+	// password of the server is accepted
+	err = handlePostRequests(w, r, "")
 
 	if err != nil {
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
-	pathToFile := filepath.Join(setting.CsvDirectory, handler.Filename)
-	os.Remove(pathToFile)
-	f, err := os.OpenFile(pathToFile, os.O_WRONLY|os.O_CREATE, fileMode)
-	checkError(err, "", true)
-	defer f.Close()
-	io.Copy(f, file)
+	// Only use the base name so the upload can't be written outside
+	// of the csv directory
+	deviceName := strings.TrimSuffix(filepath.Base(handler.Filename), ".csv")
+
+	if err = store.ReplaceCurrent(deviceName, file, deviceLocation(deviceName)); err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't reload csv file")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Couldn't reload csv file"))
+	}
 }
 
 // recordingHandler is an api endpoint that will get a list of device
 // names from html page and will either start or stop recording
 // based on device names given and flag to start or stop recording
 func recordModeHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	err := handleDashboardPostRequests(w, r)
 
 	if err != nil {
 		return
@@ -404,24 +354,20 @@ func recordModeHandler(w http.ResponseWriter, r *http.Request) {
 
 	isRecording, _ := strconv.ParseBool(record)
 	devicesRecordStatus := make(map[string]bool)
-	sqlUpdate := "UPDATE device SET is_recording=? WHERE name=?"
 
 	for _, deviceName := range r.Form["record-device"] {
-		deviceCenter.RLock()
-		dev, deviceExists := deviceCenter.Devices[deviceName]
-		deviceCenter.RUnlock()
-
-		if deviceExists {
-			if (dev.IsRecording && !isRecording) || (!dev.IsRecording && isRecording) {
-				err = execTXQuery(sqlUpdate, isRecording, deviceName)
-				checkError(err, "", true)
-				deviceCenter.Lock()
-				deviceCenter.Devices[deviceName].IsRecording = isRecording
-				deviceCenter.Unlock()
-			}
+		err = registry.SetRecording(deviceName, isRecording)
 
-			devicesRecordStatus[deviceName] = isRecording
+		if err == errDeviceNotFound {
+			continue
+		}
+
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Warn("Couldn't change record mode")
+			continue
 		}
+
+		devicesRecordStatus[deviceName] = isRecording
 	}
 
 	sendPayload(w, devicesRecordStatus)
@@ -431,14 +377,11 @@ func recordModeHandler(w http.ResponseWriter, r *http.Request) {
 // all devices and if a device hasn't been heard from for certain
 // amount of time, will add device name to list and give warning on webpage
 func updateStatusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("record status")
 	devicesNotHeardFrom := make(map[string]time.Time)
 
-	for _, dev := range deviceCenter.Devices {
+	for _, dev := range registry.Snapshot() {
 		if !dev.IsCheckedIn {
-			deviceCenter.Lock()
 			devicesNotHeardFrom[dev.Name] = dev.LatestCheckInTime
-			deviceCenter.Unlock()
 		}
 	}
 
@@ -454,7 +397,6 @@ func updateStatusHandler(w http.ResponseWriter, r *http.Request) {
 // continue to check if the device is allowed to record again or start new
 // set while not recording
 func deviceStatusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("device record")
 	message := ""
 	deviceName := r.URL.Query().Get("deviceName")
 
@@ -466,28 +408,13 @@ func deviceStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deviceCenter.RLock()
-	dev, deviceExists := deviceCenter.Devices[deviceName]
-	deviceCenter.RUnlock()
+	dev, err := registry.Heartbeat(deviceName, time.Now().UTC(), false)
 
-	if deviceExists {
-		if !dev.IsCheckedIn {
-			message += "Not Checked In,"
-			w.WriteHeader(http.StatusNotAcceptable)
-			w.Write([]byte(message))
-			return
-		}
+	switch err {
+	case nil:
+		sendCommandsHeader(w, dev)
+		sendConfigHeader(w, dev)
 		w.WriteHeader(http.StatusOK)
-		now := time.Now().UTC()
-		timeUpdateQuery := "UPDATE device SET latest_check_in_time=?, is_recording=?, is_new_set=? WHERE name=?;"
-		err := execTXQuery(timeUpdateQuery, now, dev.IsRecording, dev.IsNewSet, deviceName)
-		checkError(err, "", true)
-
-		deviceCenter.Lock()
-		deviceCenter.Devices[deviceName].LatestCheckInTime = now
-		deviceCenter.Devices[deviceName].IsRecording = dev.IsRecording
-		deviceCenter.Devices[deviceName].IsNewSet = dev.IsNewSet
-		deviceCenter.Unlock()
 
 		if dev.IsRecording {
 			message += "Record,"
@@ -496,9 +423,16 @@ func deviceStatusHandler(w http.ResponseWriter, r *http.Request) {
 		if dev.IsNewSet {
 			message += "New Set,"
 		}
-	} else {
+	case errNotCheckedIn:
+		message += "Not Checked In,"
+		w.WriteHeader(http.StatusNotAcceptable)
+	case errDeviceNotFound:
 		w.WriteHeader(http.StatusNotFound)
 		message += "Device name does not exist"
+	default:
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't update device status")
+		w.WriteHeader(http.StatusInternalServerError)
+		message += "Couldn't update device status"
 	}
 
 	w.Write([]byte(message))
@@ -508,202 +442,213 @@ func deviceStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 // sensorHandler is an api endpoint that receives time stamp info from our devices
 // and adds them to their own device log file
+// A time stamp is either "<device>,<RFC 3339 time>,<movement>" or the legacy
+// "<device>,<date>,<time>,<movement>" in the time zone the device declared
+// Devices with several sensors send "<channel>=<value>;..." in place of
+// movement
 func sensorHandler(w http.ResponseWriter, r *http.Request) {
-	err := handlePostRequests(w, r)
+	timeStamp := r.FormValue("timeStamp")
+	timeStampArray := strings.Split(timeStamp, ",")
+	err := handlePostRequests(w, r, timeStampArray[0])
 
 	if err != nil {
 		return
 	}
 
-	fmt.Println("Sensor reached")
-	var deviceFile *os.File
 	var message string
-	timeStamp := r.Form.Get("timeStamp")
-	timeStampArray := strings.Split(timeStamp, ",")
 
-	if len(timeStampArray) != 4 {
+	if len(timeStampArray) != 3 && len(timeStampArray) != 4 {
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte("Improper time stamp sent"))
 		return
 	}
 
-	movement, err := strconv.ParseBool(strings.TrimRight(strings.Split(timeStamp, ",")[3], "\n"))
+	deviceName := timeStampArray[0]
+	sentTime, err := parseCSVReading(
+		strings.Join(timeStampArray[1:len(timeStampArray)-1], ","),
+		deviceLocation(deviceName),
+	)
 
 	if err != nil {
 		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("Movement must be either true or false"))
+		w.Write([]byte("Improper time sent"))
 		return
 	}
 
-	_, err = time.ParseInLocation("2006-01-02 15:04:05", timeStampArray[1]+" "+timeStampArray[2], time.UTC)
+	deviceTime := sentTime.Time
+	values := strings.TrimSpace(timeStampArray[len(timeStampArray)-1])
+	var readings []reading
+	var movement bool
 
-	if err != nil {
+	// The last field is either the legacy movement flag or the value of
+	// each channel, e.g. "pir1=1;door=0;temperature=21.5"
+	if strings.Contains(values, "=") {
+		readings, movement, err = parseChannelValues(deviceName, values, deviceTime)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	} else {
+		movement, err = strconv.ParseBool(values)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("Movement must be either true or false"))
+			return
+		}
+
+		readings = make([]reading, 0, 1)
+
+		if movement {
+			readings = append(readings, reading{Channel: motionChannel, Time: deviceTime})
+		}
+	}
+	receivedAt := time.Now().UTC()
+	dev, err := registry.Heartbeat(deviceName, receivedAt, true)
+
+	if err == errDeviceNotFound || err == errNotCheckedIn {
 		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("Improper time sent"))
+		w.Write([]byte("Device does not exist or is not checked in"))
 		return
 	}
 
-	deviceName := strings.Split(timeStamp, ",")[0]
-	deviceCenter.RLock()
-	dev, deviceExists := deviceCenter.Devices[deviceName]
-	deviceCenter.RUnlock()
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't update device status")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't update device status"))
+		return
+	}
 
-	if deviceExists && dev.IsCheckedIn {
-		now := time.Now().UTC()
+	sendCommandsHeader(w, dev)
+	sendConfigHeader(w, dev)
 
-		if dev.IsRecording {
-			message += "Record,"
-		} else {
-			message += "Stop Recording,"
-		}
+	if dev.IsRecording {
+		message += "Record,"
+	} else {
+		message += "Stop Recording,"
+	}
 
-		sqlUpdate :=
-			"UPDATE device " +
-				"SET latest_check_in_time=?, is_recording=?, is_new_set=0 " +
-				"WHERE name=?;"
-
-		err = execTXQuery(
-			sqlUpdate,
-			now,
-			dev.IsRecording,
-			deviceName,
-		)
-		checkError(err, "", true)
-		deviceCenter.Lock()
-		deviceCenter.Devices[deviceName].LatestCheckInTime = now
-		deviceCenter.Devices[deviceName].IsRecording = dev.IsRecording
+	clockSkew, err := registry.MeasureClockSkew(deviceName, deviceTime.Sub(receivedAt))
 
-		if dev.IsNewSet {
-			deviceCenter.Devices[deviceName].IsNewSet = false
-		}
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't measure clock skew")
+	}
 
-		deviceCenter.Unlock()
+	correctedTime := correctClockSkew(deviceTime, clockSkew)
+	readingTime := deviceTime
 
-		deviceFilePath := filepath.Join(setting.CsvDirectory, deviceName+".csv")
-		checkError(err, "Can't parse bool", true)
-		_, deviceErr := os.Stat(deviceFilePath)
+	if setting.ClockSkewMode == "correct" {
+		readingTime = correctedTime
+	}
 
-		if movement {
-			mu.Lock()
-			defer mu.Unlock()
-
-			newTimeStamp := timeStampArray[1] + "," + timeStampArray[2] + " \n"
-
-			// If log file for device does not exist, create and write time stamp to it
-			// Else append time stamp to file
-			if deviceErr != nil {
-				deviceFile, _ = os.Create(deviceFilePath)
-				deviceFile.WriteString(newTimeStamp)
-			} else {
-				deviceFile, err = os.OpenFile(deviceFilePath, os.O_APPEND|os.O_WRONLY, os.ModePerm)
-				checkError(err, "Can't open file", true)
-				deviceFile.WriteString(newTimeStamp)
-			}
-			defer deviceFile.Close()
+	if movement {
+		activity.Record(deviceName, readingTime)
+	}
+
+	// Occupancy is always on the server clock, as the offline time at
+	// the end of its intervals is measured against it
+	if occupancy != nil {
+		if err = occupancy.Record(deviceName, correctedTime, movement); err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't record occupancy")
 		}
+	}
 
-		w.Write([]byte(message))
-	} else {
-		w.WriteHeader(http.StatusNotAcceptable)
-		w.Write([]byte("Device does not exist or is not checked in"))
+	for _, reading := range readings {
+		reading.Time = readingTime
+
+		if setting.ClockSkewMode == "both" {
+			reading.ReceivedAt = &receivedAt
+		}
+
+		if err = store.AppendReading(deviceName, reading); err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't save time stamp")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Couldn't save time stamp"))
+			return
+		}
 	}
 
+	w.Write([]byte(message))
 	return
 }
 
-// updateChartHandler is an api point that will read our overall log file,
-// calculate the total amount of motion based on the time measurement passed
-// and return
+// updateChartHandler is an api point that will read the current readings of
+// every device, calculate the total amount of motion based on the time
+// measurement passed and return
+// "hour" counts motion in 5 minute tick marks over the current hour and
+// "day" (the default) counts motion per hour over the current day, both in
+// the display timezone
+// channel picks the sensor to chart, motion by default, numeric channels
+// also get the average value of each tick mark
 func updateChartHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	timeMeasure := r.Form.Get("timeMeasure")
-	now := time.Now().UTC()
-
-	// Function for getting chart with hour info
-	hourPayload := func(dateTime time.Time, payload *chart) {
-		payload.TimeMeasure = "hour"
-		increment := 5
-		startingTime := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
-
-		// Loop by increment variable which is the tick marks (in minutes) that will be used
-		// for our chart
-		for i := 0; i < 60; i = i + increment {
-			// If we are on first iteration of loop, check increment of previous hour and see if
-			// dateTime falls within that time period.  If it does, add to payLoad
-			// Else check current hour within increment and if dateTime falls within, increment payLoad
-			if i == 0 {
-				previousHour := startingTime.Add(-time.Duration(increment) * time.Minute)
-
-				if dateTime.After(previousHour) && dateTime.Before(startingTime) {
-					payload.Axises[i]++
-				}
-			} else if dateTime.After(startingTime.Add(-time.Duration(increment)*time.Minute)) && dateTime.Before(startingTime.Add(time.Duration(i)*time.Minute)) {
-				payload.Axises[i]++
-				break
-			}
+	channel := r.Form.Get("channel")
+	now := time.Now().In(setting.DisplayLocation)
+
+	if channel == "" {
+		channel = motionChannel
+	}
+	var start time.Time
+	var tickMark func(dateTime time.Time) int
+
+	switch timeMeasure {
+	case "hour":
+		start = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+		tickMark = func(dateTime time.Time) int {
+			return dateTime.In(now.Location()).Minute() / 5 * 5
+		}
+	default:
+		timeMeasure = "day"
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		tickMark = func(dateTime time.Time) int {
+			return dateTime.In(now.Location()).Hour()
 		}
 	}
 
-	// Function for getting chart with 24 hour info
-	dayPayload := func(dateTime time.Time, payload *chart) {
-		payload.TimeMeasure = "day"
-		startingTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		for i := 0; i < 24; i++ {
-			if i == 0 {
-				previousDay := startingTime.Add(-1 * time.Hour)
+	chartArray := make([]*chart, 0)
 
-				if dateTime.After(previousDay) && dateTime.Before(startingTime) {
-					payload.Axises[i]++
-				}
-			} else if dateTime.After(startingTime.Add(-1*time.Hour)) && dateTime.Before(startingTime.Add(time.Duration(i)*time.Hour)) {
-				payload.Axises[i]++
-				break
-			}
+	for _, deviceName := range registry.Names() {
+		s, ok := sensors.Get(deviceName, channel)
+
+		if !ok {
+			continue
 		}
-	}
 
-	fileInfoArray, err := ioutil.ReadDir(setting.CsvDirectory)
-	checkError(err, "Can't read files in directory", true)
-	chartArray := make([]*chart, len(fileInfoArray))
-	mu.RLock()
+		readings, err := store.ReadRange(deviceName, channel, currentSet, start, time.Time{})
 
-	for i, fileInfo := range fileInfoArray {
-		if !fileInfo.IsDir() {
-			chartArray[i].DeviceName = fileInfo.Name()
-			csvFile := filepath.Join(setting.CsvDirectory, fileInfo.Name()+".csv")
-			file, err := os.Open(csvFile)
-			checkError(err, "Can't open csv file", true)
-			reader := bufio.NewReader(file)
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't read readings for chart")
+			continue
+		}
 
-			for {
-				line, fileErr := reader.ReadString('\n')
-				timeStampArray := strings.Split(line, ",")
-				dateTime, timeErr := time.ParseInLocation("2006-01-02 15:04:05", timeStampArray[0]+" "+timeStampArray[1], time.UTC)
+		payload := &chart{
+			DeviceName:  deviceName,
+			Channel:     channel,
+			TimeMeasure: timeMeasure,
+			Axises:      make(map[int]int),
+		}
 
-				if timeErr != nil {
-					dateTime = time.Now().UTC()
-				}
+		// Binary channels are charted by how often they were active and
+		// numeric ones by their average
+		if !s.IsBinary() {
+			payload.Values = make(map[int]float64)
+		}
 
-				switch timeMeasure {
-				case "hour":
-					hourPayload(dateTime, chartArray[i])
-				case "day":
-					dayPayload(dateTime, chartArray[i])
-				case "all":
-					hourPayload(dateTime, chartArray[i])
-					dayPayload(dateTime, chartArray[i])
-				default:
-					dayPayload(dateTime, chartArray[i])
-				}
+		for _, reading := range readings {
+			tick := tickMark(reading.Time)
+			payload.Axises[tick]++
 
-				if fileErr != nil {
-					break
-				}
+			if payload.Values != nil && reading.Value != nil {
+				payload.Values[tick] += (*reading.Value - payload.Values[tick]) / float64(payload.Axises[tick])
 			}
 		}
+
+		chartArray = append(chartArray, payload)
 	}
 
-	mu.Unlock()
 	sendPayload(w, chartArray)
 	return
 }
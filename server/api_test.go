@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSensorHandlerClockSkewModes sends a time stamp from a device whose
+// clock is an hour behind with each clock_skew_mode and checks which
+// times are saved
+func TestSensorHandlerClockSkewModes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		corrected  bool
+		receivedAt bool
+	}{
+		{"ignore", false, false},
+		{"both", false, true},
+		{"correct", true, false},
+	}
+
+	for _, test := range tests {
+		newTestServer(t)
+		setting.ClockSkewMode = test.mode
+
+		if err := registry.CheckIn("kitchen", time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+		postTimeStamp(t, sent, "true")
+		readings, err := store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(readings) != 1 {
+			t.Fatalf("%s saved %d readings, want 1", test.mode, len(readings))
+		}
+
+		r := readings[0]
+
+		if corrected := time.Since(r.Time) < time.Minute; corrected != test.corrected || (!corrected && !r.Time.Equal(sent)) {
+			t.Errorf("%s saved the reading at %v, sent at %v", test.mode, r.Time, sent)
+		}
+
+		if (r.ReceivedAt != nil) != test.receivedAt {
+			t.Errorf("%s saved received at %v", test.mode, r.ReceivedAt)
+		}
+
+		if dev, _ := registry.Get("kitchen"); dev.ClockSkewSeconds() > -3599 || !dev.IsClockSkewed() {
+			t.Errorf("%s measured a skew of %v, want an hour behind", test.mode, dev.ClockSkew)
+		}
+	}
+}
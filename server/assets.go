@@ -0,0 +1,150 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// assets holds the dashboard templates along with the javascript, css and
+// fonts they use so the dashboard works on networks without internet access
+//
+//go:embed templates/*.html static
+var assets embed.FS
+
+// vendorAssets are the third party files under static/ the dashboard
+// can't work without, kept in the tree and updated by fetch_assets.sh
+var vendorAssets = []string{
+	"css/bootstrap.min.css",
+	"css/toastr.min.css",
+	"js/bootstrap.min.js",
+	"js/jquery.min.js",
+	"js/Chart.min.js",
+	"js/moment.min.js",
+	"js/toastr.min.js",
+}
+
+// checkVendorAssets stops the server if any of the vendorAssets is neither
+// embedded nor, with custom_assets, in the static directory inside the
+// templates directory, as the dashboard would load without them and not work
+func checkVendorAssets() {
+	missing := make([]string, 0)
+
+	for _, asset := range vendorAssets {
+		if _, err := fs.Stat(assets, "static/"+asset); err == nil {
+			continue
+		}
+
+		if setting.CustomAssets {
+			customFile := filepath.Join(setting.TemplatesDirectory, "static", filepath.FromSlash(asset))
+
+			if _, err := os.Stat(customFile); err == nil {
+				continue
+			}
+		}
+
+		missing = append(missing, asset)
+	}
+
+	if len(missing) > 0 {
+		checkError(
+			fmt.Errorf("%s not found under static/", strings.Join(missing, ", ")),
+			"Dashboard assets are missing, restore server/static from the repository and build again",
+			true,
+		)
+	}
+}
+
+// initTemplates parses the embedded templates and, if custom_assets is set,
+// any templates found in the templates directory which replace the embedded
+// templates of the same name
+func initTemplates() *template.Template {
+	templates := template.Must(template.ParseFS(assets, "templates/*.html"))
+
+	if !setting.CustomAssets {
+		return templates
+	}
+
+	customTemplates, err := filepath.Glob(filepath.Join(setting.TemplatesDirectory, "*.html"))
+	checkError(err, "Couldn't read templates directory", true)
+
+	if len(customTemplates) > 0 {
+		templates = template.Must(templates.ParseFiles(customTemplates...))
+	}
+
+	return templates
+}
+
+// staticHandler serves files under /static/, first looking in the static
+// directory inside the templates directory if custom_assets is set and
+// falling back to the embedded files
+func staticHandler() http.Handler {
+	embeddedStatic, err := fs.Sub(assets, "static")
+	checkError(err, "Couldn't load embedded static files", true)
+
+	customDirectory := filepath.Join(setting.TemplatesDirectory, "static")
+	embeddedServer := http.FileServer(http.FS(embeddedStatic))
+	customServer := http.FileServer(http.Dir(customDirectory))
+
+	return http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if setting.CustomAssets {
+			customFile := filepath.Join(customDirectory, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+			if info, err := os.Stat(customFile); err == nil && !info.IsDir() {
+				customServer.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		embeddedServer.ServeHTTP(w, r)
+	}))
+}
+
+// exportAssets is the export-assets subcommand which writes the embedded
+// templates and static files to the templates directory so they can be
+// customized, without overwriting files that are already there
+func exportAssets() {
+	err := fs.WalkDir(assets, ".", func(assetPath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		// Templates go straight into the templates directory while
+		// static files keep their static/ prefix
+		relativePath, err := filepath.Rel("templates", filepath.FromSlash(assetPath))
+
+		if err != nil || relativePath[0] == '.' {
+			relativePath = filepath.FromSlash(assetPath)
+		}
+
+		destination := filepath.Join(setting.TemplatesDirectory, relativePath)
+
+		if _, err := os.Stat(destination); err == nil {
+			fmt.Println("Skipping " + destination + ", already exists")
+			return nil
+		}
+
+		contents, err := assets.ReadFile(assetPath)
+
+		if err != nil {
+			return err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+			return err
+		}
+
+		fmt.Println("Writing " + destination)
+		return os.WriteFile(destination, contents, fileMode)
+	})
+
+	checkError(err, "Couldn't export assets", true)
+	fmt.Println("Set custom_assets=true in server.ini to use the exported files")
+	os.Exit(0)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTemplatesLoadNothingFromTheInternet checks every embedded template
+// only refers to files served from /static/
+func TestTemplatesLoadNothingFromTheInternet(t *testing.T) {
+	templates, err := fs.Glob(assets, "templates/*.html")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(templates) == 0 {
+		t.Fatal("no templates embedded")
+	}
+
+	for _, name := range templates {
+		contents, err := assets.ReadFile(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, external := range []string{"http://", "https://", "src=\"//", "href=\"//"} {
+			if strings.Contains(string(contents), external) {
+				t.Errorf("%s refers to %s", name, external)
+			}
+		}
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	newTestDatabase(t)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		staticHandler().ServeHTTP(w, httptest.NewRequest("GET", "/static/css/dashboard.css", nil))
+		return w
+	}
+
+	embedded, err := assets.ReadFile("static/css/dashboard.css")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != string(embedded) {
+		t.Fatalf("embedded file not served, got %d", w.Code)
+	}
+
+	customFile := filepath.Join(setting.TemplatesDirectory, "static", "css", "dashboard.css")
+
+	if err = os.MkdirAll(filepath.Dir(customFile), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(customFile, []byte("body {}"), fileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(); w.Body.String() != string(embedded) {
+		t.Error("custom file served without custom_assets")
+	}
+
+	setting.CustomAssets = true
+
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "body {}" {
+		t.Errorf("custom file not served with custom_assets, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// backupTimeFormat is used to timestamp the name of backup archives
+	backupTimeFormat = "20060102-150405"
+
+	// checksumFileName is the last entry of every backup archive and holds
+	// the sha256 checksum of every other entry in sha256sum format
+	checksumFileName = "SHA256SUMS"
+
+	// scheduledBackupReason is the prefix of archives made by
+	// scheduleBackups, which are the only ones removed by retention
+	scheduledBackupReason = "scheduled"
+)
+
+// backupArchive is a .tar.gz being written that keeps track of the
+// checksum of every file added to it
+type backupArchive struct {
+	tw        *tar.Writer
+	checksums []string
+}
+
+// backupDirectory returns where backup archives are written to
+func backupDirectory() string {
+	return filepath.Join(setting.ProjectRoot, "backups")
+}
+
+// addFile writes the file at filePath into the archive under name
+func (b *backupArchive) addFile(filePath string, name string) error {
+	file, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+	fileInfo, err := file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	name = filepath.ToSlash(name)
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(fileMode),
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime(),
+	}
+
+	if err = b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+
+	if _, err = io.Copy(io.MultiWriter(b.tw, hash), file); err != nil {
+		return err
+	}
+
+	b.checksums = append(b.checksums, hex.EncodeToString(hash.Sum(nil))+"  "+name+"\n")
+	return nil
+}
+
+// addDirectory writes every file under directory into the archive with
+// their path relative to directory prefixed by prefix
+// Any directory in skip is left out, which is used to keep the sets
+// directory from being written twice when it lives in the csv directory
+func (b *backupArchive) addDirectory(directory string, prefix string, skip ...string) error {
+	return filepath.Walk(directory, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, skipPath := range skip {
+			if filePath == skipPath {
+				return filepath.SkipDir
+			}
+		}
+
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(directory, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		return b.addFile(filePath, filepath.Join(prefix, relativePath))
+	})
+}
+
+// addChecksums writes the checksums of every file added so far as the
+// last entry of the archive
+func (b *backupArchive) addChecksums() error {
+	contents := strings.Join(b.checksums, "")
+	hdr := &tar.Header{
+		Name:    checksumFileName,
+		Mode:    int64(fileMode),
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := b.tw.Write([]byte(contents))
+	return err
+}
+
+// backupDatabase copies the database into destination using sqlite's
+// online backup so the copy is consistent even while the server is
+// writing to it
+func backupDatabase(destination string) error {
+	sqliteDriver := &sqlite3.SQLiteDriver{}
+	sourceConn, err := sqliteDriver.Open(setting.ServerDBFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer sourceConn.Close()
+	destinationConn, err := sqliteDriver.Open(destination)
+
+	if err != nil {
+		return err
+	}
+
+	defer destinationConn.Close()
+	backup, err := destinationConn.(*sqlite3.SQLiteConn).Backup("main", sourceConn.(*sqlite3.SQLiteConn), "main")
+
+	if err != nil {
+		return err
+	}
+
+	// Step returns a busy error when another connection holds a write
+	// lock, in which case we wait and try again
+	for attempt := 0; ; attempt++ {
+		done, err := backup.Step(-1)
+
+		if done {
+			break
+		}
+
+		if err != nil && attempt >= 10 {
+			backup.Finish()
+			return err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return backup.Finish()
+}
+
+// writeBackupArchive writes server.ini, the database, every current csv
+// file and every set into a timestamped .tar.gz in the backups directory
+// and returns the path to it
+// reason is put in front of the file name so it is clear why the
+// backup was made, e.g. wipe-20170504-130000.tar.gz
+// The last entry of the archive is a SHA256SUMS file which restore uses
+// to verify the archive before touching any data
+func writeBackupArchive(reason string) (archivePath string, err error) {
+	if err = os.MkdirAll(backupDirectory(), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	archiveName := reason + "-" + time.Now().Format(backupTimeFormat) + ".tar.gz"
+	archivePath = filepath.Join(backupDirectory(), archiveName)
+	archiveFile, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Remove partially written archives so they are never mistaken
+	// for a good backup
+	defer func() {
+		if err != nil {
+			os.Remove(archivePath)
+		}
+	}()
+
+	defer archiveFile.Close()
+	gw := gzip.NewWriter(archiveFile)
+	archive := &backupArchive{tw: tar.NewWriter(gw)}
+
+	if _, statErr := os.Stat(setting.ServerConfigFile); statErr == nil {
+		if err = archive.addFile(setting.ServerConfigFile, "server.ini"); err != nil {
+			return "", err
+		}
+	}
+
+	databaseCopy := archivePath + ".db"
+	defer os.Remove(databaseCopy)
+
+	// Lock csv files so no device writes to them or starts a new
+	// set while they and the database are being copied, which keeps
+	// the set numbers in the database matching the set files
+	// store is only set when the server is running, in which case
+	// readings may still be buffered
+	mu.Lock()
+
+	if store != nil {
+		err = store.Flush()
+	}
+
+	if _, statErr := os.Stat(setting.ServerDBFile); err == nil && statErr == nil {
+		err = backupDatabase(databaseCopy)
+
+		if err == nil {
+			err = archive.addFile(databaseCopy, "server.db")
+		}
+	}
+
+	if err == nil {
+		err = archive.addDirectory(setting.CsvDirectory, "csv", setting.SetsDirectory, backupDirectory())
+	}
+
+	if err == nil {
+		err = archive.addDirectory(setting.SetsDirectory, "sets", backupDirectory())
+	}
+
+	mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = archive.addChecksums(); err != nil {
+		return "", err
+	}
+
+	if err = archive.tw.Close(); err != nil {
+		return "", err
+	}
+
+	if err = gw.Close(); err != nil {
+		return "", err
+	}
+
+	return archivePath, archiveFile.Sync()
+}
+
+// pruneBackups removes the oldest archives made for reason until only
+// setting.BackupRetention of them are left
+func pruneBackups(reason string) error {
+	fileInfoArray, err := ioutil.ReadDir(backupDirectory())
+
+	if err != nil {
+		return err
+	}
+
+	archives := make([]string, 0)
+
+	for _, fileInfo := range fileInfoArray {
+		if strings.HasPrefix(fileInfo.Name(), reason+"-") && strings.HasSuffix(fileInfo.Name(), ".tar.gz") {
+			archives = append(archives, fileInfo.Name())
+		}
+	}
+
+	// Archive names end in a sortable timestamp so sorting them
+	// puts the oldest first
+	sort.Strings(archives)
+
+	for len(archives) > setting.BackupRetention {
+		if err = os.Remove(filepath.Join(backupDirectory(), archives[0])); err != nil {
+			return err
+		}
+
+		logger.WithField("backup", archives[0]).Info("Removed old backup")
+		archives = archives[1:]
+	}
+
+	return nil
+}
+
+// nextBackupTime returns the next time after now that matches the
+// backup_time setting
+func nextBackupTime(now time.Time) time.Time {
+	backupTime, _ := time.Parse("15:04", setting.BackupTime)
+	next := time.Date(now.Year(), now.Month(), now.Day(), backupTime.Hour(), backupTime.Minute(), 0, 0, now.Location())
+
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+
+	return next
+}
+
+// scheduleBackups will be run on a seperate go routine and writes a
+// backup archive every day at backup_time, keeping only the latest
+// backup_retention scheduled archives
+func scheduleBackups() {
+	for {
+		time.Sleep(time.Until(nextBackupTime(time.Now())))
+		archivePath, err := writeBackupArchive(scheduledBackupReason)
+
+		if err != nil {
+			logger.WithError(err).Error("Scheduled backup failed")
+			continue
+		}
+
+		logger.WithField("backup", archivePath).Info("Scheduled backup written")
+
+		if err = pruneBackups(scheduledBackupReason); err != nil {
+			logger.WithError(err).Error("Couldn't remove old backups")
+		}
+	}
+}
+
+// runBackupCommand is the backup subcommand which writes a backup
+// archive and exits
+// It runs in its own process and can't lock out a running server, so the
+// archive is only consistent while the server is stopped
+func runBackupCommand() {
+	archivePath, err := writeBackupArchive("manual")
+	checkError(err, "Couldn't write backup", true)
+	fmt.Println("Backup written to " + archivePath)
+	os.Exit(0)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// TestBackupWipeRestore backs up a device with a finished set and a
+// current reading, wipes everything and checks restoring the backup
+// brings back the database, the set and the current reading
+func TestBackupWipeRestore(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	newTestSets(t, start)
+	current := reading{Channel: motionChannel, Time: start.Add(4 * time.Hour)}
+
+	if err := store.AppendReading("kitchen", current); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath, err := writeBackupArchive("manual")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifyBackupArchive(archivePath); err != nil {
+		t.Fatalf("backup doesn't verify: %v", err)
+	}
+
+	oldYes := *yesFlag
+	*yesFlag = true
+	defer func() { *yesFlag = oldYes }()
+	wipeData(wipeAll)
+
+	if _, err = os.Stat(setting.ServerDBFile); !os.IsNotExist(err) {
+		t.Fatalf("database not wiped: %v", err)
+	}
+
+	store = initStorage()
+
+	if sets, _ := store.ListSets("kitchen"); len(sets) != 0 {
+		t.Fatalf("sets %+v not wiped", sets)
+	}
+
+	if _, err = restoreBackupArchive(archivePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored database replaced the file the open one was wiped from
+	db.Close()
+
+	if db, err = sqlx.Open("sqlite3", setting.ServerDBFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if registry, err = loadDeviceRegistry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dev, ok := registry.Get("kitchen"); !ok || dev.SetNum != 1 {
+		t.Fatalf("device not restored %+v", dev)
+	}
+
+	store = initStorage()
+	sets, err := store.ListSets("kitchen")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sets) != 1 || sets[0].Number != 1 {
+		t.Fatalf("sets %+v restored, want set 1", sets)
+	}
+
+	finished, err := store.ReadRange("kitchen", motionChannel, 1, time.Time{}, time.Time{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(finished) != 2 {
+		t.Fatalf("%d readings restored in set 1, want 2", len(finished))
+	}
+
+	readings, err := store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readings) != 1 || !readings[0].Time.Equal(current.Time) {
+		t.Fatalf("current readings %+v restored, want the one at %v", readings, current.Time)
+	}
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys of the client.ini settings the server can manage
+const (
+	clientKeySleep     = "sleep"
+	clientKeyIPAddress = "ip_address"
+	clientKeyPort      = "port"
+	clientKeyHTTPS     = "https"
+	clientKeyPassword  = "password"
+)
+
+// clientConfigKeys is every managed client.ini setting in the order the
+// dashboard shows them
+var clientConfigKeys = []string{
+	clientKeySleep,
+	clientKeyIPAddress,
+	clientKeyPort,
+	clientKeyHTTPS,
+	clientKeyPassword,
+}
+
+const (
+	// clientScopeAll is the scope of the client config every device gets
+	// Groups and single devices are scoped "group:<name>" and
+	// "device:<name>" and override it in that order
+	clientScopeAll = "all"
+
+	// configVersionHeader is the response header that tells devices which
+	// version of their client config they should have on the replies to
+	// their pings, so they know when to fetch it
+	configVersionHeader = "X-Device-Config-Version"
+
+	// redactedValue is sent in place of managed passwords, and saving it
+	// keeps the password the scope already has
+	redactedValue = "********"
+)
+
+var (
+	// configGroupPattern is what config group names can be made of
+	configGroupPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+	// clientPortPattern is a port as client.ini has it, e.g. ":8003"
+	clientPortPattern = regexp.MustCompile(`^:[0-9]{1,5}$`)
+)
+
+// groupScope and deviceScope return the scope of the client config of a
+// group or a single device
+func groupScope(group string) string {
+	return "group:" + group
+}
+
+func deviceScope(deviceName string) string {
+	return "device:" + deviceName
+}
+
+// clientConfig is the client.ini settings a device should have
+// Version goes up with every change that touches the device, so devices
+// only have to compare it with the version they applied
+type clientConfig struct {
+	Version int               `json:"version"`
+	Values  map[string]string `json:"values"`
+}
+
+// clientConfigLayer is the client config set for one scope
+// Revision is the revision of its last change
+type clientConfigLayer struct {
+	Scope     string            `json:"scope"`
+	Values    map[string]string `json:"values"`
+	Revision  int               `json:"revision"`
+	UpdatedBy string            `json:"updatedBy"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// clientConfigStore holds the client config of every scope, kept in
+// memory as the version of each device is looked up on every ping
+// Revisions count every change to any scope or config group of a device,
+// so the version of a device is the latest revision of what it gets
+type clientConfigStore struct {
+	sync.RWMutex
+	layers   map[string]*clientConfigLayer
+	revision int
+}
+
+// loadClientConfigStore reads the client config of every scope from the
+// database
+func loadClientConfigStore() (*clientConfigStore, error) {
+	scopes := make([]struct {
+		Scope     string    `db:"scope"`
+		Revision  int       `db:"revision"`
+		UpdatedBy string    `db:"updated_by"`
+		UpdatedAt time.Time `db:"updated_at"`
+	}, 0)
+
+	if err := db.Select(&scopes, "SELECT * FROM client_config_scope;"); err != nil {
+		return nil, err
+	}
+
+	values := make([]struct {
+		Scope string `db:"scope"`
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}, 0)
+
+	if err := db.Select(&values, "SELECT * FROM client_config;"); err != nil {
+		return nil, err
+	}
+
+	loaded := &clientConfigStore{layers: make(map[string]*clientConfigLayer)}
+
+	if err := db.Get(&loaded.revision, "SELECT COALESCE(MAX(config_revision), 0) FROM device;"); err != nil {
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		loaded.layers[scope.Scope] = &clientConfigLayer{
+			Scope:     scope.Scope,
+			Values:    make(map[string]string),
+			Revision:  scope.Revision,
+			UpdatedBy: scope.UpdatedBy,
+			UpdatedAt: scope.UpdatedAt,
+		}
+
+		if scope.Revision > loaded.revision {
+			loaded.revision = scope.Revision
+		}
+	}
+
+	for _, value := range values {
+		if layer, ok := loaded.layers[value.Scope]; ok {
+			layer.Values[value.Key] = value.Value
+		}
+	}
+
+	if err := loaded.dropServerPassword(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	return loaded, nil
+}
+
+// dropServerPassword removes the password of every scope that has the
+// password setting of the server, as it's no longer needed once the
+// password was changed there and would otherwise stay a second way in
+func (c *clientConfigStore) dropServerPassword(now time.Time) error {
+	for _, layer := range c.Layers() {
+		password, ok := c.Value(layer.Scope, clientKeyPassword)
+
+		if !ok || password != setting.Password {
+			continue
+		}
+
+		delete(layer.Values, clientKeyPassword)
+
+		if err := c.Set(layer.Scope, layer.Values, "server", now); err != nil {
+			return err
+		}
+
+		logger.WithField("scope", layer.Scope).Info("Removed client config password now the server has it")
+	}
+
+	return nil
+}
+
+// Resolve returns the client config of dev, the config of every device
+// overridden by that of its group and then its own
+func (c *clientConfigStore) Resolve(dev device) clientConfig {
+	c.RLock()
+	defer c.RUnlock()
+	config := clientConfig{Version: dev.ConfigRevision, Values: make(map[string]string)}
+	scopes := []string{clientScopeAll}
+
+	if dev.ConfigGroup != "" {
+		scopes = append(scopes, groupScope(dev.ConfigGroup))
+	}
+
+	for _, scope := range append(scopes, deviceScope(dev.Name)) {
+		layer, ok := c.layers[scope]
+
+		if !ok {
+			continue
+		}
+
+		for key, value := range layer.Values {
+			config.Values[key] = value
+		}
+
+		if layer.Revision > config.Version {
+			config.Version = layer.Revision
+		}
+	}
+
+	return config
+}
+
+// Set replaces the client config of scope with values
+// Setting no values removes every override of scope, which still counts
+// as a change
+func (c *clientConfigStore) Set(scope string, values map[string]string, updatedBy string, now time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	revision := c.revision + 1
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO client_config_scope (scope, revision, updated_by, updated_at) VALUES (?,?,?,?);",
+		scope, revision, updatedBy, now,
+	)
+
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM client_config WHERE scope=?;", scope)
+	}
+
+	for key, value := range values {
+		if err != nil {
+			break
+		}
+
+		_, err = tx.Exec("INSERT INTO client_config (scope, key, value) VALUES (?,?,?);", scope, key, value)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	c.revision = revision
+	c.layers[scope] = &clientConfigLayer{
+		Scope:     scope,
+		Values:    values,
+		Revision:  revision,
+		UpdatedBy: updatedBy,
+		UpdatedAt: now,
+	}
+
+	return nil
+}
+
+// NextRevision hands out the revision of a change to the config group of
+// a device
+func (c *clientConfigStore) NextRevision() int {
+	c.Lock()
+	defer c.Unlock()
+	c.revision++
+	return c.revision
+}
+
+// Value returns the setting key of the client config of scope
+func (c *clientConfigStore) Value(scope string, key string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	layer, ok := c.layers[scope]
+
+	if !ok {
+		return "", false
+	}
+
+	value, ok := layer.Values[key]
+	return value, ok
+}
+
+// Layers returns a copy of the client config of every scope, every
+// device first, then groups and then single devices
+// Passwords are replaced with redactedValue
+func (c *clientConfigStore) Layers() []clientConfigLayer {
+	c.RLock()
+	defer c.RUnlock()
+	layers := make([]clientConfigLayer, 0, len(c.layers))
+
+	for _, layer := range c.layers {
+		values := make(map[string]string, len(layer.Values))
+
+		for key, value := range layer.Values {
+			if key == clientKeyPassword {
+				value = redactedValue
+			}
+
+			values[key] = value
+		}
+
+		copied := *layer
+		copied.Values = values
+		layers = append(layers, copied)
+	}
+
+	rank := func(scope string) int {
+		switch {
+		case scope == clientScopeAll:
+			return 0
+		case strings.HasPrefix(scope, "group:"):
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	sort.Slice(layers, func(i, j int) bool {
+		if rank(layers[i].Scope) != rank(layers[j].Scope) {
+			return rank(layers[i].Scope) < rank(layers[j].Scope)
+		}
+
+		return layers[i].Scope < layers[j].Scope
+	})
+
+	return layers
+}
+
+// validateClientValue checks that value can go in client.ini for key
+func validateClientValue(key string, value string) error {
+	switch key {
+	case clientKeySleep:
+		seconds, err := strconv.ParseFloat(value, 64)
+
+		if err != nil || !isFinite(seconds) || seconds <= 0 || seconds >= float64(setting.TimeOut) {
+			return fmt.Errorf("%s must be a number of seconds greater than 0 and less than time_out (%d)", key, setting.TimeOut)
+		}
+	case clientKeyIPAddress:
+		if strings.ContainsAny(value, " \t/") {
+			return fmt.Errorf("%s must be a host name or ip address", key)
+		}
+	case clientKeyPort:
+		if !clientPortPattern.MatchString(value) {
+			return fmt.Errorf("%s must be a colon followed by the port number, e.g. :8003", key)
+		}
+	case clientKeyHTTPS:
+		if !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+	case clientKeyPassword:
+		if len(value) < 6 {
+			return fmt.Errorf("%s must be at least 6 characters long", key)
+		}
+	default:
+		return fmt.Errorf("Setting must be one of %s", strings.Join(clientConfigKeys, ", "))
+	}
+
+	return nil
+}
+
+// validateClientScope checks that scope is every device, a valid group
+// or an existing device
+func validateClientScope(scope string) error {
+	switch {
+	case scope == clientScopeAll:
+		return nil
+	case strings.HasPrefix(scope, "group:"):
+		if !configGroupPattern.MatchString(strings.TrimPrefix(scope, "group:")) {
+			return fmt.Errorf("Group names must be 1 to 32 letters, numbers, '.', '_' or '-'")
+		}
+
+		return nil
+	case strings.HasPrefix(scope, "device:"):
+		if _, ok := registry.Get(strings.TrimPrefix(scope, "device:")); !ok {
+			return errDeviceNotFound
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Scope must be all, group:<name> or device:<name>")
+}
+
+// isDevicePassword determines if a device request sent the password of
+// the server or the password in the client config of deviceName, so
+// devices that applied a new password aren't refused before the password
+// setting is changed too
+// Once it is, the password is dropped from the client config on the next
+// start by dropServerPassword
+// deviceName must be the only device the request acts on, requests for
+// several devices or naming their device elsewhere pass it empty and only
+// get in with the password of the server
+func isDevicePassword(r *http.Request, deviceName string) bool {
+	password := []byte(r.Form.Get("password"))
+
+	if subtle.ConstantTimeCompare(password, []byte(setting.Password)) == 1 {
+		return true
+	}
+
+	if deviceName == "" {
+		return false
+	}
+
+	dev, ok := registry.Get(deviceName)
+
+	if !ok {
+		return false
+	}
+
+	managed, ok := configs.Resolve(dev).Values[clientKeyPassword]
+	return ok && subtle.ConstantTimeCompare(password, []byte(managed)) == 1
+}
+
+// isConfigDrifted determines if dev hasn't applied the latest version of
+// its client config
+func isConfigDrifted(dev device, config clientConfig) bool {
+	return dev.AppliedConfigVersion != config.Version
+}
+
+// sendConfigHeader tells dev in the configVersionHeader of the reply to
+// its ping which version of its client config it should have, if it said
+// it can apply it in its hello and hasn't yet
+func sendConfigHeader(w http.ResponseWriter, dev device) {
+	if !dev.Supports(capabilityConfig) {
+		return
+	}
+
+	config := configs.Resolve(dev)
+
+	if isConfigDrifted(dev, config) {
+		w.Header().Set(configVersionHeader, strconv.Itoa(config.Version))
+	}
+}
+
+// recordAppliedConfig records the version of its client config the
+// device of a request reports applying in appliedVersion, if it sent one
+func recordAppliedConfig(r *http.Request, deviceName string) error {
+	applied := r.Form.Get("appliedVersion")
+
+	if applied == "" {
+		return nil
+	}
+
+	version, err := strconv.Atoi(applied)
+
+	if err != nil || version < 0 {
+		return fmt.Errorf("appliedVersion must be a whole number")
+	}
+
+	return registry.SetAppliedConfig(deviceName, version, time.Now().UTC())
+}
+
+// deviceConfigHandler is the json device endpoint devices fetch their
+// client config from, posting their password and deviceName and, once
+// they applied it, the version in appliedVersion
+func deviceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeDeviceError(w, http.StatusMethodNotAllowed, deviceErrorMethod, "Request method is not post")
+		return
+	}
+
+	r.ParseForm()
+	deviceName := r.Form.Get("deviceName")
+
+	if !checkDevicePassword(w, r, deviceName) {
+		return
+	}
+
+	err := recordAppliedConfig(r, deviceName)
+
+	switch err {
+	case nil:
+	case errDeviceNotFound:
+		writeDeviceError(w, http.StatusNotFound, deviceErrorNotFound, err.Error())
+		return
+	default:
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, err.Error())
+		return
+	}
+
+	dev, ok := registry.Get(deviceName)
+
+	if !ok {
+		writeDeviceError(w, http.StatusNotFound, deviceErrorNotFound, errDeviceNotFound.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	sendPayload(w, configs.Resolve(dev))
+}
+
+// clientConfigRow is one row of the device table of the client config
+// page
+type clientConfigRow struct {
+	DeviceName     string     `json:"deviceName"`
+	Group          string     `json:"group"`
+	Version        int        `json:"version"`
+	AppliedVersion int        `json:"appliedVersion"`
+	AppliedAt      *time.Time `json:"appliedAt"`
+	Drifted        bool       `json:"drifted"`
+	Managed        bool       `json:"managed"`
+}
+
+// configView renders the page for managing client loaded
+func configView(w http.ResponseWriter, r *http.Request) {
+	context := dashboardContext(r)
+	context["keys"] = clientConfigKeys
+	tpl.ExecuteTemplate(w, "config.html", context)
+}
+
+// configListHandler is an api endpoint that returns the client config of
+// every scope and whether every device applied its own
+func configListHandler(w http.ResponseWriter, r *http.Request) {
+	devices := registry.Snapshot()
+	rows := make([]clientConfigRow, 0, len(devices))
+
+	for _, dev := range devices {
+		config := configs.Resolve(dev)
+		rows = append(rows, clientConfigRow{
+			DeviceName:     dev.Name,
+			Group:          dev.ConfigGroup,
+			Version:        config.Version,
+			AppliedVersion: dev.AppliedConfigVersion,
+			AppliedAt:      dev.ConfigAppliedAt,
+			Drifted:        isConfigDrifted(dev, config),
+			Managed:        dev.Supports(capabilityConfig),
+		})
+	}
+
+	sendPayload(w, map[string]interface{}{
+		"layers":  configs.Layers(),
+		"devices": rows,
+	})
+}
+
+// configSaveHandler is an api endpoint that replaces the client config of
+// scope with every setting sent that isn't empty
+// A password sent as redactedValue keeps the password scope has
+func configSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	scope := strings.TrimSpace(r.Form.Get("scope"))
+
+	if err := validateClientScope(scope); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	values := make(map[string]string)
+
+	for _, key := range clientConfigKeys {
+		value := strings.TrimSpace(r.Form.Get(key))
+
+		if value == "" {
+			continue
+		}
+
+		if key == clientKeyPassword && value == redactedValue {
+			password, ok := configs.Value(scope, key)
+
+			if !ok {
+				w.WriteHeader(http.StatusNotAcceptable)
+				w.Write([]byte("Enter the password to set for " + scope))
+				return
+			}
+
+			values[key] = password
+			continue
+		}
+
+		if err := validateClientValue(key, value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		values[key] = value
+	}
+
+	user := currentSession(r).user
+
+	if err := configs.Set(scope, values, user, time.Now().UTC()); err != nil {
+		logger.WithError(err).WithField("scope", scope).Error("Couldn't save client config")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't save client config"))
+		return
+	}
+
+	logger.WithField("scope", scope).WithField("user", user).Info("Saved client config")
+	configListHandler(w, r)
+}
+
+// configGroupHandler is an api endpoint that moves a device into a config
+// group, or out of any with an empty group
+func configGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	deviceName := r.Form.Get("deviceName")
+	group := strings.TrimSpace(r.Form.Get("group"))
+
+	if group != "" && !configGroupPattern.MatchString(group) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Group names must be 1 to 32 letters, numbers, '.', '_' or '-'"))
+		return
+	}
+
+	dev, ok := registry.Get(deviceName)
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(errDeviceNotFound.Error()))
+		return
+	}
+
+	if dev.ConfigGroup != group {
+		if err := registry.SetConfigGroup(deviceName, group, configs.NextRevision()); err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't change config group")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Couldn't change config group"))
+			return
+		}
+
+		logger.WithField("device", deviceName).WithField("group", group).Info("Changed config group")
+	}
+
+	configListHandler(w, r)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConfigs sets up a test server with a device and a password set
+// for every device
+func newTestConfigs(t *testing.T) {
+	t.Helper()
+	newTestServer(t)
+
+	if err := registry.CheckIn("kitchen", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{clientKeySleep: "1", clientKeyPassword: "rotated"}
+
+	if err := configs.Set(clientScopeAll, values, "admin", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// devicePasswordAccepted returns whether isDevicePassword accepts password
+// from the kitchen device
+func devicePasswordAccepted(password string) bool {
+	form := url.Values{"deviceName": {"kitchen"}, "password": {password}}
+	r := httptest.NewRequest("POST", "/api/device/config", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	return isDevicePassword(r, "kitchen")
+}
+
+func TestLayersRedactPassword(t *testing.T) {
+	newTestConfigs(t)
+	layers := configs.Layers()
+
+	if len(layers) != 1 || layers[0].Values[clientKeyPassword] != redactedValue || layers[0].Values[clientKeySleep] != "1" {
+		t.Fatalf("password not redacted in %+v", layers)
+	}
+
+	if password, _ := configs.Value(clientScopeAll, clientKeyPassword); password != "rotated" {
+		t.Fatalf("redacting changed the stored password to %q", password)
+	}
+}
+
+// TestSaveRedactedPasswordKeepsIt checks saving a scope as the dashboard
+// shows it keeps its password
+func TestSaveRedactedPasswordKeepsIt(t *testing.T) {
+	newTestConfigs(t)
+	form := url.Values{"scope": {clientScopeAll}, clientKeySleep: {"2"}, clientKeyPassword: {redactedValue}}
+	w := postDashboardForm(configSaveHandler, "/config-save/", form)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("saving answered %d: %s", w.Code, w.Body.String())
+	}
+
+	if strings.Contains(w.Body.String(), "rotated") {
+		t.Fatal("password sent back to the dashboard")
+	}
+
+	if password, _ := configs.Value(clientScopeAll, clientKeyPassword); password != "rotated" {
+		t.Fatalf("password changed to %q", password)
+	}
+}
+
+// TestServerPasswordDropsManagedPassword checks the managed password is
+// removed and no longer accepted once the server has it
+func TestServerPasswordDropsManagedPassword(t *testing.T) {
+	newTestConfigs(t)
+
+	if !devicePasswordAccepted("password") || !devicePasswordAccepted("rotated") {
+		t.Fatal("server or managed password refused while rolling out")
+	}
+
+	setting.Password = "rotated"
+	var err error
+
+	if configs, err = loadClientConfigStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := configs.Value(clientScopeAll, clientKeyPassword); ok {
+		t.Fatal("managed password kept once the server has it")
+	}
+
+	var stored int
+
+	if err = db.Get(&stored, "SELECT COUNT(*) FROM client_config WHERE key=?;", clientKeyPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored != 0 {
+		t.Fatal("managed password still in the database")
+	}
+
+	if sleep, _ := configs.Value(clientScopeAll, clientKeySleep); sleep != "1" {
+		t.Fatalf("other settings not kept, sleep is %q", sleep)
+	}
+
+	if devicePasswordAccepted("password") {
+		t.Fatal("old server password still accepted")
+	}
+}
+
+// TestManagedPasswordOnlyForItsDevice checks the password in the client
+// config of one device doesn't let it act on another, whichever way the
+// other device is named
+func TestManagedPasswordOnlyForItsDevice(t *testing.T) {
+	newTestConfigs(t)
+
+	if err := registry.CheckIn("hallway", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := configs.Set(deviceScope("kitchen"), map[string]string{clientKeyPassword: "kitchens"}, "admin", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"deviceName": {"kitchen"}, "password": {"kitchens"}, "appliedVersion": {"1"}}
+
+	if status := postForm(deviceConfigHandler, "/api/device/config", form).Code; status != http.StatusOK {
+		t.Fatalf("managed password of kitchen refused for kitchen with %d", status)
+	}
+
+	form.Set("deviceName", "hallway")
+
+	if status := postForm(deviceConfigHandler, "/api/device/config?deviceName=kitchen", form).Code; status != http.StatusForbidden {
+		t.Fatalf("managed password of kitchen answered %d for hallway, want %d", status, http.StatusForbidden)
+	}
+
+	form = url.Values{"timeStamp": {"hallway,2024-03-01T08:00:00Z,1"}, "password": {"kitchens"}, "deviceName": {"kitchen"}}
+
+	if status := postForm(sensorHandler, "/sensor-handler/?deviceName=kitchen", form).Code; status != http.StatusForbidden {
+		t.Fatalf("reading for hallway with the managed password of kitchen answered %d, want %d", status, http.StatusForbidden)
+	}
+
+	form = url.Values{"deviceName": {"kitchen"}, "password": {"kitchens"}, "timezone": {"UTC"}}
+
+	if status := postForm(deviceTimezoneHandler, "/device-timezone/", form).Code; status != http.StatusForbidden {
+		t.Fatalf("time zone change with a managed password answered %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestValidateClientValue(t *testing.T) {
+	newTestServer(t)
+	valid := map[string]string{
+		clientKeySleep:     "1.5",
+		clientKeyIPAddress: "192.168.1.20",
+		clientKeyPort:      ":8003",
+		clientKeyHTTPS:     "TRUE",
+		clientKeyPassword:  "rotated",
+	}
+
+	for key, value := range valid {
+		if err := validateClientValue(key, value); err != nil {
+			t.Errorf("%s=%s refused: %v", key, value, err)
+		}
+	}
+
+	invalid := [][2]string{
+		{clientKeySleep, "NaN"},
+		{clientKeySleep, "0"},
+		{clientKeySleep, "600"},
+		{clientKeyIPAddress, "http://server"},
+		{clientKeyPort, "8003"},
+		{clientKeyHTTPS, "yes"},
+		{clientKeyPassword, "short"},
+		{"log_level", "debug"},
+	}
+
+	for _, pair := range invalid {
+		if err := validateClientValue(pair[0], pair[1]); err == nil {
+			t.Errorf("%s=%s accepted", pair[0], pair[1])
+		}
+	}
+}
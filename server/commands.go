@@ -0,0 +1,418 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Commands the dashboard can queue for a device
+const (
+	commandSetSleepInterval = "set-sleep-interval"
+	commandReboot           = "reboot"
+	commandUploadCSV        = "upload-csv"
+	commandResyncClock      = "resync-clock"
+	commandDiagnostic       = "diagnostic"
+)
+
+// Statuses of a queued command
+// A command is pending until it is sent, delivered until the device
+// acknowledges it as done or failed, and expired once it was sent
+// command_attempts times without an answer
+const (
+	commandPending   = "pending"
+	commandDelivered = "delivered"
+	commandDone      = "done"
+	commandFailed    = "failed"
+	commandExpired   = "expired"
+	commandCancelled = "cancelled"
+)
+
+const (
+	// commandsHeader is the response header commands are delivered in on
+	// the replies to device pings, so the legacy reply bodies don't change
+	commandsHeader = "X-Device-Commands"
+
+	// maxCommandResultLength keeps results sent by devices to a sane size
+	maxCommandResultLength = 4096
+
+	// commandListLimit is how many of the latest commands the dashboard
+	// shows
+	commandListLimit = 200
+)
+
+// commandNames is every command in the order the dashboard offers them
+var commandNames = []string{
+	commandSetSleepInterval,
+	commandReboot,
+	commandUploadCSV,
+	commandResyncClock,
+	commandDiagnostic,
+}
+
+var (
+	errCommandNotFound = errors.New("Command does not exist")
+	errCommandFinished = errors.New("Command is already finished")
+)
+
+// queuedCommand is a command queued for a device along with how far it got
+type queuedCommand struct {
+	ID          int64      `json:"id" db:"pk"`
+	DeviceName  string     `json:"deviceName" db:"device_name"`
+	Name        string     `json:"name" db:"name"`
+	Args        string     `json:"args" db:"args"`
+	Status      string     `json:"status" db:"status"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	Result      string     `json:"result" db:"result"`
+	CreatedBy   string     `json:"createdBy" db:"created_by"`
+	CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
+	DeliveredAt *time.Time `json:"deliveredAt" db:"delivered_at"`
+	AckedAt     *time.Time `json:"ackedAt" db:"acked_at"`
+}
+
+// validateCommand checks that name is a known command and args are what
+// it takes
+func validateCommand(name string, args string) error {
+	switch name {
+	case commandSetSleepInterval:
+		seconds, err := strconv.ParseFloat(args, 64)
+
+		if err != nil || !isFinite(seconds) || seconds <= 0 || seconds >= float64(setting.TimeOut) {
+			return fmt.Errorf("%s takes a number of seconds greater than 0 and less than time_out (%d)", name, setting.TimeOut)
+		}
+	case commandReboot, commandUploadCSV, commandResyncClock, commandDiagnostic:
+		if args != "" {
+			return fmt.Errorf("%s doesn't take any arguments", name)
+		}
+	default:
+		return fmt.Errorf("Command must be one of %s", strings.Join(commandNames, ", "))
+	}
+
+	return nil
+}
+
+// queueCommand adds a command for deviceName to send on its next ping
+func queueCommand(deviceName string, name string, args string, createdBy string, now time.Time) error {
+	return execTXQuery(
+		"INSERT INTO device_command (device_name, name, args, status, created_by, created_at) VALUES (?,?,?,?,?,?);",
+		deviceName, name, args, commandPending, createdBy, now,
+	)
+}
+
+// loadCommand returns the queued command with id
+func loadCommand(id int64) (queuedCommand, error) {
+	var command queuedCommand
+	err := db.Get(&command, "SELECT * FROM device_command WHERE pk=?;", id)
+
+	if err == sql.ErrNoRows {
+		return command, errCommandNotFound
+	}
+
+	return command, err
+}
+
+// listCommands returns the latest commands queued for any device, newest
+// first
+func listCommands() ([]queuedCommand, error) {
+	commands := make([]queuedCommand, 0)
+	err := db.Select(&commands, "SELECT * FROM device_command ORDER BY pk DESC LIMIT ?;", commandListLimit)
+	return commands, err
+}
+
+// deliverCommands returns the commands to send deviceName now and marks
+// them delivered
+// These are the pending commands and delivered ones that weren't
+// acknowledged within command_retry seconds, unless they were already
+// sent command_attempts times, which expires them instead
+func deliverCommands(deviceName string, now time.Time) ([]deviceCommand, error) {
+	tx, err := db.Beginx()
+
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := make([]queuedCommand, 0)
+	err = tx.Select(
+		&waiting,
+		"SELECT * FROM device_command WHERE device_name=? AND status IN (?,?) ORDER BY pk;",
+		deviceName, commandPending, commandDelivered,
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	retry := time.Duration(setting.CommandRetry) * time.Second
+	commands := make([]deviceCommand, 0)
+
+	for _, command := range waiting {
+		if command.Status == commandDelivered && now.Sub(*command.DeliveredAt) < retry {
+			continue
+		}
+
+		if command.Attempts >= setting.CommandAttempts {
+			_, err = tx.Exec(
+				"UPDATE device_command SET status=?, result=? WHERE pk=?;",
+				commandExpired, "Not acknowledged after "+strconv.Itoa(command.Attempts)+" attempts", command.ID,
+			)
+		} else {
+			_, err = tx.Exec(
+				"UPDATE device_command SET status=?, attempts=attempts+1, delivered_at=? WHERE pk=?;",
+				commandDelivered, now, command.ID,
+			)
+			commands = append(commands, deviceCommand{ID: command.ID, Name: command.Name, Args: command.Args})
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return commands, tx.Commit()
+}
+
+// ackCommand records what deviceName did with the command with id
+// Repeating an acknowledgement is fine so devices can retry it
+func ackCommand(deviceName string, id int64, done bool, result string, now time.Time) error {
+	command, err := loadCommand(id)
+
+	if err != nil {
+		return err
+	}
+
+	if command.DeviceName != deviceName {
+		return errCommandNotFound
+	}
+
+	status := commandFailed
+
+	if done {
+		status = commandDone
+	}
+
+	switch command.Status {
+	case status:
+		return nil
+	case commandPending, commandDelivered, commandExpired:
+	default:
+		return errCommandFinished
+	}
+
+	return execTXQuery(
+		"UPDATE device_command SET status=?, result=?, acked_at=? WHERE pk=?;",
+		status, result, now, id,
+	)
+}
+
+// cancelCommand stops a command that hasn't been acknowledged from being
+// sent again
+func cancelCommand(id int64) error {
+	command, err := loadCommand(id)
+
+	if err != nil {
+		return err
+	}
+
+	if command.Status != commandPending && command.Status != commandDelivered {
+		return errCommandFinished
+	}
+
+	return execTXQuery("UPDATE device_command SET status=? WHERE pk=?;", commandCancelled, id)
+}
+
+// sendCommandsHeader delivers the commands waiting for dev in the
+// commandsHeader of the reply to its ping, if it said it can carry them
+// out in its hello
+func sendCommandsHeader(w http.ResponseWriter, dev device) {
+	if !dev.Supports(capabilityCommands) {
+		return
+	}
+
+	commands, err := deliverCommands(dev.Name, time.Now().UTC())
+
+	if err != nil {
+		logger.WithError(err).WithField("device", dev.Name).Error("Couldn't deliver commands")
+		return
+	}
+
+	if len(commands) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(commands)
+
+	if err != nil {
+		logger.WithError(err).WithField("device", dev.Name).Error("Couldn't marshal commands")
+		return
+	}
+
+	w.Header().Set(commandsHeader, string(payload))
+}
+
+// deviceAckHandler is the json device endpoint devices acknowledge
+// commands with, posting their password, deviceName, the id of the
+// command, status done or failed and an optional result
+func deviceAckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeDeviceError(w, http.StatusMethodNotAllowed, deviceErrorMethod, "Request method is not post")
+		return
+	}
+
+	r.ParseForm()
+	deviceName := r.Form.Get("deviceName")
+
+	if !checkDevicePassword(w, r, deviceName) {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+
+	if err != nil {
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, "id must be a whole number")
+		return
+	}
+
+	status := r.Form.Get("status")
+
+	if status != commandDone && status != commandFailed {
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, "status must be done or failed")
+		return
+	}
+
+	result := r.Form.Get("result")
+
+	if len(result) > maxCommandResultLength {
+		result = result[:maxCommandResultLength]
+	}
+
+	err = ackCommand(deviceName, id, status == commandDone, result, time.Now().UTC())
+
+	switch err {
+	case nil:
+		sendPayload(w, map[string]interface{}{"id": id, "status": status})
+	case errCommandNotFound:
+		writeDeviceError(w, http.StatusNotFound, deviceErrorNotFound, err.Error())
+	case errCommandFinished:
+		writeDeviceError(w, http.StatusConflict, deviceErrorFinished, err.Error())
+	default:
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't acknowledge command")
+		writeDeviceError(w, http.StatusInternalServerError, deviceErrorInternal, "Couldn't acknowledge command")
+	}
+}
+
+// commandsView renders the page for queueing commands and following them
+func commandsView(w http.ResponseWriter, r *http.Request) {
+	context := dashboardContext(r)
+	context["devices"] = registry.Snapshot()
+	context["commands"] = commandNames
+	tpl.ExecuteTemplate(w, "commands.html", context)
+}
+
+// commandListHandler is an api endpoint that returns the latest commands
+// along with whether their device can carry out commands at all
+func commandListHandler(w http.ResponseWriter, r *http.Request) {
+	commands, err := listCommands()
+
+	if err != nil {
+		logger.WithError(err).Error("Couldn't list commands")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't list commands"))
+		return
+	}
+
+	supported := make(map[string]bool)
+
+	for _, dev := range registry.Snapshot() {
+		supported[dev.Name] = dev.Supports(capabilityCommands)
+	}
+
+	sendPayload(w, map[string]interface{}{
+		"commands":  commands,
+		"supported": supported,
+	})
+}
+
+// commandQueueHandler is an api endpoint that queues a command for every
+// device in deviceName
+func commandQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	name := r.Form.Get("name")
+	args := strings.TrimSpace(r.Form.Get("args"))
+	deviceNames := r.Form["deviceName"]
+
+	if len(deviceNames) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Must select at least one device"))
+		return
+	}
+
+	if err := validateCommand(name, args); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	for _, deviceName := range deviceNames {
+		if _, ok := registry.Get(deviceName); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Device " + deviceName + " does not exist"))
+			return
+		}
+	}
+
+	user := currentSession(r).user
+	now := time.Now().UTC()
+
+	for _, deviceName := range deviceNames {
+		if err := queueCommand(deviceName, name, args, user, now); err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't queue command")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Couldn't queue command"))
+			return
+		}
+
+		logger.WithField("device", deviceName).WithField("command", name).WithField("user", user).Info("Queued command")
+	}
+
+	commandListHandler(w, r)
+}
+
+// commandCancelHandler is an api endpoint that cancels a command that
+// hasn't been acknowledged
+func commandCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+
+	if err == nil {
+		err = cancelCommand(id)
+	}
+
+	switch err {
+	case nil:
+		commandListHandler(w, r)
+	case errCommandNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+	case errCommandFinished:
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+	default:
+		logger.WithError(err).Error("Couldn't cancel command")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Couldn't cancel command"))
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestCommands sets up a test server where kitchen said hello saying
+// it carries out commands and hallway checked in the legacy way
+func newTestCommands(t *testing.T) {
+	t.Helper()
+	newTestServer(t)
+
+	if status, _, failure := postHello(t, helloForm("commands")); status != http.StatusOK {
+		t.Fatalf("hello answered %d: %+v", status, failure)
+	}
+
+	if err := registry.CheckIn("hallway", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queueTestCommand queues name for deviceName and returns its id
+func queueTestCommand(t *testing.T, deviceName string, name string, args string) int64 {
+	t.Helper()
+
+	if err := queueCommand(deviceName, name, args, "admin", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	var id int64
+
+	if err := db.Get(&id, "SELECT MAX(pk) FROM device_command;"); err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// commandStatus returns the status of the command with id
+func commandStatus(t *testing.T, id int64) queuedCommand {
+	t.Helper()
+	command, err := loadCommand(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return command
+}
+
+// commandsSent returns the commands delivered in the commandsHeader of a
+// ping from kitchen
+func commandsSent(t *testing.T) []deviceCommand {
+	t.Helper()
+	dev, _ := registry.Get("kitchen")
+	w := httptest.NewRecorder()
+	sendCommandsHeader(w, dev)
+	header := w.Header().Get(commandsHeader)
+	commands := make([]deviceCommand, 0)
+
+	if header == "" {
+		return commands
+	}
+
+	if err := json.Unmarshal([]byte(header), &commands); err != nil {
+		t.Fatal(err)
+	}
+
+	return commands
+}
+
+func TestCommandQueueHandler(t *testing.T) {
+	newTestCommands(t)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		return postDashboardForm(commandQueueHandler, "/command-queue/", form)
+	}
+
+	refused := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"name": {commandReboot}}, http.StatusNotAcceptable},
+		{url.Values{"name": {"self-destruct"}, "deviceName": {"kitchen"}}, http.StatusNotAcceptable},
+		{url.Values{"name": {commandReboot}, "args": {"now"}, "deviceName": {"kitchen"}}, http.StatusNotAcceptable},
+		{url.Values{"name": {commandSetSleepInterval}, "args": {"NaN"}, "deviceName": {"kitchen"}}, http.StatusNotAcceptable},
+		{url.Values{"name": {commandSetSleepInterval}, "args": {"600"}, "deviceName": {"kitchen"}}, http.StatusNotAcceptable},
+		{url.Values{"name": {commandReboot}, "deviceName": {"kitchen", "attic"}}, http.StatusNotFound},
+	}
+
+	for _, test := range refused {
+		if w := post(test.form); w.Code != test.status {
+			t.Errorf("%v answered %d, want %d", test.form, w.Code, test.status)
+		}
+	}
+
+	if commands, _ := listCommands(); len(commands) != 0 {
+		t.Fatalf("%d commands queued by refused requests", len(commands))
+	}
+
+	w := post(url.Values{"name": {commandSetSleepInterval}, "args": {"3"}, "deviceName": {"kitchen", "hallway"}})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("queueing answered %d: %s", w.Code, w.Body.String())
+	}
+
+	commands, err := listCommands()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commands) != 2 {
+		t.Fatalf("%d commands queued, want 2", len(commands))
+	}
+
+	for _, command := range commands {
+		if command.Status != commandPending || command.Args != "3" || command.CreatedBy != "admin" {
+			t.Errorf("wrong command queued %+v", command)
+		}
+	}
+}
+
+// TestCommandDelivery checks commands are only sent to devices that can
+// carry them out, in the commandsHeader of their pings and in the reply
+// to their hello
+func TestCommandDelivery(t *testing.T) {
+	newTestCommands(t)
+	id := queueTestCommand(t, "kitchen", commandReboot, "")
+	queueTestCommand(t, "hallway", commandReboot, "")
+	commands := commandsSent(t)
+
+	if len(commands) != 1 || commands[0].ID != id || commands[0].Name != commandReboot {
+		t.Fatalf("sent %+v, want the reboot", commands)
+	}
+
+	if command := commandStatus(t, id); command.Status != commandDelivered || command.Attempts != 1 || command.DeliveredAt == nil {
+		t.Fatalf("command not marked delivered %+v", command)
+	}
+
+	if commands = commandsSent(t); len(commands) != 0 {
+		t.Fatalf("sent %+v again before command_retry", commands)
+	}
+
+	hallway, _ := registry.Get("hallway")
+	w := httptest.NewRecorder()
+	sendCommandsHeader(w, hallway)
+
+	if header := w.Header().Get(commandsHeader); header != "" {
+		t.Fatalf("sent %s to a device without the commands capability", header)
+	}
+
+	id = queueTestCommand(t, "kitchen", commandDiagnostic, "")
+	status, reply, failure := postHello(t, helloForm("commands"))
+
+	if status != http.StatusOK {
+		t.Fatalf("hello answered %d: %+v", status, failure)
+	}
+
+	if len(reply.Commands) != 1 || reply.Commands[0].ID != id || reply.Commands[0].Name != commandDiagnostic {
+		t.Fatalf("hello replied with commands %+v, want the diagnostic", reply.Commands)
+	}
+}
+
+// TestCommandRetryAndExpiry checks a command that isn't acknowledged is
+// sent again after command_retry and expires after command_attempts sends
+func TestCommandRetryAndExpiry(t *testing.T) {
+	newTestCommands(t)
+	setting.CommandRetry = 60
+	setting.CommandAttempts = 2
+	id := queueTestCommand(t, "kitchen", commandResyncClock, "")
+	now := time.Now().UTC()
+	deliveries := []struct {
+		after time.Duration
+		sent  int
+	}{
+		{0, 1},
+		{30 * time.Second, 0},
+		{61 * time.Second, 1},
+		{90 * time.Second, 0},
+		{122 * time.Second, 0},
+	}
+
+	for _, delivery := range deliveries {
+		commands, err := deliverCommands("kitchen", now.Add(delivery.after))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(commands) != delivery.sent {
+			t.Fatalf("%d commands sent after %v, want %d", len(commands), delivery.after, delivery.sent)
+		}
+	}
+
+	if command := commandStatus(t, id); command.Status != commandExpired || command.Attempts != 2 {
+		t.Fatalf("command not expired after 2 attempts %+v", command)
+	}
+}
+
+func TestCommandAck(t *testing.T) {
+	newTestCommands(t)
+	done := queueTestCommand(t, "kitchen", commandDiagnostic, "")
+	failed := queueTestCommand(t, "kitchen", commandUploadCSV, "")
+	commandsSent(t)
+	ack := func(id int64, status string, deviceName string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"password":   {"password"},
+			"deviceName": {deviceName},
+			"id":         {strconv.FormatInt(id, 10)},
+			"status":     {status},
+			"result":     {"uptime 3 days"},
+		}
+
+		return postForm(deviceAckHandler, "/api/device/ack", form)
+	}
+
+	if w := ack(done, commandDone, "hallway"); w.Code != http.StatusNotFound {
+		t.Errorf("ack from another device answered %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := ack(done, commandDone, "kitchen"); w.Code != http.StatusOK {
+		t.Fatalf("ack answered %d: %s", w.Code, w.Body.String())
+	}
+
+	if command := commandStatus(t, done); command.Status != commandDone || command.Result != "uptime 3 days" || command.AckedAt == nil {
+		t.Fatalf("ack not recorded %+v", command)
+	}
+
+	// Devices retry acks they didn't get an answer to
+	if w := ack(done, commandDone, "kitchen"); w.Code != http.StatusOK {
+		t.Errorf("repeated ack answered %d, want %d", w.Code, http.StatusOK)
+	}
+
+	if w := ack(done, commandFailed, "kitchen"); w.Code != http.StatusConflict {
+		t.Errorf("failing a done command answered %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if w := ack(failed, commandFailed, "kitchen"); w.Code != http.StatusOK {
+		t.Fatalf("failed ack answered %d: %s", w.Code, w.Body.String())
+	}
+
+	if command := commandStatus(t, failed); command.Status != commandFailed {
+		t.Fatalf("command not failed %+v", command)
+	}
+
+	if w := ack(failed, "maybe", "kitchen"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("unknown status answered %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+
+	if commands := commandsSent(t); len(commands) != 0 {
+		t.Fatalf("acknowledged commands sent again %+v", commands)
+	}
+}
+
+func TestCommandCancel(t *testing.T) {
+	newTestCommands(t)
+	pending := queueTestCommand(t, "kitchen", commandReboot, "")
+
+	if err := cancelCommand(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if commands := commandsSent(t); len(commands) != 0 {
+		t.Fatalf("cancelled command sent %+v", commands)
+	}
+
+	if command := commandStatus(t, pending); command.Status != commandCancelled {
+		t.Fatalf("command not cancelled %+v", command)
+	}
+
+	if err := cancelCommand(pending); err != errCommandFinished {
+		t.Errorf("cancelling twice returned %v, want %v", err, errCommandFinished)
+	}
+
+	delivered := queueTestCommand(t, "kitchen", commandReboot, "")
+	commandsSent(t)
+
+	if err := cancelCommand(delivered); err != nil {
+		t.Fatalf("delivered command not cancelled: %v", err)
+	}
+
+	if err := ackCommand("kitchen", delivered, true, "", time.Now().UTC()); err != errCommandFinished {
+		t.Errorf("acknowledging a cancelled command returned %v, want %v", err, errCommandFinished)
+	}
+
+	if err := cancelCommand(delivered + 1); err != errCommandNotFound {
+		t.Errorf("cancelling an unknown command returned %v, want %v", err, errCommandNotFound)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxComparePoints is the most points a series can have, so a small bin
+// over a long set can't build a huge response
+const maxComparePoints = 10000
+
+// comparePoint is one bin of a series
+// X is hours since the start of the set when aligned relative and unix
+// milliseconds when aligned by wall clock
+type comparePoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// compareSeries is the activity curve of one channel of a set
+type compareSeries struct {
+	DeviceName string         `json:"deviceName"`
+	Set        int            `json:"set"`
+	Channel    string         `json:"channel"`
+	Start      time.Time      `json:"start"`
+	Readings   int            `json:"readings"`
+	Points     []comparePoint `json:"points"`
+}
+
+// parseCompareSeries parses a series such as "pi1:3" or "pi1:0:door", the
+// device, the set (0 for the current readings) and an optional channel
+func parseCompareSeries(value string) (deviceName string, set int, channel string, err error) {
+	parts := strings.Split(value, ":")
+
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", 0, "", errors.New("series must be device:set or device:set:channel, got " + value)
+	}
+
+	if set, err = strconv.Atoi(parts[1]); err != nil {
+		return "", 0, "", errors.New("set of series " + value + " must be a number")
+	}
+
+	channel = motionChannel
+
+	if len(parts) == 3 {
+		channel = parts[2]
+	}
+
+	return parts[0], set, channel, nil
+}
+
+// setStart returns when set of dev started, as recorded when the set was
+// started, or its first reading if that isn't known or came earlier
+func setStart(dev device, set int, readings []reading) (time.Time, error) {
+	start := dev.SetStartedAt
+
+	if set != currentSet {
+		var err error
+
+		if start, err = savedSetStart(dev.Name, set); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if len(readings) > 0 && (start == nil || readings[0].Time.Before(*start)) {
+		return readings[0].Time, nil
+	}
+
+	if start == nil {
+		return time.Time{}, nil
+	}
+
+	return *start, nil
+}
+
+// binActivity counts readings, which must be sorted, into bins of width
+// starting at start, filling bins without readings with 0
+func binActivity(readings []reading, start time.Time, width time.Duration) ([]int, error) {
+	if len(readings) == 0 {
+		return []int{}, nil
+	}
+
+	last := int(readings[len(readings)-1].Time.Sub(start) / width)
+
+	if last >= maxComparePoints {
+		return nil, errors.Errorf("bin is too small for the %s covered, it would need more than %d points",
+			readings[len(readings)-1].Time.Sub(start).Round(time.Second), maxComparePoints)
+	}
+
+	counts := make([]int, last+1)
+
+	for _, reading := range readings {
+		if bin := int(reading.Time.Sub(start) / width); bin >= 0 {
+			counts[bin]++
+		}
+	}
+
+	return counts, nil
+}
+
+// normalizeActivity turns the bin counts into the y values of normalize
+// none keeps the counts, rate is readings per hour, total is the fraction
+// of all readings and peak is the fraction of the busiest bin
+func normalizeActivity(counts []int, width time.Duration, normalize string) []float64 {
+	values := make([]float64, len(counts))
+	total, peak := 0, 0
+
+	for _, count := range counts {
+		total += count
+
+		if count > peak {
+			peak = count
+		}
+	}
+
+	for i, count := range counts {
+		switch normalize {
+		case "rate":
+			values[i] = float64(count) / width.Hours()
+		case "total":
+			values[i] = float64(count) / math.Max(float64(total), 1)
+		case "peak":
+			values[i] = float64(count) / math.Max(float64(peak), 1)
+		default:
+			values[i] = float64(count)
+		}
+	}
+
+	return values
+}
+
+// compareHandler is an api endpoint that returns the activity curves of
+// the sets passed as series (repeated, e.g. series=pi1:3&series=pi2:5) so
+// they can be overlaid
+// align is relative (the default) to line the sets up by time since they
+// started or wallclock to keep them at the time they were recorded, bin is
+// the width of each point in minutes (5 by default) and normalize is one
+// of none (the default), rate, total or peak
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	align := r.Form.Get("align")
+	normalize := r.Form.Get("normalize")
+	width := 5 * time.Minute
+
+	if align == "" {
+		align = "relative"
+	}
+
+	if normalize == "" {
+		normalize = "none"
+	}
+
+	if align != "relative" && align != "wallclock" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("align must be relative or wallclock"))
+		return
+	}
+
+	if normalize != "none" && normalize != "rate" && normalize != "total" && normalize != "peak" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("normalize must be none, rate, total or peak"))
+		return
+	}
+
+	if value := r.Form.Get("bin"); value != "" {
+		minutes, err := parsePositiveInt(value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("bin " + err.Error()))
+			return
+		}
+
+		width = time.Duration(minutes) * time.Minute
+	}
+
+	if len(r.Form["series"]) == 0 {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Must pass at least one series"))
+		return
+	}
+
+	series := make([]compareSeries, 0, len(r.Form["series"]))
+
+	for _, value := range r.Form["series"] {
+		deviceName, set, channel, err := parseCompareSeries(value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		dev, readings, err := readActivity(deviceName, channel, set, time.Time{}, time.Time{})
+
+		if err != nil {
+			writeActivityError(w, deviceName, err)
+			return
+		}
+
+		start, err := setStart(dev, set, readings)
+
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't read when set started")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Couldn't read when set started"))
+			return
+		}
+
+		binStart := start
+
+		// Wall clock bins are lined up on the bin width so bins of
+		// different sets cover the same times
+		if align == "wallclock" {
+			binStart = start.Truncate(width)
+		}
+
+		counts, err := binActivity(readings, binStart, width)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		points := make([]comparePoint, 0, len(counts))
+
+		for i, value := range normalizeActivity(counts, width, normalize) {
+			x := (time.Duration(i) * width).Hours()
+
+			if align == "wallclock" {
+				x = float64(binStart.Add(time.Duration(i)*width).UnixNano() / int64(time.Millisecond))
+			}
+
+			points = append(points, comparePoint{X: x, Y: value})
+		}
+
+		series = append(series, compareSeries{
+			DeviceName: deviceName,
+			Set:        set,
+			Channel:    channel,
+			Start:      start.In(setting.DisplayLocation),
+			Readings:   len(readings),
+			Points:     points,
+		})
+	}
+
+	sendPayload(w, map[string]interface{}{
+		"align":      align,
+		"normalize":  normalize,
+		"binMinutes": int(width.Minutes()),
+		"series":     series,
+	})
+}
+
+// compareView renders the page for overlaying sets of different devices
+func compareView(w http.ResponseWriter, r *http.Request) {
+	context := dashboardContext(r)
+	context["devices"] = registry.Snapshot()
+	tpl.ExecuteTemplate(w, "compare.html", context)
+}
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+)
+
+// envPrefix is prepended to the upper cased key of a setting to get the
+// name of the environment variable that can be used to set it
+const envPrefix = "RPI_SERVER_"
+
+// settingOption describes a single setting that can be given in server.ini,
+// as an environment variable or as a command line flag
+// Flags take precedence over environment variables which take precedence
+// over server.ini which takes precedence over the default value
+type settingOption struct {
+	key          string
+	defaultValue func() string
+	comment      []string
+	set          func(value string) error
+}
+
+var (
+	configFlag        = flag.String("config", "", "Path to server.ini config file (env "+envPrefix+"CONFIG)")
+	projectRootFlag   = flag.String("project-root", "", "Directory data paths default to being under, ~/"+projectName+" if not given (env "+envPrefix+"PROJECT_ROOT)")
+	wipeFlag          = new(wipeModeFlag)
+	yesFlag           = flag.Bool("yes", false, "Don't ask for confirmation before wiping, for scripted use")
+	dryRunFlag        = flag.Bool("dry-run", false, "With restore, only verify the archive without restoring it and with migrate, only print pending migrations")
+	roleFlag          = flag.String("role", roleViewer, "With user add or user set, the role of the user, one of viewer, operator or admin")
+	resetPasswordFlag = flag.Bool("reset-password", false, "With user set, also ask for a new password")
+	settingFlags      = make(map[string]*string)
+	subcommand        string
+	subcommandArgs    []string
+)
+
+// settingOptions is every setting the server knows about, in the order
+// they are written to a newly created server.ini
+var settingOptions = []settingOption{
+	{
+		key:          "ip_address",
+		defaultValue: staticDefault("localhost"),
+		comment: []string{
+			"Ip address the server is given on local network",
+			"Standard is 192.168.x.xx",
+		},
+		set: func(value string) error {
+			setting.IPAddress = value
+			return nil
+		},
+	},
+	{
+		key:          "port",
+		defaultValue: staticDefault(":8003"),
+		comment: []string{
+			"Port that the server will listen on",
+		},
+		set: func(value string) error {
+			if !strings.HasPrefix(value, ":") {
+				return errors.New("must start with ':' e.g. :8003")
+			}
+			if _, err := strconv.ParseUint(value[1:], 10, 16); err != nil {
+				return errors.New("must be a port number between 0 and 65535")
+			}
+			setting.Port = value
+			return nil
+		},
+	},
+	{
+		key:          "password",
+		defaultValue: staticDefault("password"),
+		comment: []string{
+			"Password that will be used in post requests from device",
+			"Should be the same as the client.ini file",
+		},
+		set: func(value string) error {
+			if value == "" {
+				return errors.New("can't be empty")
+			}
+			setting.Password = value
+			return nil
+		},
+	},
+	{
+		key:          "dashboard_password",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Password used to log in to the dashboard until the first user is",
+			"added, which adds them as an admin, kept apart from the device",
+			"password above so browsers never need it",
+			"Left empty the first admin has to be added with server user add",
+		},
+		set: func(value string) error {
+			if value != "" && len(value) < minPasswordLength {
+				return fmt.Errorf("must be at least %d characters", minPasswordLength)
+			}
+
+			setting.DashboardPassword = value
+			return nil
+		},
+	},
+	{
+		key:          "session_timeout",
+		defaultValue: staticDefault("720"),
+		comment: []string{
+			"The number (in minutes) a dashboard login lasts without being",
+			"used before having to log in again",
+		},
+		set: func(value string) (err error) {
+			setting.SessionTimeout, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "rate_limit",
+		defaultValue: staticDefault("20"),
+		comment: []string{
+			"The number of requests per second a single ip address can make",
+			"to the device endpoints and the login page, bursts of twice",
+			"as many are allowed",
+		},
+		set: func(value string) (err error) {
+			setting.RateLimit, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "device_rate_limit",
+		defaultValue: staticDefault("10"),
+		comment: []string{
+			"The number of requests per second a single device can make,",
+			"bursts of twice as many are allowed",
+		},
+		set: func(value string) (err error) {
+			setting.DeviceRateLimit, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "login_attempts",
+		defaultValue: staticDefault("5"),
+		comment: []string{
+			"The number of wrong passwords an ip address can send, to the",
+			"device endpoints or the login page, before it is locked out",
+		},
+		set: func(value string) (err error) {
+			setting.LoginAttempts, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "lockout_time",
+		defaultValue: staticDefault("15"),
+		comment: []string{
+			"The number (in minutes) an ip address stays locked out, wrong",
+			"passwords are also forgotten after this long",
+		},
+		set: func(value string) (err error) {
+			setting.LockoutTime, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "https",
+		defaultValue: staticDefault("false"),
+		comment: []string{
+			"Determines if requests be made over https or not",
+			"Strongly encouraged to have https as the password",
+			"above will be sent in plain text though this requires",
+			"setting up a ssl cert",
+			"This setting must be the same in the server.ini",
+		},
+		set: func(value string) (err error) {
+			setting.HTTPS, err = strconv.ParseBool(value)
+			return errors.Wrap(err, "must be true or false")
+		},
+	},
+	{
+		key: "cert_file",
+		defaultValue: func() string {
+			return setting.ProjectRoot + "/ssl/cert_file.crt"
+		},
+		comment: []string{
+			"Path to cert file",
+			"If https is set to true, this has to be filled out",
+		},
+		set: func(value string) error {
+			setting.CertFile = value
+			return nil
+		},
+	},
+	{
+		key: "key_file",
+		defaultValue: func() string {
+			return setting.ProjectRoot + "/ssl/key_file.crt"
+		},
+		comment: []string{
+			"Path to key file",
+			"If https is set to true, this has to be filled out",
+		},
+		set: func(value string) error {
+			setting.KeyFile = value
+			return nil
+		},
+	},
+	{
+		key:          "time_out",
+		defaultValue: staticDefault("5"),
+		comment: []string{
+			"The number (in seconds) that determines how long a device",
+			"can be inactive for before it is considered not working",
+			"and be considered not checked in",
+			"This settings should always be more than the 'sleep' setting",
+			"in client.ini",
+		},
+		set: func(value string) (err error) {
+			setting.TimeOut, err = strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return errors.New("must be a whole number of seconds")
+			}
+			if setting.TimeOut < 1 {
+				return errors.New("must be at least 1 second")
+			}
+			return nil
+		},
+	},
+	{
+		key:          "sleep_interval",
+		defaultValue: staticDefault("2"),
+		comment: []string{
+			"The number (in seconds) devices using the hello handshake wait",
+			"between readings, replacing the 'sleep' setting in their",
+			"client.ini",
+			"This setting has to be less than 'time_out'",
+		},
+		set: func(value string) (err error) {
+			setting.SleepInterval, err = strconv.ParseFloat(value, 64)
+
+			if err != nil || setting.SleepInterval <= 0 {
+				return errors.New("must be a number of seconds greater than 0")
+			}
+
+			return nil
+		},
+	},
+	{
+		key:          "command_retry",
+		defaultValue: staticDefault("60"),
+		comment: []string{
+			"The number (in seconds) to wait for a device to acknowledge a",
+			"command before sending it again",
+		},
+		set: func(value string) (err error) {
+			setting.CommandRetry, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "command_attempts",
+		defaultValue: staticDefault("5"),
+		comment: []string{
+			"The number of times a command is sent to a device before",
+			"giving up on it being acknowledged",
+		},
+		set: func(value string) (err error) {
+			setting.CommandAttempts, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "csv_directory",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Directory the current csv file of each device is written to",
+			"Leave empty to use the csv directory under the project root",
+		},
+		set: func(value string) error {
+			setting.CsvDirectory = resolvePath(value, setting.ProjectRoot, "csv")
+			return nil
+		},
+	},
+	{
+		key:          "sets_directory",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Directory finished sets of each device are moved to",
+			"Leave empty to use the sets directory under csv_directory",
+		},
+		set: func(value string) error {
+			setting.SetsDirectory = resolvePath(value, setting.CsvDirectory, "sets")
+			return nil
+		},
+	},
+	{
+		key:          "db_file",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Path to the sqlite database file",
+			"Leave empty to use server.db under the project root",
+		},
+		set: func(value string) error {
+			setting.ServerDBFile = resolvePath(value, setting.ProjectRoot, "server.db")
+			return nil
+		},
+	},
+	{
+		key:          "templates_directory",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Directory html templates are loaded from",
+			"Leave empty to use the templates directory under the project root",
+		},
+		set: func(value string) error {
+			setting.TemplatesDirectory = resolvePath(value, setting.ProjectRoot, "templates")
+			return nil
+		},
+	},
+	{
+		key:          "storage",
+		defaultValue: staticDefault("csv"),
+		comment: []string{
+			"Where readings are stored, either csv or sqlite",
+			"csv keeps a csv file per device in csv_directory and a csv file",
+			"per set in sets_directory, sqlite keeps them in the database",
+		},
+		set: func(value string) error {
+			if value != "csv" && value != "sqlite" {
+				return errors.New("must be csv or sqlite")
+			}
+			setting.Storage = value
+			return nil
+		},
+	},
+	{
+		key:          "flush_interval",
+		defaultValue: staticDefault("5"),
+		comment: []string{
+			"The number (in seconds) readings and device check in times are",
+			"kept in memory before being written to disk, higher values",
+			"mean fewer writes to the sd card but more lost on a power cut",
+		},
+		set: func(value string) (err error) {
+			setting.FlushInterval, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "occupancy",
+		defaultValue: staticDefault("false"),
+		comment: []string{
+			"Determines if every reading, with or without motion, is recorded",
+			"as motion, no motion and offline intervals per device so the",
+			"time a sensor was actually running is known",
+		},
+		set: func(value string) (err error) {
+			setting.Occupancy, err = strconv.ParseBool(value)
+			return errors.Wrap(err, "must be true or false")
+		},
+	},
+	{
+		key:          "clock_skew_threshold",
+		defaultValue: staticDefault("60"),
+		comment: []string{
+			"The number (in seconds) a device clock can be off from the server",
+			"clock before the device is flagged on the dashboard",
+		},
+		set: func(value string) (err error) {
+			setting.ClockSkewThreshold, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "clock_skew_mode",
+		defaultValue: staticDefault("ignore"),
+		comment: []string{
+			"What is done with device clock skew when saving readings",
+			"ignore saves the time sent by the device, both saves the time",
+			"the server received the reading as well and correct saves the",
+			"device time moved by the measured skew",
+		},
+		set: func(value string) error {
+			if value != "ignore" && value != "both" && value != "correct" {
+				return errors.New("must be ignore, both or correct")
+			}
+			setting.ClockSkewMode = value
+			return nil
+		},
+	},
+	{
+		key:          "display_timezone",
+		defaultValue: staticDefault("UTC"),
+		comment: []string{
+			"Time zone charts and downloaded csv files are shown in,",
+			"e.g. America/Chicago",
+		},
+		set: func(value string) (err error) {
+			setting.DisplayLocation, err = loadLocation(value)
+			if err != nil {
+				return errors.New("must be a time zone name like UTC or America/Chicago")
+			}
+			setting.DisplayTimezone = value
+			return nil
+		},
+	},
+	{
+		key:          "bout_gap",
+		defaultValue: staticDefault("60"),
+		comment: []string{
+			"The longest gap (in seconds) between two readings of the same",
+			"bout of motion in analytics",
+		},
+		set: func(value string) (err error) {
+			setting.BoutGap, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "day_hours",
+		defaultValue: staticDefault("7-19"),
+		comment: []string{
+			"The hours counted as day in analytics as <start>-<end> in the",
+			"display timezone, e.g. 7-19 for lights on at 7am and off at 7pm",
+		},
+		set: func(value string) (err error) {
+			setting.DayStartHour, setting.DayEndHour, err = parseDayHours(value)
+			return err
+		},
+	},
+	{
+		key:          "custom_assets",
+		defaultValue: staticDefault("false"),
+		comment: []string{
+			"Determines if html templates and files under /static/ are first",
+			"looked for in templates_directory before using the ones built",
+			"into the server.  Run 'server export-assets' to get copies to edit",
+		},
+		set: func(value string) (err error) {
+			setting.CustomAssets, err = strconv.ParseBool(value)
+			return errors.Wrap(err, "must be true or false")
+		},
+	},
+	{
+		key:          "backup_time",
+		defaultValue: staticDefault(""),
+		comment: []string{
+			"Time of day (24 hour HH:MM) a backup of the database, csv files",
+			"and sets is written to the backups directory every day",
+			"Leave empty to turn off scheduled backups",
+		},
+		set: func(value string) error {
+			if value != "" {
+				if _, err := time.Parse("15:04", value); err != nil {
+					return errors.New("must be a 24 hour time like 02:30")
+				}
+			}
+			setting.BackupTime = value
+			return nil
+		},
+	},
+	{
+		key:          "backup_retention",
+		defaultValue: staticDefault("7"),
+		comment: []string{
+			"Number of scheduled backups to keep before the oldest is removed",
+		},
+		set: func(value string) (err error) {
+			setting.BackupRetention, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "log_level",
+		defaultValue: staticDefault("info"),
+		comment: []string{
+			"Lowest level that will be written to the log file",
+			"Can be one of debug, info, warn or error",
+		},
+		set: func(value string) error {
+			switch value {
+			case "debug", "info", "warn", "error":
+				setting.LogLevel = value
+				return nil
+			}
+			return errors.New("must be one of debug, info, warn or error")
+		},
+	},
+	{
+		key:          "log_format",
+		defaultValue: staticDefault("logfmt"),
+		comment: []string{
+			"Format of each log line, either logfmt or json",
+		},
+		set: func(value string) error {
+			if value != "logfmt" && value != "json" {
+				return errors.New("must be logfmt or json")
+			}
+			setting.LogFormat = value
+			return nil
+		},
+	},
+	{
+		key:          "log_max_size",
+		defaultValue: staticDefault("10"),
+		comment: []string{
+			"Size (in megabytes) the log file can grow to before it is rotated",
+		},
+		set: func(value string) (err error) {
+			setting.LogMaxSize, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "log_max_age",
+		defaultValue: staticDefault("28"),
+		comment: []string{
+			"Number of days rotated log files are kept before being removed",
+		},
+		set: func(value string) (err error) {
+			setting.LogMaxAge, err = parsePositiveInt(value)
+			return err
+		},
+	},
+	{
+		key:          "log_max_backups",
+		defaultValue: staticDefault("5"),
+		comment: []string{
+			"Number of rotated log files that are kept before being removed",
+		},
+		set: func(value string) (err error) {
+			setting.LogMaxBackups, err = parsePositiveInt(value)
+			return err
+		},
+	},
+}
+
+// staticDefault is a helper for settings whose default value does not
+// depend on any other setting
+func staticDefault(value string) func() string {
+	return func() string {
+		return value
+	}
+}
+
+// parsePositiveInt parses setting values that have to be a number above 0
+func parsePositiveInt(value string) (int, error) {
+	number, err := strconv.Atoi(value)
+
+	if err != nil || number < 1 {
+		return 0, errors.New("must be a whole number greater than 0")
+	}
+
+	return number, nil
+}
+
+// resolvePath returns value as an absolute path, or name under parent
+// if value is empty
+func resolvePath(value string, parent string, name string) string {
+	if value == "" {
+		return filepath.Join(parent, name)
+	}
+
+	if path, err := filepath.Abs(value); err == nil {
+		return path
+	}
+
+	return value
+}
+
+// envName returns the environment variable that can be used to set key
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(key)
+}
+
+// flagName returns the command line flag that can be used to set key
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// parseCommandLine registers a flag for every setting, picks out
+// subcommands and parses command line arguments
+// The subcommand is the first argument that isn't a flag, e.g.
+// "server validate-config -config /etc/server.ini", and its own arguments
+// can be mixed with flags, e.g. "server user add alice -role admin"
+func parseCommandLine() {
+	flag.Var(wipeFlag, "wipe", "Backs up and then wipes out data to start fresh, one of db (database only), csv (current readings only) or all (database, current readings and sets), all if given without a mode")
+
+	for _, option := range settingOptions {
+		usage := fmt.Sprintf("%s (env %s)", strings.Join(option.comment, " "), envName(option.key))
+		settingFlags[option.key] = flag.String(flagName(option.key), "", usage)
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [validate-config|export-assets|backup|restore|migrate|user] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Settings are read from flags first, then environment variables, then\n")
+		fmt.Fprintf(os.Stderr, "server.ini and finally fall back to their default value\n\n")
+		flag.PrintDefaults()
+	}
+
+	args := joinWipeMode(os.Args[1:])
+
+	for len(args) > 0 {
+		if len(args[0]) > 1 && strings.HasPrefix(args[0], "-") {
+			flag.CommandLine.Parse(args)
+			args = flag.Args()
+			continue
+		}
+
+		subcommandArgs = append(subcommandArgs, args[0])
+		args = args[1:]
+	}
+
+	if len(subcommandArgs) > 0 {
+		subcommand = subcommandArgs[0]
+		subcommandArgs = subcommandArgs[1:]
+	}
+
+	switch subcommand {
+	case "", "validate-config", "export-assets", "backup", "restore", "migrate", "user":
+	default:
+		fmt.Printf("Unknown command %q\n", subcommand)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// flagPassed determines if the flag called name was given on the command
+// line, telling a flag left at its default apart from one set to it
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// settingSources returns the value of every setting along with where it
+// came from after merging defaults, server.ini, environment variables and
+// flags, as well as any problems found while reading server.ini
+func settingSources() (values map[string]string, sources map[string]string, problems []error) {
+	values = make(map[string]string)
+	sources = make(map[string]string)
+	known := make(map[string]bool)
+
+	for _, option := range settingOptions {
+		values[option.key] = option.defaultValue()
+		sources[option.key] = "default"
+		known[option.key] = true
+	}
+
+	cfg, err := ini.Load(setting.ServerConfigFile)
+
+	if err != nil {
+		problems = append(problems, errors.Wrap(err, "Couldn't load "+setting.ServerConfigFile))
+	} else {
+		defaultSection, err := cfg.GetSection("DEFAULT")
+
+		if err != nil {
+			problems = append(problems, errors.New("No default section in "+setting.ServerConfigFile))
+		} else {
+			for _, key := range defaultSection.Keys() {
+				if !known[key.Name()] {
+					problems = append(problems, fmt.Errorf("%s: unknown setting in %s", key.Name(), setting.ServerConfigFile))
+					continue
+				}
+
+				values[key.Name()] = key.Value()
+				sources[key.Name()] = setting.ServerConfigFile
+			}
+		}
+	}
+
+	for _, option := range settingOptions {
+		if value, ok := os.LookupEnv(envName(option.key)); ok {
+			values[option.key] = value
+			sources[option.key] = "env " + envName(option.key)
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		key := strings.Replace(f.Name, "-", "_", -1)
+
+		if known[key] {
+			values[key] = f.Value.String()
+			sources[key] = "flag -" + f.Name
+		}
+	})
+
+	return values, sources, problems
+}
+
+// applySettings merges every source of settings into our global settings
+// struct and returns every problem found instead of stopping at the first
+func applySettings() []error {
+	values, sources, problems := settingSources()
+
+	for _, option := range settingOptions {
+		if err := option.set(strings.TrimSpace(values[option.key])); err != nil {
+			problems = append(problems, fmt.Errorf("%s (from %s): %v", option.key, sources[option.key], err))
+		}
+	}
+
+	if setting.SleepInterval >= float64(setting.TimeOut) {
+		problems = append(problems, fmt.Errorf("sleep_interval: %v has to be less than time_out (%d)", setting.SleepInterval, setting.TimeOut))
+	}
+
+	if setting.HTTPS {
+		if _, err := os.Stat(setting.CertFile); err != nil {
+			problems = append(problems, fmt.Errorf("cert_file: %s does not exist but https is true", setting.CertFile))
+		}
+		if _, err := os.Stat(setting.KeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("key_file: %s does not exist but https is true", setting.KeyFile))
+		}
+	}
+
+	return problems
+}
+
+// loadSettingsFile loads settings from config file, environment variables
+// and flags and assigns values to our settings struct
+// Every problem found is printed before exiting
+func loadSettingsFile() {
+	problems := applySettings()
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		checkError(errors.Errorf("%d problem(s) found", len(problems)), "Invalid configuration", true)
+	}
+}
+
+// validateConfig is the validate-config subcommand which reports every
+// problem with the current configuration along with where each setting
+// value came from, and exits
+func validateConfig() {
+	_, sources, _ := settingSources()
+	problems := applySettings()
+	keys := make([]string, 0, len(sources))
+
+	for key := range sources {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	fmt.Println("Config file: " + setting.ServerConfigFile)
+
+	for _, key := range keys {
+		fmt.Printf("  %-16s from %s\n", key, sources[key])
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("Configuration is valid")
+		os.Exit(0)
+	}
+
+	fmt.Printf("Found %d problem(s):\n", len(problems))
+
+	for _, problem := range problems {
+		fmt.Println("  " + problem.Error())
+	}
+
+	os.Exit(1)
+}
+
+// writeDefaultConfigFile writes a new server.ini with every setting,
+// using overrides for the values the user gave on first run
+func writeDefaultConfigFile(overrides map[string]string) error {
+	configFile, err := os.Create(setting.ServerConfigFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer configFile.Close()
+	writeToFile := "[DEFAULT] \n"
+
+	for _, option := range settingOptions {
+		value, ok := overrides[option.key]
+
+		if !ok {
+			value = option.defaultValue()
+		}
+
+		for _, line := range option.comment {
+			writeToFile += "# " + line + " \n"
+		}
+
+		writeToFile += option.key + "=" + value + " \n\n"
+	}
+
+	_, err = configFile.WriteString(writeToFile)
+	return err
+}
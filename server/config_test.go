@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+// TestSettingPrecedence checks flags win over environment variables, which
+// win over server.ini, which wins over the default value
+func TestSettingPrecedence(t *testing.T) {
+	newTestDatabase(t)
+	contents := "time_out = 7\ncommand_attempts = 6\nsleep_interval = 3\n"
+
+	if err := ioutil.WriteFile(setting.ServerConfigFile, []byte(contents), fileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(envName("command_attempts"), "8")
+	t.Setenv(envName("sleep_interval"), "4")
+	oldCommandLine := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("server", flag.ContinueOnError)
+	defer func() { flag.CommandLine = oldCommandLine }()
+	flag.String(flagName("sleep_interval"), "", "")
+
+	if err := flag.CommandLine.Parse([]string{"-sleep-interval=1.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := applySettings(); len(problems) != 0 {
+		t.Fatalf("settings have problems: %v", problems)
+	}
+
+	if setting.CommandRetry != 60 || setting.TimeOut != 7 || setting.CommandAttempts != 8 || setting.SleepInterval != 1.5 {
+		t.Errorf("command_retry %d, time_out %d, command_attempts %d and sleep_interval %v, want 60, 7, 8 and 1.5",
+			setting.CommandRetry, setting.TimeOut, setting.CommandAttempts, setting.SleepInterval)
+	}
+
+	_, sources, _ := settingSources()
+	want := map[string]string{
+		"command_retry":    "default",
+		"time_out":         setting.ServerConfigFile,
+		"command_attempts": "env " + envName("command_attempts"),
+		"sleep_interval":   "flag -sleep-interval",
+	}
+
+	for key, source := range want {
+		if sources[key] != source {
+			t.Errorf("%s is from %q, want %q", key, sources[key], source)
+		}
+	}
+}
+
+// TestSettingProblemsAreAllReported checks every bad setting is reported
+// rather than only the first
+func TestSettingProblemsAreAllReported(t *testing.T) {
+	newTestDatabase(t)
+	contents := "command_attempts = many\nclock_skew_mode = guess\nfavourite_colour = blue\n"
+
+	if err := ioutil.WriteFile(setting.ServerConfigFile, []byte(contents), fileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := applySettings(); len(problems) != 3 {
+		t.Fatalf("%d problems %v, want 3", len(problems), problems)
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"sync"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -37,18 +38,69 @@ type device struct {
 	IsNewSet          bool       `json:"isNewSet" db:"is_new_set"`
 	IsRecording       bool       `json:"isRecording" db:"is_recording"`
 	IsCheckedIn       bool       `json:"isCheckedIn" db:"is_checked_in"`
+	Timezone          string     `json:"timezone" db:"timezone"`
+
+	// ProtocolVersion and Capabilities are what the device reported in
+	// its last hello, legacy devices that only check in have version 0
+	ProtocolVersion int    `json:"protocolVersion" db:"protocol_version"`
+	Capabilities    string `json:"capabilities" db:"capabilities"`
+
+	// ConfigGroup is the group whose client config the device gets and
+	// ConfigRevision the revision it was moved into it at, see
+	// clientconfig.go
+	// AppliedConfigVersion is the version of its client config the device
+	// last reported applying
+	ConfigGroup          string     `json:"configGroup" db:"config_group"`
+	ConfigRevision       int        `json:"configRevision" db:"config_revision"`
+	AppliedConfigVersion int        `json:"appliedConfigVersion" db:"applied_config_version"`
+	ConfigAppliedAt      *time.Time `json:"configAppliedAt" db:"config_applied_at"`
+
+	// SetStartedAt is when the current set started, which is when the
+	// device first checked in or its last set was started
+	// It is nil for devices that never started a set before it was kept
+	SetStartedAt *time.Time `json:"setStartedAt" db:"set_started_at"`
+
+	// ClockSkew is how many seconds the clock of the device is ahead of
+	// the server, measured from the readings it sends
+	ClockSkew float64 `json:"clockSkew" db:"-"`
+}
+
+// Supports determines if d reported capability in its last hello
+func (d device) Supports(capability string) bool {
+	for _, c := range strings.Split(d.Capabilities, ",") {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClockSkewSeconds returns the clock skew of d rounded to whole seconds
+func (d device) ClockSkewSeconds() int {
+	return int(math.Round(d.ClockSkew))
 }
 
-type devCenter struct {
-	sync.RWMutex
-	NumOfDevices int
-	Devices      map[string]*device
+// IsClockSkewed determines if the clock of d is off by more than the
+// clock_skew_threshold setting
+func (d device) IsClockSkewed() bool {
+	return math.Abs(d.ClockSkew) > float64(setting.ClockSkewThreshold)
+}
+
+// correctClockSkew moves t, a time sent by a device whose clock is
+// clockSkew seconds ahead of the server, onto the server clock
+func correctClockSkew(t time.Time, clockSkew float64) time.Time {
+	return t.Add(-time.Duration(clockSkew * float64(time.Second))).Round(time.Second)
 }
 
 type chart struct {
 	DeviceName  string      `json:"deviceName"`
+	Channel     string      `json:"channel"`
 	TimeMeasure string      `json:"timeMeasure"`
 	Axises      map[int]int `json:"axises"`
+
+	// Values holds the average of each tick mark for numeric channels
+	Values map[int]float64 `json:"values,omitempty"`
 }
 
 // type chartRow struct {
@@ -63,11 +115,40 @@ type settings struct {
 	Port               string
 	Password           string
 	HTTPS              bool
+	DashboardPassword  string
+	SessionTimeout     int
+	RateLimit          int
+	DeviceRateLimit    int
+	LoginAttempts      int
+	LockoutTime        int
+	CertFile           string
+	KeyFile            string
 	TimeOut            int64
+	SleepInterval      float64
+	CommandRetry       int
+	CommandAttempts    int
 	ProjectRoot        string
 	ServerDBFile       string
 	ServerConfigFile   string
 	TemplatesDirectory string
 	CsvDirectory       string
 	SetsDirectory      string
+	Storage            string
+	FlushInterval      int
+	Occupancy          bool
+	ClockSkewThreshold int
+	ClockSkewMode      string
+	DisplayTimezone    string
+	DisplayLocation    *time.Location
+	BoutGap            int
+	DayStartHour       int
+	DayEndHour         int
+	CustomAssets       bool
+	BackupTime         string
+	BackupRetention    int
+	LogLevel           string
+	LogFormat          string
+	LogMaxSize         int
+	LogMaxAge          int
+	LogMaxBackups      int
 }
@@ -0,0 +1,57 @@
+#!/bin/sh
+# Updates the third party javascript, css and fonts the dashboard uses,
+# which are kept in static/ so the server builds and runs without internet
+# access.  Every file is downloaded into a temporary directory and checked
+# against vendor.sha256 before it replaces the one in static/.  After
+# changing a version below run with -record, which writes the checksums of
+# the new files to vendor.sha256 instead, and review them before committing.
+set -e
+
+server="$(cd "$(dirname "$0")" && pwd)"
+checksums="$server/vendor.sha256"
+download="$(mktemp -d)"
+trap 'rm -rf "$download"' EXIT
+
+fetch() {
+	echo "Fetching $2"
+	mkdir -p "$download/$(dirname "$2")"
+	curl -sfL -o "$download/$2" "$1"
+}
+
+fetch https://cdn.jsdelivr.net/npm/bootstrap@3.3.7/dist/css/bootstrap.min.css css/bootstrap.min.css
+fetch https://cdn.jsdelivr.net/npm/bootstrap@3.3.7/dist/js/bootstrap.min.js js/bootstrap.min.js
+
+for ext in eot svg ttf woff woff2; do
+	fetch https://cdn.jsdelivr.net/npm/bootstrap@3.3.7/dist/fonts/glyphicons-halflings-regular.$ext fonts/glyphicons-halflings-regular.$ext
+done
+
+fetch https://cdn.jsdelivr.net/npm/toastr@2.1.4/build/toastr.min.css css/toastr.min.css
+fetch https://cdn.jsdelivr.net/npm/toastr@2.1.4/build/toastr.min.js js/toastr.min.js
+fetch https://cdn.jsdelivr.net/npm/jquery@2.1.3/dist/jquery.min.js js/jquery.min.js
+fetch https://cdn.jsdelivr.net/npm/chart.js@2.4.0/dist/Chart.min.js js/Chart.min.js
+fetch https://cdn.jsdelivr.net/npm/moment@2.18.1/min/moment.min.js js/moment.min.js
+
+cd "$download"
+
+if [ "$1" = "-record" ]; then
+	find . -type f | sed 's|^\./||' | sort | xargs sha256sum > "$checksums"
+	echo "Recorded checksums in $checksums, review them before committing"
+else
+	if [ ! -f "$checksums" ]; then
+		echo "$checksums not found, run with -record to write it" >&2
+		exit 1
+	fi
+
+	# Every download has to be listed, not only match the files that are
+	for file in $(find . -type f | sed 's|^\./||'); do
+		if ! grep -q "  $file\$" "$checksums"; then
+			echo "$file has no checksum in $checksums, run with -record after reviewing it" >&2
+			exit 1
+		fi
+	done
+
+	sha256sum -c --quiet "$checksums"
+fi
+
+cp -R . "$server/static/"
+echo "Updated $server/static"
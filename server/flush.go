@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownComplete is closed once handleShutdown has stopped the server
+// and flushed everything, main waits on it before returning
+var shutdownComplete = make(chan struct{})
+
+// flushWrites will be run on a seperate go routine and writes buffered
+// readings and check in times to disk every flush_interval seconds
+func flushWrites() {
+	sleepDuration := time.Duration(setting.FlushInterval) * time.Second
+
+	for {
+		time.Sleep(sleepDuration)
+		flushAll()
+	}
+}
+
+// flushAll writes every buffered reading and check in time to disk
+func flushAll() {
+	if err := store.Flush(); err != nil {
+		logger.WithError(err).Error("Couldn't flush readings")
+	}
+
+	if err := registry.FlushCheckIns(); err != nil {
+		logger.WithError(err).Error("Couldn't flush check in times")
+	}
+
+	if occupancy != nil {
+		if err := occupancy.Flush(); err != nil {
+			logger.WithError(err).Error("Couldn't flush occupancy intervals")
+		}
+	}
+}
+
+// handleShutdown waits for an interrupt or terminate signal, stops
+// accepting requests and flushes what is still buffered so stopping the
+// server doesn't lose readings
+func handleShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	logger.Info("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+		logger.WithError(err).Warn("Requests were still running at shutdown")
+	}
+
+	flushAll()
+	close(shutdownComplete)
+}
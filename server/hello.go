@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minProtocolVersion and maxProtocolVersion are the device protocol
+	// versions the server speaks, devices that only check in are version 0
+	minProtocolVersion = 1
+	maxProtocolVersion = 1
+)
+
+// Capabilities a device can report in its hello
+// channels devices send "<channel>=<value>;..." readings, rfc3339 devices
+// send RFC 3339 times, timezone devices declare the time zone of their
+// local times, commands devices carry out the commands sent to them and
+// config devices apply the client config the server holds for them
+const (
+	capabilityChannels = "channels"
+	capabilityRFC3339  = "rfc3339"
+	capabilityTimezone = "timezone"
+	capabilityCommands = "commands"
+	capabilityConfig   = "config"
+)
+
+// serverCapabilities is every capability the server understands
+var serverCapabilities = []string{
+	capabilityChannels,
+	capabilityRFC3339,
+	capabilityTimezone,
+	capabilityCommands,
+	capabilityConfig,
+}
+
+// Codes of errors sent to devices by the json device endpoints, so
+// devices don't have to match messages
+const (
+	deviceErrorMethod   = "method_not_allowed"
+	deviceErrorPassword = "wrong_password"
+	deviceErrorVersion  = "unsupported_protocol_version"
+	deviceErrorInvalid  = "invalid_request"
+	deviceErrorNotFound = "not_found"
+	deviceErrorFinished = "already_finished"
+	deviceErrorInternal = "server_error"
+)
+
+const (
+	// newSetCommand tells a device to reset its local csv file as a new
+	// set was started
+	newSetCommand = "new-set"
+
+	// maxDeviceNameLength and maxCapabilities keep hellos to a sane size
+	maxDeviceNameLength = 64
+	maxCapabilities     = 32
+)
+
+// deviceConfig is how the server wants a device to behave
+type deviceConfig struct {
+	SleepInterval float64 `json:"sleepInterval"`
+	TimeOut       int64   `json:"timeOut"`
+	Recording     bool    `json:"recording"`
+	SetNumber     int     `json:"setNumber"`
+}
+
+// deviceCommand is something a device has to do once, such as resetting
+// its local csv file for a new set
+// Commands queued from the dashboard have an ID the device acknowledges
+// them with, see commands.go
+type deviceCommand struct {
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name"`
+	Args string `json:"args,omitempty"`
+}
+
+// helloResponse is what a device gets back from a successful hello
+// ProtocolVersion is the version both sides speak, Capabilities the
+// capabilities of the device the server understands and ClientConfig the
+// client.ini settings the device should have
+type helloResponse struct {
+	ProtocolVersion int             `json:"protocolVersion"`
+	Capabilities    []string        `json:"capabilities"`
+	Config          deviceConfig    `json:"config"`
+	Commands        []deviceCommand `json:"commands"`
+	ClientConfig    clientConfig    `json:"clientConfig"`
+}
+
+// deviceError is what a device gets back from a failed request to a json
+// device endpoint
+type deviceError struct {
+	Error       string `json:"error"`
+	Message     string `json:"message"`
+	MinProtocol int    `json:"minProtocolVersion"`
+	MaxProtocol int    `json:"maxProtocolVersion"`
+}
+
+// writeDeviceError answers a json device endpoint with a typed error
+func writeDeviceError(w http.ResponseWriter, status int, code string, message string) {
+	payload, _ := json.Marshal(deviceError{
+		Error:       code,
+		Message:     message,
+		MinProtocol: minProtocolVersion,
+		MaxProtocol: maxProtocolVersion,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+// checkDevicePassword determines if a request to a json device endpoint
+// for deviceName sent the right password and is within the rate limit of
+// deviceName, answering it with an error if not
+func checkDevicePassword(w http.ResponseWriter, r *http.Request, deviceName string) bool {
+	ok := isDevicePassword(r, deviceName)
+	recordPasswordResult(r, ok)
+
+	if !ok {
+		writeDeviceError(w, http.StatusForbidden, deviceErrorPassword, "Wrong Password")
+		return false
+	}
+
+	return allowDevice(w, deviceName)
+}
+
+// negotiateCapabilities returns the capabilities in reported the server
+// understands, ignoring unknown ones so newer devices still connect
+func negotiateCapabilities(reported string) []string {
+	agreed := make([]string, 0)
+
+	for _, capability := range strings.Split(reported, ",") {
+		capability = strings.TrimSpace(capability)
+
+		for _, known := range serverCapabilities {
+			if capability == known && !containsString(agreed, capability) {
+				agreed = append(agreed, capability)
+			}
+		}
+	}
+
+	return agreed
+}
+
+// containsString determines if values holds value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentDeviceConfig returns the config of dev along with the commands
+// waiting for it
+// A sleep in the client config of dev overrides sleep_interval
+func currentDeviceConfig(dev device) (deviceConfig, []deviceCommand) {
+	config := deviceConfig{
+		SleepInterval: setting.SleepInterval,
+		TimeOut:       setting.TimeOut,
+		Recording:     dev.IsRecording,
+		SetNumber:     dev.SetNum,
+	}
+
+	if sleep, ok := configs.Resolve(dev).Values[clientKeySleep]; ok {
+		config.SleepInterval, _ = strconv.ParseFloat(sleep, 64)
+	}
+
+	commands := make([]deviceCommand, 0)
+
+	if dev.IsNewSet {
+		commands = append(commands, deviceCommand{Name: newSetCommand})
+	}
+
+	return config, commands
+}
+
+// deviceHelloHandler is the versioned handshake of devices, replacing
+// check-in-handler
+// Devices post their password, deviceName, protocolVersion and comma
+// separated capabilities, along with sensors and timezone as they would
+// when checking in and the version of their client config they applied in
+// appliedVersion, and get their config back as json
+// Errors are json too, with a code devices can act on
+func deviceHelloHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeDeviceError(w, http.StatusMethodNotAllowed, deviceErrorMethod, "Request method is not post")
+		return
+	}
+
+	r.ParseForm()
+	deviceName := strings.TrimSpace(r.Form.Get("deviceName"))
+
+	if !checkDevicePassword(w, r, deviceName) {
+		return
+	}
+
+	version, err := strconv.Atoi(r.Form.Get("protocolVersion"))
+
+	if err != nil || version < minProtocolVersion {
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorVersion,
+			"protocolVersion must be a whole number of at least "+strconv.Itoa(minProtocolVersion))
+		return
+	}
+
+	// Newer devices speak the latest version the server knows
+	if version > maxProtocolVersion {
+		version = maxProtocolVersion
+	}
+
+	if deviceName == "" || len(deviceName) > maxDeviceNameLength || strings.ContainsAny(deviceName, ",/\\") {
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid,
+			"deviceName must be 1 to "+strconv.Itoa(maxDeviceNameLength)+" characters without ',', '/' or '\\'")
+		return
+	}
+
+	if len(strings.Split(r.Form.Get("capabilities"), ",")) > maxCapabilities {
+		writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, "Too many capabilities")
+		return
+	}
+
+	if applied := r.Form.Get("appliedVersion"); applied != "" {
+		if version, err := strconv.Atoi(applied); err != nil || version < 0 {
+			writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, "appliedVersion must be a whole number")
+			return
+		}
+	}
+
+	capabilities := negotiateCapabilities(r.Form.Get("capabilities"))
+	var declared []sensor
+
+	if declaration := r.Form.Get("sensors"); declaration != "" {
+		if declared, err = parseSensors(declaration); err != nil {
+			writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, err.Error())
+			return
+		}
+	}
+
+	timezone := r.Form.Get("timezone")
+
+	if timezone != "" {
+		if _, err = loadLocation(timezone); err != nil {
+			writeDeviceError(w, http.StatusNotAcceptable, deviceErrorInvalid, "Unknown time zone "+timezone)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	err = registry.CheckIn(deviceName, now)
+
+	// A device still checked in, e.g. one that rebooted within time_out,
+	// shakes hands again and gets its capabilities and config replaced
+	if err == errAlreadyCheckedIn {
+		_, err = registry.Heartbeat(deviceName, now, false)
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't check in device")
+		writeDeviceError(w, http.StatusInternalServerError, deviceErrorInternal, "Couldn't check in device")
+		return
+	}
+
+	applyDeviceDeclarations(deviceName, declared, timezone)
+
+	if err = registry.SetProtocol(deviceName, version, capabilities); err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't record device protocol")
+	}
+
+	if err = recordAppliedConfig(r, deviceName); err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't record applied client config")
+	}
+
+	dev, _ := registry.Get(deviceName)
+	config, commands := currentDeviceConfig(dev)
+
+	if dev.Supports(capabilityCommands) {
+		queued, err := deliverCommands(deviceName, time.Now().UTC())
+
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't deliver commands")
+		}
+
+		commands = append(commands, queued...)
+	}
+
+	logger.WithField("device", deviceName).WithField("protocol", version).Info("Device said hello")
+	w.Header().Set("Content-Type", "application/json")
+	sendPayload(w, helloResponse{
+		ProtocolVersion: version,
+		Capabilities:    capabilities,
+		Config:          config,
+		Commands:        commands,
+		ClientConfig:    configs.Resolve(dev),
+	})
+}
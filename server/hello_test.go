@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// postHello says hello as deviceName with capabilities and returns the
+// status answered along with the reply, or the error sent instead
+func postHello(t *testing.T, form url.Values) (int, helloResponse, deviceError) {
+	t.Helper()
+	w := postForm(deviceHelloHandler, "/api/device/hello", form)
+	var reply helloResponse
+	var failure deviceError
+
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := json.Unmarshal(w.Body.Bytes(), &failure); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, reply, failure
+}
+
+// helloForm is a hello from kitchen speaking protocol version 1
+func helloForm(capabilities string) url.Values {
+	return url.Values{
+		"password":        {"password"},
+		"deviceName":      {"kitchen"},
+		"protocolVersion": {"1"},
+		"capabilities":    {capabilities},
+	}
+}
+
+func TestHelloNegotiatesCapabilities(t *testing.T) {
+	newTestServer(t)
+	form := helloForm("channels,teleport,commands")
+	form.Set("protocolVersion", "99")
+	form.Set("sensors", "temp:temperature")
+	status, reply, failure := postHello(t, form)
+
+	if status != http.StatusOK {
+		t.Fatalf("hello answered %d: %+v", status, failure)
+	}
+
+	if reply.ProtocolVersion != maxProtocolVersion {
+		t.Errorf("protocol version %d agreed, want %d", reply.ProtocolVersion, maxProtocolVersion)
+	}
+
+	if len(reply.Capabilities) != 2 || reply.Capabilities[0] != capabilityChannels || reply.Capabilities[1] != capabilityCommands {
+		t.Errorf("capabilities %v agreed, want channels and commands", reply.Capabilities)
+	}
+
+	if reply.Config.SleepInterval != setting.SleepInterval || reply.Config.TimeOut != setting.TimeOut || !reply.Config.Recording {
+		t.Errorf("wrong config %+v", reply.Config)
+	}
+
+	if _, ok := sensors.Get("kitchen", "temp"); !ok {
+		t.Error("sensors declared in the hello were not added")
+	}
+
+	dev, _ := registry.Get("kitchen")
+
+	if !dev.IsCheckedIn || dev.ProtocolVersion != maxProtocolVersion || !dev.Supports(capabilityCommands) {
+		t.Errorf("hello not recorded on the device %+v", dev)
+	}
+}
+
+// TestHelloAgainWhileCheckedIn checks a device that reboots and says hello
+// before it timed out shakes hands again instead of being refused
+func TestHelloAgainWhileCheckedIn(t *testing.T) {
+	newTestServer(t)
+
+	if status, _, failure := postHello(t, helloForm("channels")); status != http.StatusOK {
+		t.Fatalf("first hello answered %d: %+v", status, failure)
+	}
+
+	status, reply, failure := postHello(t, helloForm("channels,config"))
+
+	if status != http.StatusOK {
+		t.Fatalf("second hello answered %d: %+v", status, failure)
+	}
+
+	if len(reply.Capabilities) != 2 {
+		t.Errorf("capabilities %v agreed on the second hello, want channels and config", reply.Capabilities)
+	}
+
+	dev, _ := registry.Get("kitchen")
+
+	if !dev.IsCheckedIn || !dev.Supports(capabilityConfig) {
+		t.Errorf("second hello not recorded on the device %+v", dev)
+	}
+}
+
+func TestHelloRefused(t *testing.T) {
+	newTestServer(t)
+	tests := []struct {
+		name   string
+		key    string
+		value  string
+		status int
+		code   string
+	}{
+		{"wrong password", "password", "wrong", http.StatusForbidden, deviceErrorPassword},
+		{"old protocol", "protocolVersion", "0", http.StatusNotAcceptable, deviceErrorVersion},
+		{"no protocol", "protocolVersion", "", http.StatusNotAcceptable, deviceErrorVersion},
+		{"bad device name", "deviceName", "kitchen/oven", http.StatusNotAcceptable, deviceErrorInvalid},
+		{"bad sensors", "sensors", "temp:pressure", http.StatusNotAcceptable, deviceErrorInvalid},
+		{"unknown time zone", "timezone", "Mars/Olympus", http.StatusNotAcceptable, deviceErrorInvalid},
+	}
+
+	for _, test := range tests {
+		form := helloForm("channels")
+		form.Set(test.key, test.value)
+		status, _, failure := postHello(t, form)
+
+		if status != test.status || failure.Error != test.code {
+			t.Errorf("%s answered %d %q, want %d %q", test.name, status, failure.Error, test.status, test.code)
+		}
+	}
+
+	if _, ok := registry.Get("kitchen"); ok {
+		t.Error("refused hellos checked the device in")
+	}
+}
@@ -3,22 +3,18 @@ package main
 import (
 	"bufio"
 	"encoding/json"
-	"flag"
 	"fmt"
-	"html/template"
-	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-ini/ini"
 	"github.com/jmoiron/sqlx"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
+	"golang.org/x/term"
 )
 
 // checkError is wrapper function to print custom error message along
@@ -26,7 +22,7 @@ import (
 func checkError(err error, message string, exit bool) {
 	if err != nil {
 		fmt.Printf("%+v\n", errors.Wrap(err, message))
-		log.Printf("%+v\n", errors.Wrap(err, message))
+		logger.Errorf("%+v", errors.Wrap(err, message))
 		if exit {
 			os.Exit(2)
 		}
@@ -41,25 +37,22 @@ func unableToRetrieveFiles(w http.ResponseWriter, err error) {
 	checkError(err, "", false)
 }
 
-// initFileSystem checks if project root dir exists and if it doesn't,
-// we create proper dir/files for project and ask user for default values
-// that will be written to server.ini config file
+// initFileSystem makes sure there is a server.ini to load settings from
+// If there is none yet we ask user for default values that will be
+// written to it, unless we are not attached to a terminal (e.g. running
+// under systemd or docker) in which case defaults are written as is and can
+// be overridden with flags or environment variables
 func initFileSystem() {
-	_, err := os.Stat(setting.ProjectRoot)
+	err := os.MkdirAll(filepath.Dir(setting.ServerConfigFile), os.ModePerm)
+	checkError(err, "Error creating config directory", true)
 
-	if err != nil {
-		err := os.MkdirAll(setting.TemplatesDirectory, os.ModePerm)
-		checkError(err, "Error creating template directory", true)
-
-		indexFile, err := os.Create(filepath.Join(setting.TemplatesDirectory, "index.html"))
-		checkError(err, "Error creating index.html", true)
-
-		indexFile.WriteString(getIndexPage())
-		os.MkdirAll(filepath.Join(setting.SetsDirectory), os.ModePerm)
-		configFile, err := os.Create(setting.ServerConfigFile)
-		checkError(err, "", true)
-		_, err = os.Create(setting.ServerDBFile)
-		checkError(err, "", true)
+	if _, err = os.Stat(setting.ServerConfigFile); err == nil {
+		return
+	}
+
+	overrides := make(map[string]string)
+
+	if isInteractive() {
 		reader := bufio.NewReader(os.Stdin)
 		fmt.Println("This is your first time running program.  We will now set some defaults.")
 		fmt.Print("Enter ip address server will be listing on (default localhost):")
@@ -68,60 +61,58 @@ func initFileSystem() {
 		port, _ := reader.ReadString('\n')
 		fmt.Print("Enter password you want to use for server (default password):")
 		password, _ := reader.ReadString('\n')
+		fmt.Print("Enter password to log in to the dashboard with and add the first admin (at least 8 characters, leave empty to add them with server user add):")
+		dashboardPassword, _ := reader.ReadString('\n')
 
 		ipAddress = strings.TrimSpace(ipAddress)
 		port = strings.TrimSpace(port)
 		password = strings.TrimSpace(password)
+		dashboardPassword = strings.TrimSpace(dashboardPassword)
 
-		if ipAddress == "" {
-			ipAddress = "localhost"
+		if ipAddress != "" {
+			overrides["ip_address"] = ipAddress
 		}
-		if port == "" {
-			port = ":8003"
+		if port != "" {
+			overrides["port"] = port
 		}
-		if password == "" {
-			password = "password"
+		if password != "" {
+			overrides["password"] = password
 		}
+		if dashboardPassword != "" {
+			overrides["dashboard_password"] = dashboardPassword
+		}
+	} else {
+		fmt.Println("No terminal attached, writing default settings to " + setting.ServerConfigFile)
+	}
+
+	err = writeDefaultConfigFile(overrides)
+	checkError(err, "Couldn't write config file", true)
+}
+
+// initDataDirectories creates the project root, csv, sets and templates
+// directories based on the loaded settings if they don't exist yet, so
+// each of them can live on a different drive
+func initDataDirectories() {
+	directories := []string{
+		setting.ProjectRoot,
+		setting.CsvDirectory,
+		setting.SetsDirectory,
+		setting.TemplatesDirectory,
+		filepath.Dir(setting.ServerDBFile),
+	}
 
-		writeToFile :=
-			"[DEFAULT] \n" +
-				"# Ip address the server is given on local network \n" +
-				"# Standard is 192.168.x.xx \n" +
-				"ip_address=" + ipAddress + " \n\n" +
-
-				"# Port that the server will listen on \n" +
-				"port=" + port + " \n\n" +
-
-				"# Password that will be used in post requests from device \n" +
-				"# Should be the same as the client.ini file \n" +
-				"password=" + password + " \n\n" +
-
-				"# Determines if requests be made over https or not \n" +
-				"# Strongly encouraged to have https as the password \n" +
-				"# above will be sent in plain text though this requires \n" +
-				"# setting up a ssl cert \n" +
-				"# This setting must be the same in the server.ini \n" +
-				"https=false \n\n" +
-
-				"# Path to cert file \n" +
-				"# If https is set to true, this has to be filled out \n" +
-				"cert_file=" + setting.ProjectRoot + "/ssl/cert_file.crt \n\n" +
-
-				"# Path to key file \n" +
-				"# If https is set to true, this has to be filled out \n" +
-				"key_file=" + setting.ProjectRoot + "/ssl/key_file.crt \n\n" +
-
-				"# The number (in seconds) that determines how long a device \n" +
-				"# can be inactive for before it is considered not working \n" +
-				"# and be considered not checked in \n" +
-				"# This settings should always be more than the 'sleep' setting \n" +
-				"# in client.ini \n" +
-				"time_out=5"
-
-		configFile.WriteString(writeToFile)
+	for _, directory := range directories {
+		err := os.MkdirAll(directory, os.ModePerm)
+		checkError(err, "Error creating directory "+directory, true)
 	}
 }
 
+// isInteractive determines whether stdin is attached to a terminal that
+// we can prompt the user on
+func isInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
 // initProjectFilePaths initiates file paths for our global variables
 // func initProjectFilePaths() {
 // 	path, err := homedir.Dir()
@@ -134,100 +125,42 @@ func initFileSystem() {
 // 	templatesDirectory = filepath.Join(projectRoot, "templates")
 // }
 
+// initSettings sets up the project root and where server.ini is found,
+// which have to be known before the rest of the settings can be loaded
+// Both can be given as flags or environment variables and otherwise
+// default to ~/.raspberry_pi_server
 func initSettings() {
-	path, err := homedir.Dir()
-	checkError(err, "Couldn't get project root", true)
-	projectRoot := filepath.Join(path, projectName)
-	csvDirectory := filepath.Join(projectRoot, "csv")
+	projectRoot := *projectRootFlag
 
-	setting = &settings{
-		ProjectRoot:        projectRoot,
-		ServerConfigFile:   filepath.Join(projectRoot, "server.ini"),
-		ServerDBFile:       filepath.Join(projectRoot, "server.db"),
-		CsvDirectory:       filepath.Join(projectRoot, "csv"),
-		SetsDirectory:      filepath.Join(csvDirectory, "sets"),
-		TemplatesDirectory: filepath.Join(projectRoot, "templates"),
+	if projectRoot == "" {
+		projectRoot = os.Getenv(envPrefix + "PROJECT_ROOT")
 	}
-}
 
-// initLogger initiates logger and tells where to store logger file
-func initLogger() {
-	serverLog := filepath.Join(setting.ProjectRoot, "rapsberry_pi_server.log")
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	f, err := os.Create(serverLog)
-	// f, err := os.OpenFile(
-	// 	filepath.Join(projectRoot, "rapsberry_pi_server.log"),
-	// 	os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-
-	checkError(err, "Couldn't init logger", true)
-	defer f.Close()
-	log.SetOutput(f)
-}
+	if projectRoot == "" {
+		path, err := homedir.Dir()
+		checkError(err, "Couldn't get project root", true)
+		projectRoot = filepath.Join(path, projectName)
+	}
 
-// loadSettingsFile loads settings from config file and assigns
-// values to our settings struct
-func loadSettingsFile() {
-	cfg, err := ini.Load(setting.ServerConfigFile)
-	checkError(err, "server.ini file not found", true)
-	defaultSection, err := cfg.GetSection("DEFAULT")
-	checkError(err, "No default section in ini file", true)
-	ipAddress, err := defaultSection.GetKey("ip_address")
-	checkError(err, "ip address setting not set", true)
-	password, err := defaultSection.GetKey("password")
-	checkError(err, "password setting is not set", true)
-	https, err := defaultSection.GetKey("https")
-	checkError(err, "https setting not set", true)
-	boolHTTPS, err := strconv.ParseBool(https.Value())
-	checkError(err, "https setting is not bool", true)
-	timeOut, err := defaultSection.GetKey("time_out")
-	checkError(err, "time_out setting not set", true)
-	intTimeOut, err := strconv.ParseInt(timeOut.Value(), 10, 32)
-	checkError(err, "timeout is not an int", true)
-	port, err := defaultSection.GetKey("port")
-	checkError(err, "port setting is not set", true)
-
-	if boolHTTPS {
-		certFile, err := defaultSection.GetKey("cert_file")
-		checkError(err, "If https setting is true, cert_file must be set", true)
-		keyFile, err := defaultSection.GetKey("key_file")
-		checkError(err, "If https setting is true, key_file must be set", true)
-
-		_, err = os.Stat(certFile.Value())
-		checkError(err, "cert file does not exists", true)
-		_, err = os.Stat(keyFile.Value())
-		checkError(err, "key file does not exists", true)
+	configFile := filepath.Join(projectRoot, "server.ini")
 
+	if *configFlag != "" {
+		configFile = *configFlag
+	} else if envConfigFile := os.Getenv(envPrefix + "CONFIG"); envConfigFile != "" {
+		configFile = envConfigFile
 	}
 
-	setting.IPAddress = ipAddress.Value()
-	setting.Port = port.Value()
-	setting.Password = password.Value()
-	setting.HTTPS = boolHTTPS
-	setting.TimeOut = intTimeOut
+	setting = &settings{
+		ProjectRoot:      projectRoot,
+		ServerConfigFile: configFile,
+	}
 }
 
-// commandLineArgs grabs command line arguments and sets up enviroment
-// based on arguments passed
+// commandLineArgs sets up enviroment based on command line arguments
+// parsed in parseCommandLine
 func commandLineArgs() {
-	wipePtr := flag.Bool("wipe", false, "Wipes out all csv files and database, basically to start fresh")
-	flag.Parse()
-
-	if *wipePtr {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Println("You are about to wipe all csv files and entries in database.  Are you sure you want to continue? (y/n)")
-		text, _ := reader.ReadString('\n')
-		text = strings.TrimRight(text, "\r\n")
-		if text == "y" || text == "Y" {
-			// Extra saftey to make sure we don't delete home directory
-			homeDir, _ := homedir.Dir()
-			if setting.ProjectRoot != homeDir {
-				os.RemoveAll(setting.ProjectRoot)
-			} else {
-				fmt.Println("Can't delete home directory, thats dangerous!")
-			}
-		} else {
-			fmt.Println("Files not deleted")
-		}
+	if *wipeFlag != "" {
+		wipeData(string(*wipeFlag))
 	}
 }
 
@@ -254,8 +187,7 @@ func execTXQuery(query string, args ...interface{}) (err error) {
 	_, err = tx.Stmt(stmt).Exec(args...)
 
 	if err != nil {
-		fmt.Println("doing rollback")
-		log.Println(err)
+		logger.WithError(err).Warn("Rolling back transaction")
 		tx.Rollback()
 		return err
 	}
@@ -265,8 +197,14 @@ func execTXQuery(query string, args ...interface{}) (err error) {
 	return nil
 }
 
-// initDatabase creates sqlite file and device table if they don't exist
+// initDatabase creates sqlite file if it doesn't exist and brings its
+// schema up to date
+// It may already have been opened by -wipe
 func initDatabase() {
+	if db != nil {
+		return
+	}
+
 	_, err := os.Stat(setting.ServerDBFile)
 
 	if err != nil {
@@ -276,47 +214,38 @@ func initDatabase() {
 	db, err = sqlx.Open("sqlite3", setting.ServerDBFile)
 	checkError(err, "Connecting to database", true)
 
-	sqlQuery := "CREATE TABLE IF NOT EXISTS `device` (" +
-		"`pk`					INTEGER PRIMARY KEY AUTOINCREMENT," +
-		"`name`					TEXT UNIQUE," +
-		"`set_num`				INTEGER," +
-		"`latest_set_time`		DATETIME NULL," +
-		"`latest_check_in_time`	DATETIME," +
-		"`is_new_set`			INTEGER," +
-		"`is_recording`			INTEGER," +
-		"`is_checked_in`		INTEGER" +
-		");"
-
-	_, err = db.Exec(sqlQuery)
-	checkError(err, "Executing query", true)
+	if subcommand == "migrate" {
+		runMigrateCommand()
+	}
+
+	err = migrateDatabase()
+	checkError(err, "Migrating database", true)
 }
 
 // initGlobalVariables initiates global variables
 func initGlobalVariables() {
-	tpl = template.Must(template.ParseGlob("templates/*.html"))
-	// tpl = template.Must(template.ParseGlob(filepath.Join(setting.TemplatesDirectory, "*.html")))
+	checkVendorAssets()
+	checkDashboardLogin()
+	tpl = initTemplates()
 	server = &http.Server{
 		Addr:              setting.IPAddress + setting.Port,
 		ReadTimeout:       (2 * time.Minute),
 		ReadHeaderTimeout: (2 * time.Minute),
 	}
-	devices := make([]device, 0)
-	deviceMap := make(map[string]*device)
-	dbQuery := "SELECT * FROM device"
-	err := db.Select(&devices, dbQuery, nil)
-	checkError(err, "Improper query", true)
-	counter := 0
-
-	for _, item := range devices {
-		counter++
-		item.LatestCheckInTime = time.Now()
-		deviceMap[item.Name] = &item
-	}
+	store = initStorage()
 
-	deviceCenter = &devCenter{
-		NumOfDevices: counter,
-		Devices:      deviceMap,
+	if setting.Occupancy {
+		occupancy = newOccupancyTracker()
 	}
+	var err error
+	registry, err = loadDeviceRegistry()
+	checkError(err, "Loading devices", true)
+	sensors, err = loadSensorCatalog()
+	checkError(err, "Loading sensors", true)
+	configs, err = loadClientConfigStore()
+	checkError(err, "Loading client configs", true)
+	activity, err = loadLiveActivity()
+	checkError(err, "Loading recent activity", true)
 }
 
 // sendPayload is helper function that takes an empty interface
@@ -325,7 +254,7 @@ func sendPayload(w http.ResponseWriter, payload interface{}) {
 	jsonString, err := json.Marshal(payload)
 
 	if err != nil {
-		log.Println(err)
+		logger.WithError(err).Error("Couldn't marshal payload")
 		w.WriteHeader(http.StatusInternalServerError)
 	} else {
 		w.WriteHeader(http.StatusOK)
@@ -334,9 +263,11 @@ func sendPayload(w http.ResponseWriter, payload interface{}) {
 }
 
 // handlePostRequests makes sure that incoming requests are of method "POST" and that
-// they have the write password.  This is used for api end points that usually
-// changes files
-func handlePostRequests(w http.ResponseWriter, r *http.Request) (err error) {
+// they have the write password.  This is used for api end points devices
+// use, the dashboard logs in instead, see handleDashboardPostRequests
+// deviceName is the device the request acts on, see isDevicePassword
+// Once the password is right the device is charged to its rate limit
+func handlePostRequests(w http.ResponseWriter, r *http.Request, deviceName string) (err error) {
 	r.ParseForm()
 	var message string
 
@@ -347,15 +278,20 @@ func handlePostRequests(w http.ResponseWriter, r *http.Request) (err error) {
 		return errors.New(message)
 	}
 
-	password := r.Form.Get("password")
+	ok := isDevicePassword(r, deviceName)
+	recordPasswordResult(r, ok)
 
-	if password != setting.Password {
+	if !ok {
 		message = "Wrong Password"
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(message))
 		return errors.New(message)
 	}
 
+	if !allowDevice(w, deviceName) {
+		return errors.New("Too many requests")
+	}
+
 	return nil
 }
 
@@ -370,9 +306,9 @@ func randomString(n int) string {
 }
 
 // updateCheckIn will be run on a seperate go routine and will loop
-// through deviceCenter to see if any device have not been heard from
+// through the registry to see if any device have not been heard from
 // based on the timeOut setting.  If a device hasn't been heard from
-// based on timeOut, we change deviceCenter check in based on device
+// based on timeOut, we check the device out
 // The updateStatusHandler api end point is used in conjunction with
 // this function as this function changes check in status for device and
 // updateStatusHandler will use check in status to display message
@@ -382,20 +318,15 @@ func updateCheckIn() {
 	duration := time.Duration(-setting.TimeOut) * time.Second
 
 	for {
-		now := time.Now().UTC()
-		fmt.Println("update checkin")
-
-		for deviceName, dev := range deviceCenter.Devices {
-			latestCheckinTime := dev.LatestCheckInTime
-			if latestCheckinTime.Before(now.Add(duration)) {
-				fmt.Println("not heard from " + deviceName)
-				query := "UPDATE device SET is_checked_in=0 WHERE name=?;"
-				err := execTXQuery(query, deviceName)
-				checkError(err, "", true)
-				deviceCenter.Lock()
-				deviceCenter.Devices[deviceName].IsCheckedIn = false
-				deviceCenter.Unlock()
-			}
+		logger.Debug("Updating check in statuses")
+		timedOut, err := registry.TimeOut(time.Now().UTC().Add(duration))
+
+		for _, deviceName := range timedOut {
+			logger.WithField("device", deviceName).Warn("Device not heard from")
+		}
+
+		if err != nil {
+			logger.WithError(err).Error("Couldn't update check in statuses")
 		}
 
 		time.Sleep(sleepDuration)
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// statusRecorder wraps http.ResponseWriter so that the request logger
+// can find out which status code a handler sent back
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// initLogger initiates logger and tells where to store logger file
+// The log file is rotated once it reaches log_max_size megabytes and old
+// files are removed after log_max_age days or once there are more
+// than log_max_backups of them
+func initLogger() {
+	level, err := logrus.ParseLevel(setting.LogLevel)
+	checkError(err, "log_level setting is not a valid level", true)
+
+	logger.SetLevel(level)
+	logger.SetOutput(&lumberjack.Logger{
+		Filename:   filepath.Join(setting.ProjectRoot, "rapsberry_pi_server.log"),
+		MaxSize:    setting.LogMaxSize,
+		MaxAge:     setting.LogMaxAge,
+		MaxBackups: setting.LogMaxBackups,
+		LocalTime:  true,
+	})
+
+	if setting.LogFormat == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	}
+}
+
+// requestDeviceName tries to find the name of the device a request was
+// made for to log it, either from the deviceName field or from the first
+// field of the timeStamp sent by sensorHandler
+func requestDeviceName(r *http.Request) string {
+	if r.Form == nil {
+		return r.URL.Query().Get("deviceName")
+	}
+
+	if deviceName := r.Form.Get("deviceName"); deviceName != "" {
+		return deviceName
+	}
+
+	if timeStamp := r.Form.Get("timeStamp"); timeStamp != "" {
+		return strings.Split(timeStamp, ",")[0]
+	}
+
+	return ""
+}
+
+// logRequests is middleware that logs every request made to the server
+// along with the device it was made for, the status sent back and how
+// long the handler took
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		entry := logger.WithFields(logrus.Fields{
+			"method":   r.Method,
+			"endpoint": r.URL.Path,
+			"status":   recorder.status,
+			"duration": time.Since(start).String(),
+			"remote":   r.RemoteAddr,
+		})
+
+		if deviceName := requestDeviceName(r); deviceName != "" {
+			entry = entry.WithField("device", deviceName)
+		}
+
+		if recorder.status >= http.StatusInternalServerError {
+			entry.Error("request")
+		} else if recorder.status >= http.StatusBadRequest {
+			entry.Warn("request")
+		} else {
+			entry.Info("request")
+		}
+	})
+}
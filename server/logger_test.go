@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestLogRequests checks every request is logged as a json entry with
+// the device it was for and a level going by the status sent back
+func TestLogRequests(t *testing.T) {
+	var output bytes.Buffer
+	oldFormatter, oldLevel := logger.Formatter, logger.GetLevel()
+	logger.SetOutput(&output)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+	defer func() {
+		logger.SetOutput(io.Discard)
+		logger.SetFormatter(oldFormatter)
+		logger.SetLevel(oldLevel)
+	}()
+
+	tests := []struct {
+		form   url.Values
+		status int
+		device string
+		level  string
+	}{
+		{url.Values{"timeStamp": {"kitchen,2024-03-01T08:00:00Z,true"}}, http.StatusOK, "kitchen", "info"},
+		{url.Values{"deviceName": {"hallway"}}, http.StatusNotAcceptable, "hallway", "warning"},
+		{url.Values{}, http.StatusInternalServerError, "", "error"},
+	}
+
+	for _, test := range tests {
+		output.Reset()
+		handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			w.WriteHeader(test.status)
+		}))
+		postForm(handler.ServeHTTP, "/timeStamp/", test.form)
+		var entry map[string]interface{}
+
+		if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+			t.Fatalf("log line %q is not json: %v", output.String(), err)
+		}
+
+		if entry["level"] != test.level || entry["status"] != float64(test.status) || entry["endpoint"] != "/timeStamp/" {
+			t.Errorf("%v logged as %v", test.form, entry)
+		}
+
+		if device, _ := entry["device"].(string); device != test.device {
+			t.Errorf("%v logged for device %q, want %q", test.form, device, test.device)
+		}
+	}
+}
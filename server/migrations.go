@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// migration is a single forward change to the database schema
+// Migrations are applied in order of version and each one is applied in
+// its own transaction along with recording it in the schema_version table
+// Once released, a migration must never be changed, add a new one instead
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations is every schema change ever made to the database, oldest first
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create device table",
+		statements: []string{
+			// IF NOT EXISTS as databases created before migrations
+			// existed already have this table
+			"CREATE TABLE IF NOT EXISTS `device` (" +
+				"`pk`					INTEGER PRIMARY KEY AUTOINCREMENT," +
+				"`name`					TEXT UNIQUE," +
+				"`set_num`				INTEGER," +
+				"`latest_set_time`		DATETIME NULL," +
+				"`latest_check_in_time`	DATETIME," +
+				"`is_new_set`			INTEGER," +
+				"`is_recording`			INTEGER," +
+				"`is_checked_in`		INTEGER" +
+				");",
+		},
+	},
+	{
+		version:     2,
+		description: "Create reading and reading_set tables for sqlite storage",
+		statements: []string{
+			"CREATE TABLE `reading` (" +
+				"`pk`			INTEGER PRIMARY KEY AUTOINCREMENT," +
+				"`device_name`	TEXT NOT NULL," +
+				"`set_num`		INTEGER NOT NULL," +
+				"`time`			DATETIME NOT NULL" +
+				");",
+			"CREATE INDEX `reading_device_set_time` ON `reading` (`device_name`, `set_num`, `time`);",
+			"CREATE TABLE `reading_set` (" +
+				"`device_name`	TEXT NOT NULL," +
+				"`set_num`		INTEGER NOT NULL," +
+				"`created_at`	DATETIME NOT NULL," +
+				"PRIMARY KEY (`device_name`, `set_num`)" +
+				");",
+		},
+	},
+	{
+		version:     3,
+		description: "Create occupancy_interval table",
+		statements: []string{
+			"CREATE TABLE `occupancy_interval` (" +
+				"`pk`			INTEGER PRIMARY KEY AUTOINCREMENT," +
+				"`device_name`	TEXT NOT NULL," +
+				"`state`		TEXT NOT NULL," +
+				"`start_time`	DATETIME NOT NULL," +
+				"`end_time`		DATETIME NOT NULL" +
+				");",
+			"CREATE INDEX `occupancy_interval_device_start` ON `occupancy_interval` (`device_name`, `start_time`);",
+		},
+	},
+	{
+		version:     4,
+		description: "Add received_at to reading for the both clock_skew_mode",
+		statements: []string{
+			"ALTER TABLE `reading` ADD COLUMN `received_at` DATETIME NULL;",
+		},
+	},
+	{
+		version:     5,
+		description: "Add timezone to device for devices sending local times",
+		statements: []string{
+			"ALTER TABLE `device` ADD COLUMN `timezone` TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		version:     6,
+		description: "Create sensor table and add channel and value to reading",
+		statements: []string{
+			"CREATE TABLE `sensor` (" +
+				"`device_name`	TEXT NOT NULL," +
+				"`channel`		TEXT NOT NULL," +
+				"`type`			TEXT NOT NULL," +
+				"`unit`			TEXT NOT NULL DEFAULT ''," +
+				"`created_at`	DATETIME NOT NULL," +
+				"PRIMARY KEY (`device_name`, `channel`)" +
+				");",
+			"ALTER TABLE `reading` ADD COLUMN `channel` TEXT NOT NULL DEFAULT 'motion';",
+			"ALTER TABLE `reading` ADD COLUMN `value` REAL NULL;",
+			"DROP INDEX `reading_device_set_time`;",
+			"CREATE INDEX `reading_device_channel_set_time` ON `reading` (`device_name`, `channel`, `set_num`, `time`);",
+		},
+	},
+	{
+		version:     7,
+		description: "Create set_label table",
+		statements: []string{
+			"CREATE TABLE `set_label` (" +
+				"`device_name`	TEXT NOT NULL," +
+				"`set_num`		INTEGER NOT NULL," +
+				"`label`		TEXT NOT NULL," +
+				"`created_at`	DATETIME NOT NULL," +
+				"PRIMARY KEY (`device_name`, `set_num`, `label`)" +
+				");",
+		},
+	},
+	{
+		version:     8,
+		description: "Create dashboard_user table",
+		statements: []string{
+			"CREATE TABLE `dashboard_user` (" +
+				"`name`			TEXT PRIMARY KEY," +
+				"`password_hash`	TEXT NOT NULL," +
+				"`role`			TEXT NOT NULL," +
+				"`created_at`	DATETIME NOT NULL" +
+				");",
+		},
+	},
+	{
+		version:     9,
+		description: "Add protocol_version and capabilities to device for the hello handshake",
+		statements: []string{
+			"ALTER TABLE `device` ADD COLUMN `protocol_version` INTEGER NOT NULL DEFAULT 0;",
+			"ALTER TABLE `device` ADD COLUMN `capabilities` TEXT NOT NULL DEFAULT '';",
+		},
+	},
+	{
+		version:     10,
+		description: "Create device_command table",
+		statements: []string{
+			"CREATE TABLE `device_command` (" +
+				"`pk`			INTEGER PRIMARY KEY AUTOINCREMENT," +
+				"`device_name`	TEXT NOT NULL," +
+				"`name`			TEXT NOT NULL," +
+				"`args`			TEXT NOT NULL DEFAULT ''," +
+				"`status`		TEXT NOT NULL," +
+				"`attempts`		INTEGER NOT NULL DEFAULT 0," +
+				"`result`		TEXT NOT NULL DEFAULT ''," +
+				"`created_by`	TEXT NOT NULL DEFAULT ''," +
+				"`created_at`	DATETIME NOT NULL," +
+				"`delivered_at`	DATETIME NULL," +
+				"`acked_at`		DATETIME NULL" +
+				");",
+			"CREATE INDEX `device_command_device_status` ON `device_command` (`device_name`, `status`);",
+		},
+	},
+	{
+		version:     11,
+		description: "Create client_config tables and add config group and versions to device",
+		statements: []string{
+			"CREATE TABLE `client_config_scope` (" +
+				"`scope`		TEXT PRIMARY KEY," +
+				"`revision`		INTEGER NOT NULL," +
+				"`updated_by`	TEXT NOT NULL DEFAULT ''," +
+				"`updated_at`	DATETIME NOT NULL" +
+				");",
+			"CREATE TABLE `client_config` (" +
+				"`scope`	TEXT NOT NULL," +
+				"`key`		TEXT NOT NULL," +
+				"`value`	TEXT NOT NULL," +
+				"PRIMARY KEY (`scope`, `key`)" +
+				");",
+			"ALTER TABLE `device` ADD COLUMN `config_group` TEXT NOT NULL DEFAULT '';",
+			"ALTER TABLE `device` ADD COLUMN `config_revision` INTEGER NOT NULL DEFAULT 0;",
+			"ALTER TABLE `device` ADD COLUMN `applied_config_version` INTEGER NOT NULL DEFAULT 0;",
+			"ALTER TABLE `device` ADD COLUMN `config_applied_at` DATETIME NULL;",
+		},
+	},
+	{
+		version:     12,
+		description: "Create set_summary table and add set_started_at to device",
+		statements: []string{
+			"CREATE TABLE `set_summary` (" +
+				"`device_name`	TEXT NOT NULL," +
+				"`set_num`		INTEGER NOT NULL," +
+				"`start_time`	DATETIME NULL," +
+				"`end_time`		DATETIME NULL," +
+				"`rows`			TEXT NULL," +
+				"PRIMARY KEY (`device_name`, `set_num`)" +
+				");",
+			"ALTER TABLE `device` ADD COLUMN `set_started_at` DATETIME NULL;",
+			// The current set of a device started when its last set did,
+			// for devices that never started one it isn't known
+			"UPDATE `device` SET `set_started_at` = `latest_set_time`;",
+		},
+	},
+}
+
+// schemaVersion returns the version of the latest migration applied to
+// the database, creating the schema_version table if needed
+func schemaVersion() (version int, err error) {
+	sqlQuery := "CREATE TABLE IF NOT EXISTS `schema_version` (" +
+		"`version`		INTEGER PRIMARY KEY," +
+		"`description`	TEXT," +
+		"`applied_at`	DATETIME" +
+		");"
+
+	if _, err = db.Exec(sqlQuery); err != nil {
+		return 0, err
+	}
+
+	err = db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_version;")
+	return version, err
+}
+
+// pendingMigrations returns the migrations that have not been applied to
+// the database yet
+func pendingMigrations() ([]migration, error) {
+	version, err := schemaVersion()
+
+	if err != nil {
+		return nil, err
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	if version > latest {
+		return nil, fmt.Errorf("database is at schema version %d but this server only knows up to %d, "+
+			"it was probably created by a newer version of the server", version, latest)
+	}
+
+	pending := make([]migration, 0)
+
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// applyMigration runs every statement of m and records it in
+// schema_version within one transaction
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range m.statements {
+		if _, err = tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d failed", m.version)
+		}
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO schema_version (version, description, applied_at) VALUES (?,?,?);",
+		m.version,
+		m.description,
+		time.Now().UTC(),
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hasTables determines if the database has any tables besides
+// schema_version, i.e. if it was used before
+func hasTables() (bool, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name NOT IN ('schema_version', 'sqlite_sequence');")
+	return count > 0, err
+}
+
+// migrateDatabase applies every pending migration
+// If the database already holds data, a backup is written first so a bad
+// migration can be undone with restore
+func migrateDatabase() error {
+	pending, err := pendingMigrations()
+
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	existing, err := hasTables()
+
+	if err != nil {
+		return err
+	}
+
+	if existing {
+		archivePath, err := writeBackupArchive("pre-migrate")
+
+		if err != nil {
+			return errors.Wrap(err, "Couldn't back up database before migrating")
+		}
+
+		logger.WithField("backup", archivePath).Info("Backed up database before migrating")
+	}
+
+	for _, m := range pending {
+		if err = applyMigration(m); err != nil {
+			return err
+		}
+
+		logger.WithField("version", m.version).Info("Applied migration: " + m.description)
+	}
+
+	return nil
+}
+
+// printMigrations writes pending migrations and their sql to w, this is
+// what migrate -dry-run shows instead of applying them
+func printMigrations(w io.Writer, pending []migration) {
+	for _, m := range pending {
+		fmt.Fprintf(w, "Migration %d: %s\n", m.version, m.description)
+
+		for _, statement := range m.statements {
+			fmt.Fprintln(w, "    "+statement)
+		}
+	}
+
+	fmt.Fprintf(w, "%d migration(s) would be applied\n", len(pending))
+}
+
+// runMigrateCommand is the migrate subcommand which applies pending
+// migrations and exits
+// With -dry-run the pending migrations and their sql are only printed
+func runMigrateCommand() {
+	pending, err := pendingMigrations()
+	checkError(err, "Couldn't read schema version", true)
+
+	if len(pending) == 0 {
+		fmt.Println("Database is up to date")
+		os.Exit(0)
+	}
+
+	if *dryRunFlag {
+		printMigrations(os.Stdout, pending)
+		os.Exit(0)
+	}
+
+	err = migrateDatabase()
+	checkError(err, "Migrating database", true)
+	fmt.Printf("Applied %d migration(s)\n", len(pending))
+	os.Exit(0)
+}
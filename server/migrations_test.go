@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// baselineSchema is the device table as created by the server before
+// migrations existed
+const baselineSchema = "CREATE TABLE IF NOT EXISTS `device` (" +
+	"`pk`					INTEGER PRIMARY KEY AUTOINCREMENT," +
+	"`name`					TEXT UNIQUE," +
+	"`set_num`				INTEGER," +
+	"`latest_set_time`		DATETIME NULL," +
+	"`latest_check_in_time`	DATETIME," +
+	"`is_new_set`			INTEGER," +
+	"`is_recording`			INTEGER," +
+	"`is_checked_in`		INTEGER" +
+	");"
+
+// newBaselineDatabase creates a database the way the server did before
+// migrations existed, holding two devices
+func newBaselineDatabase(t *testing.T) {
+	t.Helper()
+	newTestDatabase(t)
+
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	rows := []struct {
+		name   string
+		setNum int
+	}{
+		{"kitchen", 3},
+		{"hallway", 1},
+	}
+
+	for _, row := range rows {
+		_, err := db.Exec(
+			"INSERT INTO device (name, set_num, latest_set_time, latest_check_in_time, is_new_set, is_recording, is_checked_in) VALUES (?,?,?,?,?,?,?);",
+			row.name, row.setNum, now, now, false, true, true,
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// appliedMigrations returns how many rows schema_version holds
+func appliedMigrations(t *testing.T) int {
+	t.Helper()
+	var count int
+
+	if err := db.Get(&count, "SELECT COUNT(*) FROM schema_version;"); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+// backupArchives returns the backup archives written so far
+func backupArchives(t *testing.T) []string {
+	t.Helper()
+	archives, err := filepath.Glob(filepath.Join(backupDirectory(), "*.tar.gz"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archives
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	newBaselineDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	version, err := schemaVersion()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != latest {
+		t.Fatalf("schema version is %d, want %d", version, latest)
+	}
+
+	if count := appliedMigrations(t); count != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", count, len(migrations))
+	}
+
+	if archives := backupArchives(t); len(archives) != 1 {
+		t.Fatalf("%d backups written before migrating, want 1", len(archives))
+	}
+
+	devices := make([]device, 0)
+
+	if err = db.Select(&devices, "SELECT * FROM device ORDER BY name;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("%d devices after migrating, want 2", len(devices))
+	}
+
+	if devices[0].Name != "hallway" || devices[0].SetNum != 1 || devices[1].Name != "kitchen" || devices[1].SetNum != 3 {
+		t.Fatalf("devices not preserved: %+v", devices)
+	}
+
+	if !devices[1].IsRecording || devices[1].ProtocolVersion != 0 || devices[1].Timezone != "" {
+		t.Fatalf("device columns not preserved or defaulted: %+v", devices[1])
+	}
+
+	if devices[1].SetStartedAt == nil || !devices[1].SetStartedAt.Equal(*devices[1].LatestSetTime) {
+		t.Fatalf("set_started_at not taken from latest_set_time: %+v", devices[1])
+	}
+}
+
+func TestMigrateTwiceIsNoop(t *testing.T) {
+	newBaselineDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := appliedMigrations(t); count != len(migrations) {
+		t.Fatalf("%d migrations recorded after migrating twice, want %d", count, len(migrations))
+	}
+
+	if archives := backupArchives(t); len(archives) != 1 {
+		t.Fatalf("%d backups written after migrating twice, want 1", len(archives))
+	}
+
+	pending, err := pendingMigrations()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 0 {
+		t.Fatalf("%d migrations still pending", len(pending))
+	}
+}
+
+func TestMigrateEmptyDatabaseSkipsBackup(t *testing.T) {
+	newTestDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := appliedMigrations(t); count != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", count, len(migrations))
+	}
+
+	if _, err := os.Stat(backupDirectory()); err == nil {
+		t.Fatal("backup written for a new database")
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	newBaselineDatabase(t)
+	pending, err := pendingMigrations()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != len(migrations) {
+		t.Fatalf("%d migrations pending, want %d", len(pending), len(migrations))
+	}
+
+	var out bytes.Buffer
+	printMigrations(&out, pending)
+
+	for _, m := range migrations {
+		if !strings.Contains(out.String(), m.description) {
+			t.Fatalf("dry run output is missing migration %d", m.version)
+		}
+	}
+
+	if !strings.HasSuffix(out.String(), "migration(s) would be applied\n") {
+		t.Fatalf("dry run output has no summary: %q", out.String())
+	}
+
+	version, err := schemaVersion()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != 0 {
+		t.Fatalf("dry run changed schema version to %d", version)
+	}
+
+	var columns int
+
+	if err = db.Get(&columns, "SELECT COUNT(*) FROM pragma_table_info('device') WHERE name = 'timezone';"); err != nil {
+		t.Fatal(err)
+	}
+
+	if columns != 0 {
+		t.Fatal("dry run altered the device table")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	occupancyMotion   = "motion"
+	occupancyNoMotion = "no_motion"
+	occupancyOffline  = "offline"
+)
+
+// occupancyInterval is a stretch of time a device was in one state,
+// either seeing motion, seeing no motion or not sending anything
+type occupancyInterval struct {
+	Pk         int       `json:"-" db:"pk"`
+	DeviceName string    `json:"deviceName" db:"device_name"`
+	State      string    `json:"state" db:"state"`
+	Start      time.Time `json:"start" db:"start_time"`
+	End        time.Time `json:"end" db:"end_time"`
+}
+
+// occupancyTracker turns the readings of each device into run length
+// encoded occupancy intervals
+// The interval a device is currently in is extended in memory and only
+// written to the database when it ends or by Flush, so a reading every
+// few seconds doesn't mean a database write every few seconds
+type occupancyTracker struct {
+	sync.Mutex
+	open  map[string]*occupancyInterval
+	dirty map[string]bool
+}
+
+// newOccupancyTracker returns an empty occupancyTracker
+func newOccupancyTracker() *occupancyTracker {
+	return &occupancyTracker{
+		open:  make(map[string]*occupancyInterval),
+		dirty: make(map[string]bool),
+	}
+}
+
+// offlineGap is how long a device can go without sending a reading
+// before the time in between is counted as offline
+func offlineGap() time.Duration {
+	return time.Duration(setting.TimeOut) * time.Second
+}
+
+// Record adds a reading of deviceName taken at t to its intervals
+// Readings older than the end of the current interval are ignored
+func (o *occupancyTracker) Record(deviceName string, t time.Time, movement bool) error {
+	o.Lock()
+	defer o.Unlock()
+	state := occupancyNoMotion
+
+	if movement {
+		state = occupancyMotion
+	}
+
+	current, ok := o.open[deviceName]
+
+	if !ok {
+		var lastEnd time.Time
+		err := db.Get(
+			&lastEnd,
+			"SELECT end_time FROM occupancy_interval WHERE device_name=? ORDER BY end_time DESC LIMIT 1;",
+			deviceName,
+		)
+
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		// Anything between the last interval written before a restart
+		// and this reading is offline time
+		if err == nil && t.Sub(lastEnd) > offlineGap() {
+			if _, err = o.insert(deviceName, occupancyOffline, lastEnd, t); err != nil {
+				return err
+			}
+		}
+
+		return o.start(deviceName, state, t)
+	}
+
+	if t.Before(current.End) {
+		return nil
+	}
+
+	if t.Sub(current.End) > offlineGap() {
+		if err := o.write(current); err != nil {
+			return err
+		}
+
+		if _, err := o.insert(deviceName, occupancyOffline, current.End, t); err != nil {
+			return err
+		}
+
+		return o.start(deviceName, state, t)
+	}
+
+	current.End = t
+
+	if current.State == state {
+		o.dirty[deviceName] = true
+		return nil
+	}
+
+	if err := o.write(current); err != nil {
+		return err
+	}
+
+	return o.start(deviceName, state, t)
+}
+
+// start opens a new interval of deviceName in state at t
+func (o *occupancyTracker) start(deviceName string, state string, t time.Time) error {
+	pk, err := o.insert(deviceName, state, t, t)
+
+	if err != nil {
+		return err
+	}
+
+	o.open[deviceName] = &occupancyInterval{
+		Pk:         pk,
+		DeviceName: deviceName,
+		State:      state,
+		Start:      t,
+		End:        t,
+	}
+	delete(o.dirty, deviceName)
+	return nil
+}
+
+// insert adds an interval to the database and returns its pk
+func (o *occupancyTracker) insert(deviceName string, state string, start time.Time, end time.Time) (int, error) {
+	result, err := db.Exec(
+		"INSERT INTO occupancy_interval (device_name, state, start_time, end_time) VALUES (?,?,?,?);",
+		deviceName,
+		state,
+		start.UTC(),
+		end.UTC(),
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	pk, err := result.LastInsertId()
+	return int(pk), err
+}
+
+// write saves the end of interval to the database
+func (o *occupancyTracker) write(interval *occupancyInterval) error {
+	delete(o.dirty, interval.DeviceName)
+	return execTXQuery("UPDATE occupancy_interval SET end_time=? WHERE pk=?;", interval.End.UTC(), interval.Pk)
+}
+
+// Flush writes the end of every interval extended since the last flush
+func (o *occupancyTracker) Flush() error {
+	o.Lock()
+	defer o.Unlock()
+
+	for deviceName := range o.dirty {
+		if err := o.write(o.open[deviceName]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// occupancyIntervals returns the intervals of deviceName overlapping
+// start and end, clipped to the range
+func occupancyIntervals(deviceName string, start time.Time, end time.Time) ([]occupancyInterval, error) {
+	intervals := make([]occupancyInterval, 0)
+	err := db.Select(
+		&intervals,
+		"SELECT * FROM occupancy_interval WHERE device_name=? AND end_time>? AND start_time<? ORDER BY start_time;",
+		deviceName,
+		start.UTC(),
+		end.UTC(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range intervals {
+		if intervals[i].Start.Before(start) {
+			intervals[i].Start = start
+		}
+
+		if intervals[i].End.After(end) {
+			intervals[i].End = end
+		}
+	}
+
+	return intervals, nil
+}
+
+// occupancyHandler is an api endpoint that returns the occupancy
+// intervals of a device between start and end (RFC 3339, the last day by
+// default) along with the seconds spent in each state and the fraction
+// of time the sensor was running that motion was seen
+func occupancyHandler(w http.ResponseWriter, r *http.Request) {
+	if occupancy == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Occupancy recording is turned off"))
+		return
+	}
+
+	r.ParseForm()
+	deviceName := r.Form.Get("deviceName")
+
+	if _, ok := registry.Get(deviceName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Device name does not exist"))
+		return
+	}
+
+	end := time.Now().UTC()
+	start := end.Add(-24 * time.Hour)
+	var err error
+
+	if value := r.Form.Get("end"); value != "" {
+		if end, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("end must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	if value := r.Form.Get("start"); value != "" {
+		if start, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("start must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	var intervals []occupancyInterval
+
+	if err = occupancy.Flush(); err == nil {
+		intervals, err = occupancyIntervals(deviceName, start, end)
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't read occupancy")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't read occupancy"))
+		return
+	}
+
+	// A device that stopped sending is offline until now even though no
+	// interval says so yet, intervals are recorded with device times
+	// corrected by their clock skew so they are on the same clock as now
+	if len(intervals) > 0 {
+		last := intervals[len(intervals)-1]
+		until := end
+
+		if now := time.Now().UTC(); now.Before(until) {
+			until = now
+		}
+
+		if until.Sub(last.End) > offlineGap() {
+			intervals = append(intervals, occupancyInterval{
+				DeviceName: deviceName,
+				State:      occupancyOffline,
+				Start:      last.End,
+				End:        until,
+			})
+		}
+	}
+
+	totals := map[string]float64{
+		occupancyMotion:   0,
+		occupancyNoMotion: 0,
+		occupancyOffline:  0,
+	}
+
+	for _, interval := range intervals {
+		totals[interval.State] += interval.End.Sub(interval.Start).Seconds()
+	}
+
+	activeFraction := 0.0
+
+	if running := totals[occupancyMotion] + totals[occupancyNoMotion]; running > 0 {
+		activeFraction = totals[occupancyMotion] / running
+	}
+
+	sendPayload(w, map[string]interface{}{
+		"intervals":      intervals,
+		"totals":         totals,
+		"activeFraction": activeFraction,
+	})
+}
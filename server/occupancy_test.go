@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// postTimeStamp sends a legacy time stamp from kitchen taken at t the way
+// the client does
+func postTimeStamp(t *testing.T, deviceTime time.Time, movement string) {
+	t.Helper()
+	form := url.Values{
+		"password":  {"password"},
+		"timeStamp": {"kitchen," + deviceTime.Format(time.RFC3339) + "," + movement},
+	}
+
+	if w := postForm(sensorHandler, "/timeStamp/", form); w.Code != http.StatusOK {
+		t.Fatalf("time stamp answered %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOccupancyIntervals(t *testing.T) {
+	newTestServer(t)
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	tracker := newOccupancyTracker()
+	records := []struct {
+		seconds  int
+		movement bool
+	}{
+		{0, true},
+		{2, true},
+		{4, false},
+		{1, true},
+		{6, false},
+		{20, true},
+	}
+
+	for _, record := range records {
+		if err := tracker.Record("kitchen", start.Add(time.Duration(record.seconds)*time.Second), record.movement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restarted server counts the time since the last saved interval
+	// as offline
+	if err := newOccupancyTracker().Record("kitchen", start.Add(40*time.Second), false); err != nil {
+		t.Fatal(err)
+	}
+
+	intervals, err := occupancyIntervals("kitchen", start.Add(-time.Hour), start.Add(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		state      string
+		start, end int
+	}{
+		{occupancyMotion, 0, 4},
+		{occupancyNoMotion, 4, 6},
+		{occupancyOffline, 6, 20},
+		{occupancyMotion, 20, 20},
+		{occupancyOffline, 20, 40},
+		{occupancyNoMotion, 40, 40},
+	}
+
+	if len(intervals) != len(want) {
+		t.Fatalf("%d intervals %+v, want %d", len(intervals), intervals, len(want))
+	}
+
+	for i, interval := range intervals {
+		wantStart := start.Add(time.Duration(want[i].start) * time.Second)
+		wantEnd := start.Add(time.Duration(want[i].end) * time.Second)
+
+		if interval.State != want[i].state || !interval.Start.Equal(wantStart) || !interval.End.Equal(wantEnd) {
+			t.Errorf("interval %d is %s from %v to %v, want %s from %v to %v",
+				i, interval.State, interval.Start, interval.End, want[i].state, wantStart, wantEnd)
+		}
+	}
+
+	clipped, err := occupancyIntervals("kitchen", start.Add(5*time.Second), start.Add(10*time.Second))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clipped) != 2 || !clipped[0].Start.Equal(start.Add(5*time.Second)) || !clipped[1].End.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("intervals not clipped to the range %+v", clipped)
+	}
+}
+
+// TestOccupancyOnServerClock checks a device whose clock is an hour behind
+// isn't shown as offline for the hour between its last interval and now
+// when its readings are saved with the device time
+func TestOccupancyOnServerClock(t *testing.T) {
+	newTestServer(t)
+	occupancy = newOccupancyTracker()
+	setting.ClockSkewMode = "ignore"
+
+	if err := registry.CheckIn("kitchen", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	postTimeStamp(t, time.Now().Add(-time.Hour), "true")
+	postTimeStamp(t, time.Now().Add(-time.Hour), "false")
+	form := url.Values{
+		"deviceName": {"kitchen"},
+		"end":        {time.Now().Add(time.Minute).Format(time.RFC3339)},
+	}
+	w := postDashboardForm(occupancyHandler, "/occupancy/", form)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("occupancy answered %d: %s", w.Code, w.Body.String())
+	}
+
+	var reply struct {
+		Intervals []occupancyInterval `json:"intervals"`
+		Totals    map[string]float64  `json:"totals"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reply.Intervals) == 0 || reply.Totals[occupancyOffline] != 0 {
+		t.Fatalf("device counted as offline %+v", reply)
+	}
+
+	if first := reply.Intervals[0].Start; time.Since(first) > time.Minute {
+		t.Fatalf("interval started at %v on the device clock", first)
+	}
+}
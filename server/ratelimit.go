@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// guardPruneInterval is how often idle rate limit buckets and forgotten
+// failures are dropped
+const guardPruneInterval = time.Minute
+
+// limitedWindow is how long a rate limited source is still shown as
+// blocked after its last rejected request
+const limitedWindow = 5 * time.Minute
+
+// bucket is a token bucket of a rate limited source
+type bucket struct {
+	tokens      float64
+	last        time.Time
+	rejected    int
+	lastLimited time.Time
+}
+
+// failures counts the wrong passwords of an ip address
+type failures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// blockedSource is an ip address or device that is locked out or was
+// recently rate limited
+type blockedSource struct {
+	Source   string    `json:"source"`
+	Reason   string    `json:"reason"`
+	Count    int       `json:"count"`
+	Until    time.Time `json:"until"`
+	IsLocked bool      `json:"isLocked"`
+}
+
+// sourceGuard rate limits requests by ip address and device and locks out
+// ip addresses that send too many wrong passwords
+// Everything is only kept in memory, restarting the server clears it
+type sourceGuard struct {
+	sync.Mutex
+	buckets   map[string]*bucket
+	failures  map[string]*failures
+	lastPrune time.Time
+}
+
+// newSourceGuard returns an empty sourceGuard
+func newSourceGuard() *sourceGuard {
+	return &sourceGuard{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]*failures),
+	}
+}
+
+// lockoutTime is how long an ip address stays locked out
+func lockoutTime() time.Duration {
+	return time.Duration(setting.LockoutTime) * time.Minute
+}
+
+// ipSource and deviceSource are the keys sources are tracked by
+func ipSource(ip string) string {
+	return "ip " + ip
+}
+
+func deviceSource(deviceName string) string {
+	return "device " + deviceName
+}
+
+// prune drops buckets that have refilled and failures that are forgotten
+// The caller has to hold the lock
+func (g *sourceGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < guardPruneInterval {
+		return
+	}
+
+	g.lastPrune = now
+
+	for key, b := range g.buckets {
+		if now.Sub(b.last) > limitedWindow && now.Sub(b.lastLimited) > limitedWindow {
+			delete(g.buckets, key)
+		}
+	}
+
+	for key, f := range g.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.first) > lockoutTime() {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// Allow takes a token from the bucket of source, which refills at rate
+// tokens per second and holds up to twice that, and reports if there was
+// one to take
+func (g *sourceGuard) Allow(source string, rate int, now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	g.prune(now)
+	capacity := float64(2 * rate)
+	b, ok := g.buckets[source]
+
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		g.buckets[source] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	b.last = now
+
+	if b.tokens < 1 {
+		b.rejected++
+		b.lastLimited = now
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// LockedUntil returns when the lockout of ip ends if it is locked out
+func (g *sourceGuard) LockedUntil(ip string, now time.Time) (time.Time, bool) {
+	g.Lock()
+	defer g.Unlock()
+	f, ok := g.failures[ipSource(ip)]
+
+	if !ok || !now.Before(f.lockedUntil) {
+		return time.Time{}, false
+	}
+
+	return f.lockedUntil, true
+}
+
+// Fail records a wrong password from ip and reports if it is now locked
+// out
+// Wrong passwords older than lockout_time are forgotten
+func (g *sourceGuard) Fail(ip string, now time.Time) bool {
+	g.Lock()
+	defer g.Unlock()
+	source := ipSource(ip)
+	f, ok := g.failures[source]
+
+	if !ok || (now.After(f.lockedUntil) && now.Sub(f.first) > lockoutTime()) {
+		f = &failures{first: now}
+		g.failures[source] = f
+	}
+
+	f.count++
+
+	if f.count >= setting.LoginAttempts && now.After(f.lockedUntil) {
+		f.lockedUntil = now.Add(lockoutTime())
+		return true
+	}
+
+	return false
+}
+
+// Succeed forgets the wrong passwords of ip once it sends the right one
+func (g *sourceGuard) Succeed(ip string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.failures, ipSource(ip))
+}
+
+// Unblock lifts the lockout and rate limit of source
+func (g *sourceGuard) Unblock(source string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.failures, source)
+	delete(g.buckets, source)
+}
+
+// Blocked returns every locked out source and every source rate limited
+// in the last few minutes, locked out sources first
+func (g *sourceGuard) Blocked(now time.Time) []blockedSource {
+	g.Lock()
+	defer g.Unlock()
+	blocked := make([]blockedSource, 0)
+
+	for source, f := range g.failures {
+		if now.Before(f.lockedUntil) {
+			blocked = append(blocked, blockedSource{
+				Source:   source,
+				Reason:   "Locked out after " + strconv.Itoa(f.count) + " wrong passwords",
+				Count:    f.count,
+				Until:    f.lockedUntil,
+				IsLocked: true,
+			})
+		}
+	}
+
+	for source, b := range g.buckets {
+		if b.rejected > 0 && now.Sub(b.lastLimited) <= limitedWindow {
+			blocked = append(blocked, blockedSource{
+				Source: source,
+				Reason: "Rate limited " + strconv.Itoa(b.rejected) + " requests",
+				Count:  b.rejected,
+				Until:  b.lastLimited.Add(limitedWindow),
+			})
+		}
+	}
+
+	sort.Slice(blocked, func(i, j int) bool {
+		if blocked[i].IsLocked != blocked[j].IsLocked {
+			return blocked[i].IsLocked
+		}
+
+		return blocked[i].Source < blocked[j].Source
+	})
+
+	return blocked
+}
+
+// clientIP returns the ip address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// tooManyRequests answers a request from a blocked source, telling it when
+// to try again
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(message))
+}
+
+// rateLimited wraps a device endpoint or the login page so it answers
+// 429 to locked out ip addresses and to ip addresses sending more than
+// rate_limit requests per second
+// Devices are limited by allowDevice once their password was checked
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+		ip := clientIP(r)
+
+		if until, locked := guard.LockedUntil(ip, now); locked {
+			tooManyRequests(w, until.Sub(now), "Too many wrong passwords, try again later")
+			return
+		}
+
+		if !guard.Allow(ipSource(ip), setting.RateLimit, now) {
+			tooManyRequests(w, time.Second, "Too many requests")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// allowDevice answers 429 and returns false if deviceName was sent more
+// than device_rate_limit requests per second
+// It must only be called once the device password was checked, otherwise
+// anyone could use up the limit of a device by sending its name
+func allowDevice(w http.ResponseWriter, deviceName string) bool {
+	if deviceName == "" || guard.Allow(deviceSource(deviceName), setting.DeviceRateLimit, time.Now().UTC()) {
+		return true
+	}
+
+	tooManyRequests(w, time.Second, "Too many requests")
+	return false
+}
+
+// recordPasswordResult tells guard whether the request sent the right
+// password, logging when its ip address gets locked out
+func recordPasswordResult(r *http.Request, ok bool) {
+	ip := clientIP(r)
+
+	if ok {
+		guard.Succeed(ip)
+		return
+	}
+
+	if guard.Fail(ip, time.Now().UTC()) {
+		logger.WithField("ip", ip).WithField("path", r.URL.Path).Warn("Locked out after too many wrong passwords")
+	}
+}
+
+// blockedView renders the page listing blocked sources
+func blockedView(w http.ResponseWriter, r *http.Request) {
+	context := dashboardContext(r)
+	context["blocked"] = guard.Blocked(time.Now().UTC())
+	tpl.ExecuteTemplate(w, "blocked.html", context)
+}
+
+// unblockHandler is an api endpoint that lifts the lockout and rate limit
+// of a source
+func unblockHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	source := r.Form.Get("source")
+	guard.Unblock(source)
+	logger.WithField("source", source).WithField("user", currentSession(r).user).Info("Unblocked source")
+	sendPayload(w, guard.Blocked(time.Now().UTC()))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postDevice sends a device request with password for deviceName through
+// rateLimited and handlePostRequests and returns the status answered
+func postDevice(deviceName string, password string) int {
+	handler := rateLimited(func(w http.ResponseWriter, r *http.Request) {
+		if err := handlePostRequests(w, r, r.FormValue("deviceName")); err != nil {
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	form := url.Values{"deviceName": {deviceName}, "password": {password}}
+	r := httptest.NewRequest("POST", "/check-in-handler/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+// TestDeviceLimitOnlyChargedWithPassword checks requests without the
+// device password can't use up the rate limit of the device they name
+func TestDeviceLimitOnlyChargedWithPassword(t *testing.T) {
+	newTestServer(t)
+	setting.RateLimit = 1000
+	setting.DeviceRateLimit = 1
+	setting.LoginAttempts = 1000
+
+	for i := 0; i < 10; i++ {
+		if status := postDevice("kitchen", "wrong"); status != http.StatusForbidden {
+			t.Fatalf("wrong password answered %d, want %d", status, http.StatusForbidden)
+		}
+	}
+
+	// A device rate limit of 1 allows a burst of 2
+	for i := 0; i < 2; i++ {
+		if status := postDevice("kitchen", "password"); status != http.StatusOK {
+			t.Fatalf("request %d with the password answered %d, want %d", i+1, status, http.StatusOK)
+		}
+	}
+
+	if status := postDevice("kitchen", "password"); status != http.StatusTooManyRequests {
+		t.Fatalf("request over the device limit answered %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
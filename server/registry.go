@@ -0,0 +1,474 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errDeviceNotFound   = errors.New("Device name does not exist")
+	errNotCheckedIn     = errors.New("Not Checked In")
+	errAlreadyCheckedIn = errors.New("Device already checked in")
+	errDeviceRecording  = errors.New("Device is recording")
+	errNewSetPending    = errors.New("Device still hasn't reset to new set")
+)
+
+// deviceRegistry holds the state of every device
+// Every change to a device goes through one of its methods, which update
+// the database and memory while holding the registry lock, so the two
+// never disagree and handlers never see a half changed device
+// The one exception is the check in time sent with every heartbeat, which
+// is written in batches by FlushCheckIns
+// Devices handed out are copies and changing them changes nothing
+type deviceRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*device
+
+	// rotating holds the devices a new set is being written for, so the
+	// lock doesn't have to be held while the store copies readings
+	rotating map[string]bool
+
+	// heardFrom holds the devices whose latest check in time changed
+	// since the last FlushCheckIns
+	heardFrom map[string]bool
+}
+
+// loadDeviceRegistry reads every device from the database
+// Devices are treated as just heard from so they aren't timed out before
+// they had a chance to send anything
+func loadDeviceRegistry() (*deviceRegistry, error) {
+	devices := make([]device, 0)
+
+	if err := db.Select(&devices, "SELECT * FROM device;"); err != nil {
+		return nil, err
+	}
+
+	registry := &deviceRegistry{
+		devices:   make(map[string]*device, len(devices)),
+		rotating:  make(map[string]bool),
+		heardFrom: make(map[string]bool),
+	}
+	now := time.Now().UTC()
+
+	for i := range devices {
+		devices[i].LatestCheckInTime = now
+		registry.devices[devices[i].Name] = &devices[i]
+	}
+
+	return registry, nil
+}
+
+// Get returns a copy of deviceName and whether it exists
+func (reg *deviceRegistry) Get(deviceName string) (device, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return device{}, false
+	}
+
+	return *dev, true
+}
+
+// Names returns the names of every device, sorted
+func (reg *deviceRegistry) Names() []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	names := make([]string, 0, len(reg.devices))
+
+	for deviceName := range reg.devices {
+		names = append(names, deviceName)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns a copy of every device, sorted by name
+func (reg *deviceRegistry) Snapshot() []device {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	devices := make([]device, 0, len(reg.devices))
+
+	for _, dev := range reg.devices {
+		devices = append(devices, *dev)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+
+	return devices
+}
+
+// CheckIn checks in deviceName, adding it as a recording device if it
+// has never checked in before
+func (reg *deviceRegistry) CheckIn(deviceName string, now time.Time) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if ok {
+		if dev.IsCheckedIn {
+			return errAlreadyCheckedIn
+		}
+
+		err := execTXQuery("UPDATE device SET latest_check_in_time=?, is_checked_in=1 WHERE name=?;", now, deviceName)
+
+		if err != nil {
+			return err
+		}
+
+		dev.LatestCheckInTime = now
+		dev.IsCheckedIn = true
+		return nil
+	}
+
+	err := execTXQuery(
+		"INSERT INTO device (name, set_num, latest_check_in_time, is_new_set, is_recording, is_checked_in, set_started_at) "+
+			"VALUES (?,?,?,?,?,?,?);",
+		deviceName, 0, now, 0, 1, 1, now,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	reg.devices[deviceName] = &device{
+		Name:              deviceName,
+		LatestCheckInTime: now,
+		IsRecording:       true,
+		IsCheckedIn:       true,
+		SetStartedAt:      &now,
+	}
+
+	return nil
+}
+
+// Heartbeat records that a checked in deviceName was heard from at now
+// and returns the device as it was before the heartbeat
+// If clearNewSet is true the device has reset to its new set and is no
+// longer told to
+// As heartbeats come in every few seconds the check in time is only
+// written to the database by FlushCheckIns
+func (reg *deviceRegistry) Heartbeat(deviceName string, now time.Time, clearNewSet bool) (device, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return device{}, errDeviceNotFound
+	}
+
+	if !dev.IsCheckedIn {
+		return device{}, errNotCheckedIn
+	}
+
+	previous := *dev
+
+	if clearNewSet && dev.IsNewSet {
+		err := execTXQuery("UPDATE device SET latest_check_in_time=?, is_new_set=0 WHERE name=?;", now, deviceName)
+
+		if err != nil {
+			return device{}, err
+		}
+
+		dev.IsNewSet = false
+		delete(reg.heardFrom, deviceName)
+	} else {
+		reg.heardFrom[deviceName] = true
+	}
+
+	dev.LatestCheckInTime = now
+	return previous, nil
+}
+
+// FlushCheckIns writes the latest check in time of every device heard
+// from since the last flush to the database in one transaction
+func (reg *deviceRegistry) FlushCheckIns() error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if len(reg.heardFrom) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE device SET latest_check_in_time=? WHERE name=?;")
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	for deviceName := range reg.heardFrom {
+		if _, err = stmt.Exec(reg.devices[deviceName].LatestCheckInTime, deviceName); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	reg.heardFrom = make(map[string]bool)
+	return nil
+}
+
+// MeasureClockSkew adds a measurement of how far the clock of deviceName
+// is ahead of the server and returns the skew in seconds
+// Device times only have second precision, so measurements are smoothed
+// unless one is more than clock_skew_threshold away from the current
+// skew, which means the device clock was set and the skew starts over
+func (reg *deviceRegistry) MeasureClockSkew(deviceName string, measured time.Duration) (float64, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return 0, errDeviceNotFound
+	}
+
+	seconds := measured.Seconds()
+
+	if math.Abs(seconds-dev.ClockSkew) > float64(setting.ClockSkewThreshold) {
+		dev.ClockSkew = seconds
+	} else {
+		dev.ClockSkew += (seconds - dev.ClockSkew) / 8
+	}
+
+	return dev.ClockSkew, nil
+}
+
+// SetRecording turns recording of deviceName on or off
+// Recording can't be turned on while a new set is being started
+func (reg *deviceRegistry) SetRecording(deviceName string, isRecording bool) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return errDeviceNotFound
+	}
+
+	if isRecording && reg.rotating[deviceName] {
+		return errNewSetPending
+	}
+
+	if dev.IsRecording == isRecording {
+		return nil
+	}
+
+	if err := execTXQuery("UPDATE device SET is_recording=? WHERE name=?;", isRecording, deviceName); err != nil {
+		return err
+	}
+
+	dev.IsRecording = isRecording
+	return nil
+}
+
+// SetTimezone sets the time zone deviceName sends its times in
+func (reg *deviceRegistry) SetTimezone(deviceName string, timezone string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return errDeviceNotFound
+	}
+
+	if err := execTXQuery("UPDATE device SET timezone=? WHERE name=?;", timezone, deviceName); err != nil {
+		return err
+	}
+
+	dev.Timezone = timezone
+	return nil
+}
+
+// SetProtocol records the protocol version and capabilities deviceName
+// reported in its hello
+func (reg *deviceRegistry) SetProtocol(deviceName string, version int, capabilities []string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return errDeviceNotFound
+	}
+
+	joined := strings.Join(capabilities, ",")
+	err := execTXQuery("UPDATE device SET protocol_version=?, capabilities=? WHERE name=?;", version, joined, deviceName)
+
+	if err != nil {
+		return err
+	}
+
+	dev.ProtocolVersion = version
+	dev.Capabilities = joined
+	return nil
+}
+
+// SetConfigGroup moves deviceName into group, which changes its client
+// config as of revision
+func (reg *deviceRegistry) SetConfigGroup(deviceName string, group string, revision int) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return errDeviceNotFound
+	}
+
+	err := execTXQuery("UPDATE device SET config_group=?, config_revision=? WHERE name=?;", group, revision, deviceName)
+
+	if err != nil {
+		return err
+	}
+
+	dev.ConfigGroup = group
+	dev.ConfigRevision = revision
+	return nil
+}
+
+// SetAppliedConfig records that deviceName applied version of its client
+// config at now
+func (reg *deviceRegistry) SetAppliedConfig(deviceName string, version int, now time.Time) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dev, ok := reg.devices[deviceName]
+
+	if !ok {
+		return errDeviceNotFound
+	}
+
+	if dev.AppliedConfigVersion == version {
+		return nil
+	}
+
+	err := execTXQuery("UPDATE device SET applied_config_version=?, config_applied_at=? WHERE name=?;", version, now, deviceName)
+
+	if err != nil {
+		return err
+	}
+
+	dev.AppliedConfigVersion = version
+	dev.ConfigAppliedAt = &now
+	return nil
+}
+
+// BeginNewSet moves the current readings of deviceName into a new set
+// with rotate and flags the device to reset its local file
+// The finished set is saved to set_summary as having run from when the
+// current set started until now, which is when the next one starts
+// The device must not be recording or still resetting from its last set
+func (reg *deviceRegistry) BeginNewSet(deviceName string, now time.Time, rotate func(deviceName string) (int, error)) (device, error) {
+	reg.mu.Lock()
+	dev, ok := reg.devices[deviceName]
+
+	switch {
+	case !ok:
+		reg.mu.Unlock()
+		return device{}, errDeviceNotFound
+	case dev.IsRecording:
+		reg.mu.Unlock()
+		return device{}, errDeviceRecording
+	case dev.IsNewSet || reg.rotating[deviceName]:
+		reg.mu.Unlock()
+		return device{}, errNewSetPending
+	}
+
+	reg.rotating[deviceName] = true
+	reg.mu.Unlock()
+
+	setNum, err := rotate(deviceName)
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.rotating, deviceName)
+
+	if err != nil {
+		return device{}, err
+	}
+
+	if err = saveNewSet(dev, setNum, now); err != nil {
+		return device{}, errors.Wrapf(err, "set %d was written but couldn't be saved to the database", setNum)
+	}
+
+	dev.IsNewSet = true
+	dev.SetNum = setNum
+	dev.LatestSetTime = &now
+	dev.SetStartedAt = &now
+	return *dev, nil
+}
+
+// saveNewSet records in one transaction that dev finished set setNum at
+// now and started its next set
+// A summary left over from a set with the same number, which can happen
+// after the database was wiped, is replaced
+func saveNewSet(dev *device, setNum int, now time.Time) error {
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO set_summary (device_name, set_num, start_time, end_time) VALUES (?,?,?,?);",
+		dev.Name, setNum, dev.SetStartedAt, now,
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE device SET is_new_set=1, set_num=?, latest_set_time=?, set_started_at=? WHERE name=?;",
+		setNum, now, now, dev.Name,
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TimeOut checks out every checked in device not heard from since cutoff
+// and returns their names
+func (reg *deviceRegistry) TimeOut(cutoff time.Time) ([]string, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	timedOut := make([]string, 0)
+
+	for deviceName, dev := range reg.devices {
+		if !dev.IsCheckedIn || !dev.LatestCheckInTime.Before(cutoff) {
+			continue
+		}
+
+		if err := execTXQuery("UPDATE device SET is_checked_in=0 WHERE name=?;", deviceName); err != nil {
+			return timedOut, err
+		}
+
+		dev.IsCheckedIn = false
+		timedOut = append(timedOut, deviceName)
+	}
+
+	sort.Strings(timedOut)
+	return timedOut, nil
+}
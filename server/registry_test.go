@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRegistry migrates a new test database and loads an empty
+// registry from it
+func newTestRegistry(t testing.TB) *deviceRegistry {
+	t.Helper()
+	newTestDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := loadDeviceRegistry()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reg
+}
+
+// TestRegistryConcurrentChanges hammers every device from several
+// goroutines at once and is meant to be run with -race
+// Afterwards the registry and the database must still agree
+func TestRegistryConcurrentChanges(t *testing.T) {
+	reg := newTestRegistry(t)
+	deviceNames := make([]string, 8)
+
+	for i := range deviceNames {
+		deviceNames[i] = fmt.Sprintf("device%d", i)
+	}
+
+	var setsMu sync.Mutex
+	sets := make(map[string]int)
+	rotate := func(deviceName string) (int, error) {
+		setsMu.Lock()
+		defer setsMu.Unlock()
+		sets[deviceName]++
+		return sets[deviceName], nil
+	}
+
+	unexpected := make(chan error, 100)
+	report := func(err error, allowed ...error) {
+		for _, allowedErr := range allowed {
+			if err == allowedErr {
+				return
+			}
+		}
+
+		if err != nil {
+			select {
+			case unexpected <- err:
+			default:
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	const rounds = 50
+
+	for _, deviceName := range deviceNames {
+		deviceName := deviceName
+		wg.Add(4)
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				report(reg.CheckIn(deviceName, time.Now().UTC()), errAlreadyCheckedIn)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				_, err := reg.Heartbeat(deviceName, time.Now().UTC(), i%3 == 0)
+				report(err, errDeviceNotFound, errNotCheckedIn)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				report(reg.SetRecording(deviceName, i%2 == 0), errDeviceNotFound, errNewSetPending)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				_, err := reg.BeginNewSet(deviceName, time.Now().UTC(), rotate)
+				report(err, errDeviceNotFound, errDeviceRecording, errNewSetPending)
+			}
+		}()
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < rounds; i++ {
+			_, err := reg.TimeOut(time.Now().UTC().Add(-time.Millisecond))
+			report(err)
+			report(reg.FlushCheckIns())
+			reg.Snapshot()
+			reg.Names()
+		}
+	}()
+
+	wg.Wait()
+	close(unexpected)
+
+	for err := range unexpected {
+		t.Error(err)
+	}
+
+	if err := reg.FlushCheckIns(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadDeviceRegistry()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dev := range reg.Snapshot() {
+		saved, ok := loaded.Get(dev.Name)
+
+		switch {
+		case !ok:
+			t.Errorf("%s is not in the database", dev.Name)
+		case saved.SetNum != dev.SetNum || saved.IsNewSet != dev.IsNewSet ||
+			saved.IsRecording != dev.IsRecording || saved.IsCheckedIn != dev.IsCheckedIn:
+			t.Errorf("%s differs from the database, memory %+v database %+v", dev.Name, dev, saved)
+		case dev.SetNum != sets[dev.Name]:
+			t.Errorf("%s is at set %d but %d sets were rotated", dev.Name, dev.SetNum, sets[dev.Name])
+		}
+	}
+}
+
+// TestRegistryRecordingWhileRotating makes sure recording can't be turned
+// back on and no second set started while a set is being rotated
+func TestRegistryRecordingWhileRotating(t *testing.T) {
+	reg := newTestRegistry(t)
+	now := time.Now().UTC()
+
+	if err := reg.CheckIn("kitchen", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.SetRecording("kitchen", false); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan error)
+
+	go func() {
+		_, err := reg.BeginNewSet("kitchen", now, func(string) (int, error) {
+			started <- true
+			<-release
+			return 1, nil
+		})
+		done <- err
+	}()
+
+	<-started
+
+	if err := reg.SetRecording("kitchen", true); err != errNewSetPending {
+		t.Errorf("recording turned on while rotating, got %v", err)
+	}
+
+	if _, err := reg.BeginNewSet("kitchen", now, nil); err != errNewSetPending {
+		t.Errorf("second set started while rotating, got %v", err)
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	dev, _ := reg.Get("kitchen")
+
+	if !dev.IsNewSet || dev.SetNum != 1 {
+		t.Fatalf("set not started: %+v", dev)
+	}
+}
+
+// TestRegistryNewSetSavesSetTimes checks each finished set is saved as
+// running from when the previous one was started, or the device first
+// checked in, until it was rotated
+func TestRegistryNewSetSavesSetTimes(t *testing.T) {
+	reg := newTestRegistry(t)
+	checkedIn := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	times := []time.Time{checkedIn.Add(2 * time.Hour), checkedIn.Add(5 * time.Hour)}
+
+	if err := reg.CheckIn("kitchen", checkedIn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.SetRecording("kitchen", false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, now := range times {
+		set := i + 1
+		_, err := reg.BeginNewSet("kitchen", now, func(string) (int, error) { return set, nil })
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The device has to reset before the next set can be started
+		if _, err = reg.Heartbeat("kitchen", now, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []time.Time{checkedIn, times[0]} {
+		start, err := savedSetStart("kitchen", i+1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if start == nil || !start.Equal(want) {
+			t.Errorf("set %d started at %v, want %v", i+1, start, want)
+		}
+	}
+
+	dev, _ := reg.Get("kitchen")
+
+	if dev.SetStartedAt == nil || !dev.SetStartedAt.Equal(times[1]) {
+		t.Errorf("current set started at %v, want %v", dev.SetStartedAt, times[1])
+	}
+
+	start, err := setStart(dev, 1, []reading{{Time: checkedIn.Add(time.Hour)}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !start.Equal(checkedIn) {
+		t.Errorf("set 1 is aligned on %v, want %v", start, checkedIn)
+	}
+}
+
+// TestRegistryMeasureClockSkew checks measurements within
+// clock_skew_threshold are smoothed and one further away starts over
+func TestRegistryMeasureClockSkew(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	if err := reg.CheckIn("kitchen", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	measurements := []struct {
+		measured time.Duration
+		skew     float64
+	}{
+		{8 * time.Second, 1},
+		{9 * time.Second, 2},
+		{-2 * time.Minute, -120},
+		{-112 * time.Second, -119},
+	}
+
+	for _, measurement := range measurements {
+		skew, err := reg.MeasureClockSkew("kitchen", measurement.measured)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if skew != measurement.skew {
+			t.Errorf("skew is %v after measuring %v, want %v", skew, measurement.measured, measurement.skew)
+		}
+	}
+
+	if dev, _ := reg.Get("kitchen"); !dev.IsClockSkewed() || dev.ClockSkewSeconds() != -119 {
+		t.Errorf("device skew is %v, want -119 and skewed", dev.ClockSkew)
+	}
+
+	if _, err := reg.MeasureClockSkew("attic", time.Second); err != errDeviceNotFound {
+		t.Errorf("measuring an unknown device returned %v, want %v", err, errDeviceNotFound)
+	}
+
+	sent := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	if corrected := correctClockSkew(sent, -119.4); !corrected.Equal(sent.Add(119 * time.Second)) {
+		t.Errorf("%v corrected to %v, want 119s later", sent, corrected)
+	}
+}
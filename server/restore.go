@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// eachArchiveEntry calls fn with every entry of the .tar.gz at archivePath
+func eachArchiveEntry(archivePath string, fn func(hdr *tar.Header, tr *tar.Reader) error) error {
+	archiveFile, err := os.Open(archivePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer archiveFile.Close()
+	gr, err := gzip.NewReader(archiveFile)
+
+	if err != nil {
+		return err
+	}
+
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	for {
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreDestination returns where an archive entry should be restored
+// to, or an empty string if the entry is not restored
+// Entry names are checked so a bad archive can't write outside of our
+// data directories
+func restoreDestination(name string) (string, error) {
+	cleanName := path.Clean(name)
+
+	if strings.HasPrefix(cleanName, "../") || strings.HasPrefix(cleanName, "/") || cleanName == ".." {
+		return "", errors.New("Archive entry " + name + " points outside of the archive")
+	}
+
+	switch {
+	case cleanName == "server.db":
+		return setting.ServerDBFile, nil
+	case strings.HasPrefix(cleanName, "csv/"):
+		return filepath.Join(setting.CsvDirectory, filepath.FromSlash(strings.TrimPrefix(cleanName, "csv/"))), nil
+	case strings.HasPrefix(cleanName, "sets/"):
+		return filepath.Join(setting.SetsDirectory, filepath.FromSlash(strings.TrimPrefix(cleanName, "sets/"))), nil
+	}
+
+	// server.ini and the checksum file are not restored
+	return "", nil
+}
+
+// verifyBackupArchive reads through the archive at archivePath and checks
+// every entry against the SHA256SUMS file written by writeBackupArchive
+func verifyBackupArchive(archivePath string) error {
+	computed := make(map[string]string)
+	expected := make(map[string]string)
+
+	err := eachArchiveEntry(archivePath, func(hdr *tar.Header, tr *tar.Reader) error {
+		if _, err := restoreDestination(hdr.Name); err != nil {
+			return err
+		}
+
+		if hdr.Name == checksumFileName {
+			scanner := bufio.NewScanner(tr)
+
+			for scanner.Scan() {
+				fields := strings.SplitN(scanner.Text(), "  ", 2)
+
+				if len(fields) != 2 {
+					return errors.New("Malformed line in " + checksumFileName + ": " + scanner.Text())
+				}
+
+				expected[fields[1]] = fields[0]
+			}
+
+			return scanner.Err()
+		}
+
+		hash := sha256.New()
+
+		if _, err := io.Copy(hash, tr); err != nil {
+			return err
+		}
+
+		computed[hdr.Name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+
+	if err != nil {
+		return errors.Wrap(err, "Couldn't read archive")
+	}
+
+	if len(expected) == 0 {
+		return errors.New("Archive has no " + checksumFileName + ", can't verify it")
+	}
+
+	problems := make([]string, 0)
+
+	for name, checksum := range expected {
+		if computedChecksum, ok := computed[name]; !ok {
+			problems = append(problems, name+" is missing")
+		} else if computedChecksum != checksum {
+			problems = append(problems, name+" checksum does not match")
+		}
+	}
+
+	for name := range computed {
+		if _, ok := expected[name]; !ok {
+			problems = append(problems, name+" is not in "+checksumFileName)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Archive is corrupt: " + strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// restoreBackupArchive replaces the database, current csv files and sets
+// with the ones in the archive at archivePath
+// The archive is verified first and a backup of the current data is made
+// before anything is replaced
+func restoreBackupArchive(archivePath string) (preRestoreArchive string, err error) {
+	if err = verifyBackupArchive(archivePath); err != nil {
+		return "", err
+	}
+
+	preRestoreArchive, err = writeBackupArchive("pre-restore")
+
+	if err != nil {
+		return "", errors.Wrap(err, "Couldn't back up current data, nothing was restored")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err = removeCurrentCSVFiles(); err != nil {
+		return preRestoreArchive, err
+	}
+
+	if err = removeDirectoryContents(setting.SetsDirectory, backupDirectory()); err != nil {
+		return preRestoreArchive, err
+	}
+
+	err = eachArchiveEntry(archivePath, func(hdr *tar.Header, tr *tar.Reader) error {
+		destination, err := restoreDestination(hdr.Name)
+
+		if err != nil || destination == "" || hdr.Typeflag == tar.TypeDir {
+			return err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+			return err
+		}
+
+		// Write to a temporary file first so a failed restore never
+		// leaves a half written database or csv file in place
+		temporaryFile := destination + ".restore"
+		file, err := os.OpenFile(temporaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(file, tr); err != nil {
+			file.Close()
+			os.Remove(temporaryFile)
+			return err
+		}
+
+		if err = file.Close(); err != nil {
+			return err
+		}
+
+		return os.Rename(temporaryFile, destination)
+	})
+
+	return preRestoreArchive, err
+}
+
+// runRestoreCommand is the restore subcommand which restores the archive
+// given as the first argument and exits
+// With -dry-run the archive is only verified
+// The server should be stopped before restoring
+func runRestoreCommand() {
+	if len(subcommandArgs) != 1 {
+		fmt.Println("Usage: server restore [-dry-run] <archive.tar.gz>")
+		os.Exit(2)
+	}
+
+	archivePath := subcommandArgs[0]
+
+	if *dryRunFlag {
+		err := verifyBackupArchive(archivePath)
+		checkError(err, "Verifying "+archivePath, true)
+		fmt.Println(archivePath + " is valid")
+		os.Exit(0)
+	}
+
+	preRestoreArchive, err := restoreBackupArchive(archivePath)
+
+	if preRestoreArchive != "" {
+		fmt.Println("Data before restore was backed up to " + preRestoreArchive)
+	}
+
+	checkError(err, "Restoring "+archivePath, true)
+	fmt.Println("Restored " + archivePath)
+	os.Exit(0)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// motionChannel is the channel every device has, holding the motion
+// sent by devices that only know the legacy time stamp
+const motionChannel = "motion"
+
+// sensorTypes maps every sensor type to the unit used when a device
+// doesn't declare one
+// motion and contact are binary, only the times they are active are
+// stored, the others are numeric and every value is stored
+var sensorTypes = map[string]string{
+	"motion":      "",
+	"contact":     "",
+	"temperature": "C",
+	"light":       "lux",
+}
+
+// channelNamePattern limits channel names to what is safe in file names
+var channelNamePattern = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+// sensor describes one channel of a device
+type sensor struct {
+	DeviceName string    `json:"deviceName" db:"device_name"`
+	Channel    string    `json:"channel" db:"channel"`
+	Type       string    `json:"type" db:"type"`
+	Unit       string    `json:"unit" db:"unit"`
+	CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+}
+
+// IsBinary determines if the channel of s is on or off rather than a
+// measurement
+func (s sensor) IsBinary() bool {
+	return s.Type == "motion" || s.Type == "contact"
+}
+
+// sensorCatalog holds the channels of every device, kept in memory as it
+// is looked up for every reading
+type sensorCatalog struct {
+	sync.RWMutex
+	sensors map[string]map[string]sensor
+}
+
+// loadSensorCatalog reads every sensor from the database
+func loadSensorCatalog() (*sensorCatalog, error) {
+	rows := make([]sensor, 0)
+
+	if err := db.Select(&rows, "SELECT * FROM sensor;"); err != nil {
+		return nil, err
+	}
+
+	catalog := &sensorCatalog{sensors: make(map[string]map[string]sensor)}
+
+	for _, row := range rows {
+		catalog.add(row)
+	}
+
+	return catalog, nil
+}
+
+func (c *sensorCatalog) add(s sensor) {
+	if c.sensors[s.DeviceName] == nil {
+		c.sensors[s.DeviceName] = make(map[string]sensor)
+	}
+
+	c.sensors[s.DeviceName][s.Channel] = s
+}
+
+// Get returns the sensor on channel of deviceName and whether it exists
+// The motion channel always exists
+func (c *sensorCatalog) Get(deviceName string, channel string) (sensor, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	s, ok := c.sensors[deviceName][channel]
+
+	if !ok && channel == motionChannel {
+		return sensor{DeviceName: deviceName, Channel: motionChannel, Type: "motion"}, true
+	}
+
+	return s, ok
+}
+
+// Channels returns every sensor of deviceName, motion first and the rest
+// sorted by channel
+func (c *sensorCatalog) Channels(deviceName string) []sensor {
+	motion, _ := c.Get(deviceName, motionChannel)
+	c.RLock()
+	defer c.RUnlock()
+	sensors := make([]sensor, 0, len(c.sensors[deviceName])+1)
+
+	for channel, s := range c.sensors[deviceName] {
+		if channel != motionChannel {
+			sensors = append(sensors, s)
+		}
+	}
+
+	sort.Slice(sensors, func(i, j int) bool {
+		return sensors[i].Channel < sensors[j].Channel
+	})
+
+	return append([]sensor{motion}, sensors...)
+}
+
+// Declare adds or changes the sensors of deviceName
+func (c *sensorCatalog) Declare(deviceName string, sensors []sensor) error {
+	c.Lock()
+	defer c.Unlock()
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for i := range sensors {
+		sensors[i].DeviceName = deviceName
+		sensors[i].CreatedAt = now
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO sensor (device_name, channel, type, unit, created_at) VALUES (?,?,?,?,?);",
+			deviceName,
+			sensors[i].Channel,
+			sensors[i].Type,
+			sensors[i].Unit,
+			now,
+		)
+
+		if err == nil {
+			_, err = tx.Exec(
+				"UPDATE sensor SET type=?, unit=? WHERE device_name=? AND channel=?;",
+				sensors[i].Type,
+				sensors[i].Unit,
+				deviceName,
+				sensors[i].Channel,
+			)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, s := range sensors {
+		c.add(s)
+	}
+
+	return nil
+}
+
+// parseSensors parses a sensor declaration such as
+// "pir2:motion,door:contact,temp:temperature:F" where the unit is optional
+func parseSensors(declaration string) ([]sensor, error) {
+	sensors := make([]sensor, 0)
+
+	for _, field := range strings.Split(declaration, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, errors.New("Sensor must be channel:type or channel:type:unit, got " + field)
+		}
+
+		if !channelNamePattern.MatchString(parts[0]) {
+			return nil, errors.New("Channel " + parts[0] + " must be lower case letters, numbers and _ starting with a letter")
+		}
+
+		unit, ok := sensorTypes[parts[1]]
+
+		if !ok {
+			return nil, errors.New("Sensor type " + parts[1] + " must be one of motion, contact, temperature or light")
+		}
+
+		if parts[0] == motionChannel && parts[1] != "motion" {
+			return nil, errors.New("Channel " + motionChannel + " can only be a motion sensor")
+		}
+
+		if len(parts) == 3 {
+			unit = parts[2]
+		}
+
+		sensors = append(sensors, sensor{Channel: parts[0], Type: parts[1], Unit: unit})
+	}
+
+	return sensors, nil
+}
+
+// parseChannelValues parses the values of a time stamp such as
+// "pir1=1;door=0;temperature=21.5" into readings taken at t
+// Binary channels only give a reading when active
+// movement is true if any motion channel is active
+func parseChannelValues(deviceName string, values string, t time.Time) (readings []reading, movement bool, err error) {
+	readings = make([]reading, 0)
+
+	for _, field := range strings.Split(values, ";") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+
+		if len(parts) != 2 {
+			return nil, false, errors.New("Channel value must be channel=value, got " + field)
+		}
+
+		s, ok := sensors.Get(deviceName, parts[0])
+
+		if !ok {
+			return nil, false, errors.New("Unknown channel " + parts[0] + ", declare it with sensors when checking in")
+		}
+
+		if s.IsBinary() {
+			active, err := strconv.ParseBool(parts[1])
+
+			if err != nil {
+				return nil, false, errors.New("Value of " + parts[0] + " must be either true or false")
+			}
+
+			if active {
+				readings = append(readings, reading{Channel: s.Channel, Time: t})
+				movement = movement || s.Type == "motion"
+			}
+
+			continue
+		}
+
+		value, err := strconv.ParseFloat(parts[1], 64)
+
+		if err != nil || !isFinite(value) {
+			return nil, false, errors.New("Value of " + parts[0] + " must be a number")
+		}
+
+		readings = append(readings, reading{Channel: s.Channel, Time: t, Value: &value})
+	}
+
+	return readings, movement, nil
+}
+
+// isFinite determines if value is neither NaN nor infinite, which
+// ParseFloat accepts but can't be sent to the dashboard as json
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// sensorsHandler is an api endpoint that returns the sensors of a device
+func sensorsHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	deviceName := r.Form.Get("deviceName")
+
+	if _, ok := registry.Get(deviceName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Device name does not exist"))
+		return
+	}
+
+	sendPayload(w, sensors.Channels(deviceName))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSensors sets up a test server with kitchen declaring a door
+// contact and a temperature channel
+func newTestSensors(t *testing.T) {
+	t.Helper()
+	newTestServer(t)
+	declared, err := parseSensors("door:contact,temp:temperature:F")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sensors.Declare("kitchen", declared); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSensors(t *testing.T) {
+	declared, err := parseSensors("pir2:motion, door:contact,temp:temperature:F,lux:light")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sensor{
+		{Channel: "pir2", Type: "motion", Unit: ""},
+		{Channel: "door", Type: "contact", Unit: ""},
+		{Channel: "temp", Type: "temperature", Unit: "F"},
+		{Channel: "lux", Type: "light", Unit: "lux"},
+	}
+
+	if len(declared) != len(want) {
+		t.Fatalf("%d sensors parsed, want %d", len(declared), len(want))
+	}
+
+	for i := range want {
+		if declared[i] != want[i] {
+			t.Errorf("sensor %d is %+v, want %+v", i, declared[i], want[i])
+		}
+	}
+
+	for _, declaration := range []string{"temp", "Temp:temperature", "temp:pressure", "motion:contact", "a:motion:b:c"} {
+		if _, err = parseSensors(declaration); err == nil {
+			t.Errorf("%q parsed, want an error", declaration)
+		}
+	}
+}
+
+func TestParseChannelValues(t *testing.T) {
+	newTestSensors(t)
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	readings, movement, err := parseChannelValues("kitchen", "motion=1;door=false;temp=21.5", now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !movement {
+		t.Error("motion=1 not reported as movement")
+	}
+
+	// The inactive door gives no reading
+	if len(readings) != 2 || readings[0].Channel != motionChannel || readings[1].Channel != "temp" {
+		t.Fatalf("wrong readings %+v", readings)
+	}
+
+	if readings[1].Value == nil || *readings[1].Value != 21.5 {
+		t.Fatalf("temp reading has value %v, want 21.5", readings[1].Value)
+	}
+
+	for _, values := range []string{"temp=NaN", "temp=Inf", "temp=-Inf", "temp=warm", "door=open", "window=1", "temp"} {
+		if _, _, err = parseChannelValues("kitchen", values, now); err == nil {
+			t.Errorf("%q parsed, want an error", values)
+		}
+	}
+}
+
+func TestParseCSVReadingRejectsNonFiniteValues(t *testing.T) {
+	r, err := parseCSVReading("2024-03-01T08:00:00Z,21.5", time.UTC)
+
+	if err != nil || r.Value == nil || *r.Value != 21.5 {
+		t.Fatalf("value not read, got %+v %v", r, err)
+	}
+
+	if _, err = parseCSVReading("2024-03-01T08:00:00Z,NaN", time.UTC); err == nil {
+		t.Fatal("NaN value read from csv")
+	}
+}
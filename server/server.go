@@ -6,18 +6,30 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	_ "time/tzdata"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
 )
 
 var (
-	mu           sync.RWMutex
-	tpl          *template.Template
-	deviceCenter *devCenter
-	db           *sqlx.DB
-	server       *http.Server
-	setting      *settings
+	mu       sync.RWMutex
+	tpl      *template.Template
+	registry *deviceRegistry
+	sensors  *sensorCatalog
+	configs  *clientConfigStore
+	activity *liveActivity
+	sessions = newSessionStore()
+	guard    = newSourceGuard()
+	db       *sqlx.DB
+	server   *http.Server
+	setting  *settings
+	logger   = logrus.New()
+	store    readingStore
+
+	// occupancy is only set when the occupancy setting is on
+	occupancy *occupancyTracker
 )
 
 const (
@@ -25,34 +37,103 @@ const (
 	fileMode    = os.FileMode(0700)
 )
 
-func init() {
+// initServer loads settings, runs any subcommand and sets up the
+// database and global variables
+// It is called from main rather than init so tests don't parse the
+// command line or touch the real database
+func initServer() {
+	parseCommandLine()
 	initSettings()
+
+	if subcommand == "validate-config" {
+		validateConfig()
+	}
+
 	initFileSystem()
-	initLogger()
 	loadSettingsFile()
+	initDataDirectories()
+
+	if subcommand == "export-assets" {
+		exportAssets()
+	}
+
+	initLogger()
+
+	switch subcommand {
+	case "backup":
+		runBackupCommand()
+	case "restore":
+		runRestoreCommand()
+	}
+
 	commandLineArgs()
 	initDatabase()
+
+	if subcommand == "user" {
+		runUserCommand()
+	}
+
 	initGlobalVariables()
 }
 
 func main() {
+	initServer()
 	fmt.Println("Server running...")
+	logger.WithField("address", server.Addr).Info("Server running")
+
+	http.HandleFunc("/", dashboardPage(roleViewer, mainView))
+	http.HandleFunc("/login/", rateLimited(loginHandler))
+	http.HandleFunc("/logout/", dashboardPage(roleViewer, logoutHandler))
+	http.Handle("/static/", staticHandler())
+	http.HandleFunc("/new-set/", dashboardAPI(roleOperator, newSetHandler))
+	http.HandleFunc("/reload-csv/", rateLimited(reloadCSVHandler))
+	http.HandleFunc("/record-mode-handler/", dashboardAPI(roleOperator, recordModeHandler))
+	http.HandleFunc("/device-status-handler/", rateLimited(deviceStatusHandler))
+	http.HandleFunc("/update-status-handler/", dashboardAPI(roleViewer, updateStatusHandler))
+	http.HandleFunc("/status-snapshot/", dashboardAPI(roleViewer, statusSnapshotHandler))
+	http.HandleFunc("/sensor-handler/", rateLimited(sensorHandler))
+	http.HandleFunc("/update-chart-handler/", dashboardAPI(roleViewer, updateChartHandler))
+	http.HandleFunc("/occupancy/", dashboardAPI(roleViewer, occupancyHandler))
+	http.HandleFunc("/sensors/", dashboardAPI(roleViewer, sensorsHandler))
+	http.HandleFunc("/analytics/", dashboardAPI(roleViewer, analyticsHandler))
+	http.HandleFunc("/compare/", dashboardPage(roleViewer, compareView))
+	http.HandleFunc("/compare-data/", dashboardAPI(roleViewer, compareHandler))
+	http.HandleFunc("/sets/", dashboardPage(roleViewer, setsView))
+	http.HandleFunc("/set-list/", dashboardAPI(roleViewer, setListHandler))
+	http.HandleFunc("/set-preview/", dashboardAPI(roleViewer, setPreviewHandler))
+	http.HandleFunc("/set-download/", dashboardAPI(roleViewer, setDownloadHandler))
+	http.HandleFunc("/set-label/", dashboardAPI(roleOperator, setLabelHandler))
+	http.HandleFunc("/commands/", dashboardPage(roleAdmin, commandsView))
+	http.HandleFunc("/command-list/", dashboardAPI(roleAdmin, commandListHandler))
+	http.HandleFunc("/command-queue/", dashboardAPI(roleAdmin, commandQueueHandler))
+	http.HandleFunc("/command-cancel/", dashboardAPI(roleAdmin, commandCancelHandler))
+	http.HandleFunc("/config/", dashboardPage(roleAdmin, configView))
+	http.HandleFunc("/config-list/", dashboardAPI(roleAdmin, configListHandler))
+	http.HandleFunc("/config-save/", dashboardAPI(roleAdmin, configSaveHandler))
+	http.HandleFunc("/config-group/", dashboardAPI(roleAdmin, configGroupHandler))
+	http.HandleFunc("/users/", dashboardPage(roleAdmin, usersView))
+	http.HandleFunc("/user-save/", dashboardAPI(roleAdmin, userSaveHandler))
+	http.HandleFunc("/user-remove/", dashboardAPI(roleAdmin, userRemoveHandler))
+	http.HandleFunc("/blocked/", dashboardPage(roleAdmin, blockedView))
+	http.HandleFunc("/unblock/", dashboardAPI(roleAdmin, unblockHandler))
+	http.HandleFunc("/check-in-handler/", rateLimited(deviceCheckInHandler))
+	http.HandleFunc("/api/device/hello", rateLimited(deviceHelloHandler))
+	http.HandleFunc("/api/device/ack", rateLimited(deviceAckHandler))
+	http.HandleFunc("/api/device/config", rateLimited(deviceConfigHandler))
+	http.HandleFunc("/device-timezone/", rateLimited(deviceTimezoneHandler))
+	http.HandleFunc("/download-tar/", dashboardAPI(roleViewer, downloadTarHandler))
+	http.HandleFunc("/generate-device-tar/", dashboardAPI(roleViewer, generateDeviceTarHandler))
+	http.HandleFunc("/generate-all-devices-tar/", dashboardAPI(roleViewer, generateAllDevicesTarHandler))
 
-	http.HandleFunc("/", mainView)
-	http.HandleFunc("/new-set/", newSetHandler)
-	http.HandleFunc("/reload-csv/", reloadCSVHandler)
-	http.HandleFunc("/record-mode-handler/", recordModeHandler)
-	http.HandleFunc("/device-status-handler/", deviceStatusHandler)
-	http.HandleFunc("/update-status-handler/", updateStatusHandler)
-	http.HandleFunc("/sensor-handler/", sensorHandler)
-	http.HandleFunc("/update-chart-handler/", updateChartHandler)
-	http.HandleFunc("/check-in-handler/", deviceCheckInHandler)
-	http.HandleFunc("/download-tar/", downloadTarHandler)
-	http.HandleFunc("/generate-device-tar/", generateDeviceTarHandler)
-	http.HandleFunc("/generate-all-devices-tar/", generateAllDevicesTarHandler)
-
-	fmt.Println("here")
 	go updateCheckIn()
+	go flushWrites()
+	go handleShutdown()
+
+	if setting.BackupTime != "" {
+		go scheduleBackups()
+	}
+
+	server.Handler = logRequests(http.DefaultServeMux)
 
 	if setting.HTTPS {
 		// server.Addr = "https://" + setting.IPAddress + setting.Port
@@ -60,6 +141,11 @@ func main() {
 		// checkError(err, "Listen and server tls", true)
 	} else {
 		err := server.ListenAndServe()
-		checkError(err, "Listen and server", true)
+
+		if err != http.ErrServerClosed {
+			checkError(err, "Listen and server", true)
+		}
+
+		<-shutdownComplete
 	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newTestDatabase points setting at the default settings in a temporary
+// project root and db at an empty database there, restoring both when the
+// test is done
+func newTestDatabase(t testing.TB) {
+	t.Helper()
+	root := t.TempDir()
+	oldSetting, oldDB := setting, db
+	logger.SetOutput(io.Discard)
+	setting = &settings{ProjectRoot: root, ServerConfigFile: filepath.Join(root, "server.ini")}
+
+	// The only problem expected is server.ini not being there
+	if problems := applySettings(); len(problems) != 1 {
+		t.Fatalf("default settings have problems: %v", problems)
+	}
+
+	var err error
+	db, err = sqlx.Open("sqlite3", setting.ServerDBFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		setting, db = oldSetting, oldDB
+	})
+}
+
+// newTestServer sets up every global the server loads at startup on a new
+// migrated test database without any devices, restoring them all when the
+// test is done
+func newTestServer(t testing.TB) {
+	t.Helper()
+	oldRegistry, oldSensors, oldConfigs, oldActivity := registry, sensors, configs, activity
+	oldStore, oldGuard, oldOccupancy := store, guard, occupancy
+	t.Cleanup(func() {
+		registry, sensors, configs, activity = oldRegistry, oldSensors, oldConfigs, oldActivity
+		store, guard, occupancy = oldStore, oldGuard, oldOccupancy
+	})
+
+	newTestDatabase(t)
+
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = initStorage()
+	guard = newSourceGuard()
+	occupancy = nil
+	var err error
+
+	if registry, err = loadDeviceRegistry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sensors, err = loadSensorCatalog(); err != nil {
+		t.Fatal(err)
+	}
+
+	if configs, err = loadClientConfigStore(); err != nil {
+		t.Fatal(err)
+	}
+
+	if activity, err = loadLiveActivity(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// postForm posts form to handler at target the way devices do and returns
+// the recorded reply
+func postForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// postDashboardForm posts form to handler at target as an admin, the way
+// dashboardAPI passes requests on once their session was checked
+func postDashboardForm(handler http.HandlerFunc, target string, form url.Values) *httptest.ResponseRecorder {
+	return postForm(func(w http.ResponseWriter, r *http.Request) {
+		sess := &session{user: "admin", role: roleAdmin}
+		handler(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess)))
+	}, target, form)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionCookieName is the cookie holding the session token of a
+	// dashboard user
+	sessionCookieName = "session"
+
+	// csrfHeader and csrfField are where dashboard requests that change
+	// anything send the csrf token of their session, the header for ajax
+	// requests and the form field for plain form posts
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrfToken"
+)
+
+// sessionContextKey is the request context key of the session of a
+// logged in request
+type sessionContextKey struct{}
+
+// session is a logged in dashboard user along with their role
+// Sessions are only kept in memory, restarting the server logs everyone
+// out
+type session struct {
+	token     string
+	csrfToken string
+	user      string
+	role      string
+	expires   time.Time
+}
+
+// sessionStore holds every session that hasn't expired
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]*session
+}
+
+// newSessionStore returns an empty sessionStore
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+// sessionTimeout is how long a session lasts without being used
+func sessionTimeout() time.Duration {
+	return time.Duration(setting.SessionTimeout) * time.Minute
+}
+
+// randomToken returns a hex encoded random token that can't be guessed
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Create starts a new session for user with role
+func (s *sessionStore) Create(now time.Time, user string, role string) (*session, error) {
+	token, err := randomToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	csrfToken, err := randomToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Expired sessions are dropped here rather than on a timer
+	for key, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, key)
+		}
+	}
+
+	sess := &session{
+		token:     token,
+		csrfToken: csrfToken,
+		user:      user,
+		role:      role,
+		expires:   now.Add(sessionTimeout()),
+	}
+	s.sessions[token] = sess
+	return sess, nil
+}
+
+// Get returns the session of token if it hasn't expired, extending it
+func (s *sessionStore) Get(token string, now time.Time) (*session, bool) {
+	s.Lock()
+	defer s.Unlock()
+	sess, ok := s.sessions[token]
+
+	if !ok {
+		return nil, false
+	}
+
+	if now.After(sess.expires) {
+		delete(s.sessions, token)
+		return nil, false
+	}
+
+	sess.expires = now.Add(sessionTimeout())
+	copied := *sess
+	return &copied, true
+}
+
+// Delete ends the session of token
+func (s *sessionStore) Delete(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, token)
+}
+
+// DeleteUser ends every session of user, so changes to their account
+// apply right away
+func (s *sessionStore) DeleteUser(user string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for key, sess := range s.sessions {
+		if sess.user == user {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// checkDashboardLogin exits unless someone can log in to the dashboard,
+// either a user or dashboard_password to add the first admin with
+// The device password is never used for this as every device knows it
+func checkDashboardLogin() {
+	userCount, err := countUsers()
+	checkError(err, "Couldn't count dashboard users", true)
+
+	if userCount == 0 && setting.DashboardPassword == "" {
+		checkError(
+			errors.New("no dashboard users and no dashboard_password"),
+			"Add the first admin with \"server user add <name> -role admin\" or set dashboard_password",
+			true,
+		)
+	}
+}
+
+// requestSession returns the session of r if it has a valid session cookie
+func requestSession(r *http.Request) (*session, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+
+	if err != nil {
+		return nil, false
+	}
+
+	return sessions.Get(cookie.Value, time.Now().UTC())
+}
+
+// currentSession returns the session a dashboard handler was called with
+func currentSession(r *http.Request) *session {
+	sess, _ := r.Context().Value(sessionContextKey{}).(*session)
+	return sess
+}
+
+// setSessionCookie sends the cookie of sess, or clears it if sess is nil
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sess *session) {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   setting.HTTPS || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	if sess == nil {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Value = sess.token
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+// requireLogin wraps a dashboard handler so it only runs for logged in
+// users whose role allows role, redirecting pages to the login page and
+// answering apis with 401 when not logged in and with 403 when the role
+// isn't enough
+// Requests other than GET and HEAD must also carry the csrf token of the
+// session
+func requireLogin(next http.HandlerFunc, role string, isPage bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := requestSession(r)
+
+		if !ok {
+			if isPage {
+				http.Redirect(w, r, "/login/?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Not logged in"))
+			return
+		}
+
+		if !roleAllows(sess.role, role) {
+			logger.WithField("user", sess.user).WithField("path", r.URL.Path).Warn("Role not allowed")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Your account needs the " + role + " role to do this"))
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			r.ParseForm()
+			token := r.Header.Get(csrfHeader)
+
+			if token == "" {
+				token = r.Form.Get(csrfField)
+			}
+
+			if subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrfToken)) != 1 {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Invalid csrf token, reload the page"))
+				return
+			}
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess)))
+	}
+}
+
+// dashboardPage wraps the handler of a dashboard page with requireLogin
+func dashboardPage(role string, next http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(next, role, true)
+}
+
+// dashboardAPI wraps the handler of a dashboard api with requireLogin
+func dashboardAPI(role string, next http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(next, role, false)
+}
+
+// dashboardContext returns the template data every dashboard page needs,
+// the csrf token and who is logged in, so pages can hide what the role of
+// the user doesn't allow
+func dashboardContext(r *http.Request) map[string]interface{} {
+	sess := currentSession(r)
+	return map[string]interface{}{
+		"csrfToken":  sess.csrfToken,
+		"user":       sess.user,
+		"role":       sess.role,
+		"canOperate": roleAllows(sess.role, roleOperator),
+		"isAdmin":    roleAllows(sess.role, roleAdmin),
+	}
+}
+
+// handleDashboardPostRequests makes sure that a dashboard request is of
+// method "POST", the session and csrf token are checked by requireLogin
+func handleDashboardPostRequests(w http.ResponseWriter, r *http.Request) error {
+	r.ParseForm()
+
+	if r.Method != "POST" {
+		message := "Request method is not post"
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(message))
+		return errors.New(message)
+	}
+
+	return nil
+}
+
+// safeRedirect returns next if it is a path on this server and / otherwise,
+// so the login page can't be used to send users elsewhere
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
+
+// loginHandler shows the login page and logs users in with their name
+// and password
+// Until the first user is added, logging in with dashboard_password adds
+// an admin with the name given and that password, so there is an account
+// to manage the rest from
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	next := safeRedirect(r.Form.Get("next"))
+	userCount, err := countUsers()
+
+	if err != nil {
+		logger.WithError(err).Error("Couldn't count users")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't log in"))
+		return
+	}
+
+	page := map[string]interface{}{
+		"next":    next,
+		"noUsers": userCount == 0,
+	}
+
+	if r.Method != "POST" {
+		if _, ok := requestSession(r); ok {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		tpl.ExecuteTemplate(w, "login.html", page)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	password := r.Form.Get("password")
+	role := ""
+
+	if userCount == 0 {
+		if setting.DashboardPassword != "" && subtle.ConstantTimeCompare([]byte(password), []byte(setting.DashboardPassword)) == 1 {
+			role = roleAdmin
+		}
+	} else if user, ok := authenticateUser(name, password); ok {
+		name, role = user.Name, user.Role
+	}
+
+	recordPasswordResult(r, role != "")
+
+	if role == "" {
+		logger.WithField("user", name).Warn("Failed login")
+		page["error"] = "Wrong user name or password"
+		w.WriteHeader(http.StatusForbidden)
+		tpl.ExecuteTemplate(w, "login.html", page)
+		return
+	}
+
+	if userCount == 0 {
+		if err = createUser(name, password, roleAdmin); err != nil {
+			page["error"] = err.Error()
+			w.WriteHeader(http.StatusNotAcceptable)
+			tpl.ExecuteTemplate(w, "login.html", page)
+			return
+		}
+
+		logger.WithField("user", name).Info("Added first admin with the dashboard password")
+	}
+
+	sess, err := sessions.Create(time.Now().UTC(), name, role)
+
+	if err != nil {
+		logger.WithError(err).Error("Couldn't create session")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't log in"))
+		return
+	}
+
+	logger.WithField("user", name).WithField("role", role).Info("Logged in")
+	setSessionCookie(w, r, sess)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the session of the request and goes back to the
+// login page
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	sessions.Delete(currentSession(r).token)
+	setSessionCookie(w, r, nil)
+	http.Redirect(w, r, "/login/", http.StatusSeeOther)
+}
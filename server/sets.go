@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPreviewRows and maxPreviewRows are the rows per page of a set
+	// preview when none or too many are asked for
+	defaultPreviewRows = 50
+	maxPreviewRows     = 1000
+
+	// maxLabelLength keeps labels short enough to show in the set browser
+	maxLabelLength = 64
+)
+
+// setSummary describes a finished set for the set browser
+// Start and End are when the set was started and finished, or its first
+// and last motion readings for sets from before that was saved, and Rows
+// counts the readings of each channel that has any
+type setSummary struct {
+	Number          int            `json:"number"`
+	Start           *time.Time     `json:"start"`
+	End             *time.Time     `json:"end"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Rows            map[string]int `json:"rows"`
+	Labels          []string       `json:"labels"`
+}
+
+// savedSetSummary is a row of set_summary
+// Start and End are saved by BeginNewSet and Rows, the json of the
+// readings per channel, the first time the set is listed, as a finished
+// set doesn't change
+type savedSetSummary struct {
+	SetNum int        `db:"set_num"`
+	Start  *time.Time `db:"start_time"`
+	End    *time.Time `db:"end_time"`
+	Rows   *string    `db:"rows"`
+}
+
+// setLabels returns the labels of every set of deviceName by set number
+func setLabels(deviceName string) (map[int][]string, error) {
+	rows := make([]struct {
+		SetNum int    `db:"set_num"`
+		Label  string `db:"label"`
+	}, 0)
+	err := db.Select(&rows, "SELECT set_num, label FROM set_label WHERE device_name=? ORDER BY label;", deviceName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[int][]string)
+
+	for _, row := range rows {
+		labels[row.SetNum] = append(labels[row.SetNum], row.Label)
+	}
+
+	return labels, nil
+}
+
+// savedSetStart returns when finished set of deviceName started as saved
+// by BeginNewSet, or nil if that isn't known
+func savedSetStart(deviceName string, set int) (*time.Time, error) {
+	var start *time.Time
+	err := db.Get(&start, "SELECT start_time FROM set_summary WHERE device_name=? AND set_num=?;", deviceName, set)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return start, err
+}
+
+// completeSetSummary counts the readings of each channel of finished set
+// of deviceName and saves them along with saved
+// Times missing from saved, for sets from before they were kept, are
+// taken from the first and last motion readings
+func completeSetSummary(deviceName string, set int, saved savedSetSummary) (savedSetSummary, error) {
+	rows := make(map[string]int)
+
+	for _, s := range sensors.Channels(deviceName) {
+		readings, err := store.ReadRange(deviceName, s.Channel, set, time.Time{}, time.Time{})
+
+		if err != nil {
+			return saved, err
+		}
+
+		if len(readings) == 0 && s.Channel != motionChannel {
+			continue
+		}
+
+		rows[s.Channel] = len(readings)
+
+		if s.Channel != motionChannel {
+			continue
+		}
+
+		for i := range readings {
+			if saved.Start == nil || readings[i].Time.Before(*saved.Start) {
+				saved.Start = &readings[i].Time
+			}
+
+			if saved.End == nil || readings[i].Time.After(*saved.End) {
+				saved.End = &readings[i].Time
+			}
+		}
+	}
+
+	rowsJSON, err := json.Marshal(rows)
+
+	if err != nil {
+		return saved, err
+	}
+
+	saved.SetNum = set
+	saved.Rows = new(string)
+	*saved.Rows = string(rowsJSON)
+
+	// Times saved by BeginNewSet in the meantime are kept
+	err = execTXQuery(
+		"INSERT INTO set_summary (device_name, set_num, start_time, end_time, rows) VALUES (?,?,?,?,?) "+
+			"ON CONFLICT (device_name, set_num) DO UPDATE SET rows=excluded.rows, "+
+			"start_time=COALESCE(set_summary.start_time, excluded.start_time), "+
+			"end_time=COALESCE(set_summary.end_time, excluded.end_time);",
+		deviceName, set, saved.Start, saved.End, saved.Rows,
+	)
+
+	return saved, err
+}
+
+// setRows returns the number of readings of each channel of finished set
+// of deviceName, which are counted once and saved in set_summary
+func setRows(deviceName string, set int) (map[string]int, error) {
+	var saved savedSetSummary
+	err := db.Get(
+		&saved,
+		"SELECT set_num, start_time, end_time, rows FROM set_summary WHERE device_name=? AND set_num=?;",
+		deviceName,
+		set,
+	)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if saved.Rows == nil {
+		if saved, err = completeSetSummary(deviceName, set, saved); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := make(map[string]int)
+	return rows, json.Unmarshal([]byte(*saved.Rows), &rows)
+}
+
+// summarizeSets returns a summary of every finished set of deviceName
+// The sets are listed from the store and their summaries read from
+// set_summary, only sets that weren't listed before are read
+func summarizeSets(deviceName string) ([]setSummary, error) {
+	sets, err := store.ListSets(deviceName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := setLabels(deviceName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	savedSummaries := make([]savedSetSummary, 0)
+	err = db.Select(
+		&savedSummaries,
+		"SELECT set_num, start_time, end_time, rows FROM set_summary WHERE device_name=?;",
+		deviceName,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	saved := make(map[int]savedSetSummary, len(savedSummaries))
+
+	for _, savedSummary := range savedSummaries {
+		saved[savedSummary.SetNum] = savedSummary
+	}
+
+	summaries := make([]setSummary, 0, len(sets))
+
+	for _, set := range sets {
+		savedSummary, ok := saved[set.Number]
+
+		if !ok || savedSummary.Rows == nil {
+			if savedSummary, err = completeSetSummary(deviceName, set.Number, savedSummary); err != nil {
+				return nil, err
+			}
+		}
+
+		summary := setSummary{
+			Number: set.Number,
+			Rows:   make(map[string]int),
+			Labels: labels[set.Number],
+		}
+
+		if summary.Labels == nil {
+			summary.Labels = []string{}
+		}
+
+		if err = json.Unmarshal([]byte(*savedSummary.Rows), &summary.Rows); err != nil {
+			return nil, err
+		}
+
+		if savedSummary.Start != nil {
+			start := savedSummary.Start.In(setting.DisplayLocation)
+			summary.Start = &start
+		}
+
+		if savedSummary.End != nil {
+			end := savedSummary.End.In(setting.DisplayLocation)
+			summary.End = &end
+		}
+
+		if summary.Start != nil && summary.End != nil {
+			summary.DurationSeconds = summary.End.Sub(*summary.Start).Seconds()
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+// setExists determines if deviceName has finished set in the store
+// The store is asked rather than going by the set number of the device,
+// as sets are kept when the database is wiped
+func setExists(deviceName string, set int) (bool, error) {
+	sets, err := store.ListSets(deviceName)
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range sets {
+		if s.Number == set {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parseSetRequest reads the device, finished set and channel of a set
+// browser request, writing the error to w if they aren't valid
+func parseSetRequest(w http.ResponseWriter, r *http.Request) (deviceName string, set int, channel string, ok bool) {
+	deviceName = r.Form.Get("deviceName")
+	channel = r.Form.Get("channel")
+	_, exists := registry.Get(deviceName)
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Device name does not exist"))
+		return "", 0, "", false
+	}
+
+	set, err := strconv.Atoi(r.Form.Get("set"))
+
+	if err != nil || set < 1 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Set does not exist"))
+		return "", 0, "", false
+	}
+
+	if exists, err = setExists(deviceName, set); err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't list sets")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't read sets"))
+		return "", 0, "", false
+	}
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Set does not exist"))
+		return "", 0, "", false
+	}
+
+	if channel == "" {
+		channel = motionChannel
+	}
+
+	if _, exists = sensors.Get(deviceName, channel); !exists {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Channel does not exist"))
+		return "", 0, "", false
+	}
+
+	return deviceName, set, channel, true
+}
+
+// setListHandler is an api endpoint that returns a summary of every
+// finished set of a device
+func setListHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	deviceName := r.Form.Get("deviceName")
+
+	if _, ok := registry.Get(deviceName); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Device name does not exist"))
+		return
+	}
+
+	summaries, err := summarizeSets(deviceName)
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't summarize sets")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't read sets"))
+		return
+	}
+
+	sendPayload(w, summaries)
+}
+
+// setPreviewHandler is an api endpoint that returns one page of the rows
+// of a set, with page counting from 1 and pageSize rows per page
+// Only the rows of the page are read, the total is the count saved in
+// set_summary
+func setPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	deviceName, set, channel, ok := parseSetRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	page, pageSize := 1, defaultPreviewRows
+
+	if value := r.Form.Get("page"); value != "" {
+		number, err := parsePositiveInt(value)
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("page " + err.Error()))
+			return
+		}
+
+		page = number
+	}
+
+	if value := r.Form.Get("pageSize"); value != "" {
+		number, err := parsePositiveInt(value)
+
+		if err != nil || number > maxPreviewRows {
+			w.WriteHeader(http.StatusNotAcceptable)
+			w.Write([]byte("pageSize must be a whole number from 1 to " + strconv.Itoa(maxPreviewRows)))
+			return
+		}
+
+		pageSize = number
+	}
+
+	counts, err := setRows(deviceName, set)
+	var rows []reading
+
+	if err == nil {
+		rows, err = store.ReadPage(deviceName, channel, set, (page-1)*pageSize, pageSize)
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't read set for preview")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't read set"))
+		return
+	}
+
+	for i := range rows {
+		rows[i].Time = rows[i].Time.In(setting.DisplayLocation)
+	}
+
+	sendPayload(w, map[string]interface{}{
+		"deviceName": deviceName,
+		"set":        set,
+		"channel":    channel,
+		"page":       page,
+		"pageSize":   pageSize,
+		"total":      counts[channel],
+		"rows":       rows,
+	})
+}
+
+// setDownloadHandler is an api endpoint that sends a single set as a csv
+// file, named the way it is in the device tar
+func setDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	deviceName, set, channel, ok := parseSetRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	fileName := deviceName + "-" + strconv.Itoa(set) + ".csv"
+
+	if channel != motionChannel {
+		fileName = deviceName + "-" + strconv.Itoa(set) + "." + channel + ".csv"
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+
+	if err := store.WriteSetCSV(deviceName, channel, set, w); err != nil {
+		unableToRetrieveFiles(w, err)
+	}
+}
+
+// setLabelHandler is an api endpoint that adds label to a finished set of
+// a device, or removes it if remove is true
+func setLabelHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	deviceName, set, _, ok := parseSetRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	label := strings.TrimSpace(r.Form.Get("label"))
+
+	if label == "" || len(label) > maxLabelLength {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Label must be 1 to " + strconv.Itoa(maxLabelLength) + " characters"))
+		return
+	}
+
+	var err error
+
+	if r.Form.Get("remove") == "true" {
+		err = execTXQuery("DELETE FROM set_label WHERE device_name=? AND set_num=? AND label=?;", deviceName, set, label)
+	} else {
+		err = execTXQuery(
+			"INSERT OR IGNORE INTO set_label (device_name, set_num, label, created_at) VALUES (?,?,?,?);",
+			deviceName, set, label, time.Now().UTC(),
+		)
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't change set label")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't change set label"))
+		return
+	}
+
+	labels, err := setLabels(deviceName)
+
+	if err != nil {
+		logger.WithError(err).WithField("device", deviceName).Error("Couldn't read set labels")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't read set labels"))
+		return
+	}
+
+	if labels[set] == nil {
+		labels[set] = []string{}
+	}
+
+	sendPayload(w, labels[set])
+}
+
+// setsView renders the set browser
+func setsView(w http.ResponseWriter, r *http.Request) {
+	context := dashboardContext(r)
+	context["devices"] = registry.Snapshot()
+	tpl.ExecuteTemplate(w, "sets.html", context)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestSets sets up a test server with a device that has one finished
+// set holding two readings
+// The set was started when the device checked in at start and finished
+// three hours later
+func newTestSets(t *testing.T, start time.Time) {
+	t.Helper()
+	newTestServer(t)
+	addTestSet(t, start)
+}
+
+// addTestSet gives kitchen a finished set holding two readings in store,
+// started when it checked in at start and finished three hours later
+func addTestSet(t *testing.T, start time.Time) {
+	t.Helper()
+
+	if err := registry.CheckIn("kitchen", start); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hours := range []int{1, 2} {
+		r := reading{Channel: motionChannel, Time: start.Add(time.Duration(hours) * time.Hour)}
+
+		if err := store.AppendReading("kitchen", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := registry.SetRecording("kitchen", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := registry.BeginNewSet("kitchen", start.Add(3*time.Hour), store.RotateSet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSummarizeSetsUsesSavedTimes(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	newTestSets(t, start)
+	summaries, err := summarizeSets("kitchen")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(summaries) != 1 {
+		t.Fatalf("%d sets summarized, want 1", len(summaries))
+	}
+
+	summary := summaries[0]
+
+	if summary.Start == nil || !summary.Start.Equal(start) || summary.End == nil || !summary.End.Equal(start.Add(3*time.Hour)) {
+		t.Fatalf("set ran from %v to %v, want %v for 3h", summary.Start, summary.End, start)
+	}
+
+	if summary.DurationSeconds != (3*time.Hour).Seconds() || summary.Rows[motionChannel] != 2 {
+		t.Fatalf("wrong summary %+v", summary)
+	}
+
+	var rows *string
+
+	if err = db.Get(&rows, "SELECT rows FROM set_summary WHERE device_name='kitchen' AND set_num=1;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows == nil || *rows != `{"motion":2}` {
+		t.Fatalf("rows of the set were not saved, got %v", rows)
+	}
+}
+
+func TestSummarizeSetsFromBeforeTimesWereSaved(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	newTestSets(t, start)
+
+	if _, err := db.Exec("DELETE FROM set_summary;"); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := summarizeSets("kitchen")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := summaries[0]
+
+	if !summary.Start.Equal(start.Add(time.Hour)) || !summary.End.Equal(start.Add(2*time.Hour)) {
+		t.Fatalf("set ran from %v to %v, want its first and last readings", summary.Start, summary.End)
+	}
+}
+
+// TestSetExistsAfterDatabaseWipe checks sets are still found once the
+// device is added again with set number 0, as happens after -wipe db
+func TestSetExistsAfterDatabaseWipe(t *testing.T) {
+	newTestSets(t, time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+
+	if _, err := db.Exec("DELETE FROM device;"); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+
+	if registry, err = loadDeviceRegistry(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registry.CheckIn("kitchen", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := setExists("kitchen", 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		t.Fatal("set 1 not found after the device was added again")
+	}
+
+	if exists, _ = setExists("kitchen", 2); exists {
+		t.Fatal("set 2 found but was never started")
+	}
+
+	_, readings, err := readActivity("kitchen", motionChannel, 1, time.Time{}, time.Time{})
+
+	if err != nil {
+		t.Fatalf("analytics can't read set 1 after the device was added again: %v", err)
+	}
+
+	if len(readings) != 2 {
+		t.Fatalf("%d readings in set 1, want 2", len(readings))
+	}
+
+	if _, _, err = readActivity("kitchen", motionChannel, 2, time.Time{}, time.Time{}); err != errSetNotFound {
+		t.Fatalf("reading set 2 returned %v, want %v", err, errSetNotFound)
+	}
+}
+
+func TestSetPreviewPages(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	for _, storage := range []string{"csv", "sqlite"} {
+		newTestServer(t)
+		setting.Storage = storage
+		store = initStorage()
+		addTestSet(t, start)
+		pages := []struct {
+			page string
+			time time.Time
+		}{
+			{"1", start.Add(time.Hour)},
+			{"2", start.Add(2 * time.Hour)},
+			{"3", time.Time{}},
+		}
+
+		for _, page := range pages {
+			form := url.Values{"deviceName": {"kitchen"}, "set": {"1"}, "page": {page.page}, "pageSize": {"1"}}
+			w := postDashboardForm(setPreviewHandler, "/set-preview/", form)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s preview answered %d: %s", storage, w.Code, w.Body.String())
+			}
+
+			var reply struct {
+				Total int       `json:"total"`
+				Rows  []reading `json:"rows"`
+			}
+
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatal(err)
+			}
+
+			if reply.Total != 2 {
+				t.Errorf("%s preview total is %d, want 2", storage, reply.Total)
+			}
+
+			if page.time.IsZero() {
+				if len(reply.Rows) != 0 {
+					t.Errorf("%s page %s has rows %+v past the end", storage, page.page, reply.Rows)
+				}
+				continue
+			}
+
+			if len(reply.Rows) != 1 || !reply.Rows[0].Time.Equal(page.time) {
+				t.Errorf("%s page %s has rows %+v, want the reading at %v", storage, page.page, reply.Rows, page.time)
+			}
+		}
+	}
+}
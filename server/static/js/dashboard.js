@@ -0,0 +1,21 @@
+// Sends the csrf token of the session with every ajax request and goes back
+// to the login page once the session has expired
+$(function(){
+    var csrfToken = $("meta[name=csrf-token]").attr("content");
+
+    $.ajaxSetup({
+        headers: {"X-CSRF-Token": csrfToken}
+    });
+
+    $("form[method=POST], form[method=post]").each(function(){
+        if ($(this).find("input[name=csrfToken]").length == 0){
+            $("<input type='hidden' name='csrfToken'>").val(csrfToken).appendTo(this);
+        }
+    });
+
+    $(document).ajaxError(function(event, xhr){
+        if (xhr.status == 401){
+            window.location = "/login/?next=" + encodeURIComponent(window.location.pathname);
+        }
+    });
+});
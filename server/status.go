@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deviceActivity is the recent motion of a device
+type deviceActivity struct {
+	lastMotion   time.Time
+	firstReading time.Time
+	recent       []time.Time
+}
+
+// prune drops the motion seen more than an hour before now
+func (dev *deviceActivity) prune(now time.Time) {
+	since := now.Add(-time.Hour)
+	recent := dev.recent[:0]
+
+	for _, t := range dev.recent {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+
+	dev.recent = recent
+}
+
+// liveActivity keeps the recent motion of every device in memory so the
+// dashboard can poll it every few seconds without reading the store
+type liveActivity struct {
+	sync.Mutex
+	devices map[string]*deviceActivity
+}
+
+// loadLiveActivity reads the current motion readings of every device so
+// the status table is filled in from the start
+func loadLiveActivity() (*liveActivity, error) {
+	activity := &liveActivity{devices: make(map[string]*deviceActivity)}
+	since := time.Now().UTC().Add(-time.Hour)
+
+	for _, deviceName := range registry.Names() {
+		readings, err := store.ReadRange(deviceName, motionChannel, currentSet, time.Time{}, time.Time{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Slice(readings, func(i, j int) bool {
+			return readings[i].Time.Before(readings[j].Time)
+		})
+
+		for _, reading := range readings {
+			if reading.Time.After(since) {
+				activity.record(deviceName, reading.Time)
+			}
+		}
+
+		if len(readings) > 0 {
+			dev := activity.device(deviceName)
+			dev.firstReading = readings[0].Time
+			dev.lastMotion = readings[len(readings)-1].Time
+		}
+	}
+
+	return activity, nil
+}
+
+func (a *liveActivity) device(deviceName string) *deviceActivity {
+	dev, ok := a.devices[deviceName]
+
+	if !ok {
+		dev = &deviceActivity{recent: make([]time.Time, 0)}
+		a.devices[deviceName] = dev
+	}
+
+	return dev
+}
+
+func (a *liveActivity) record(deviceName string, t time.Time) {
+	dev := a.device(deviceName)
+
+	if dev.firstReading.IsZero() {
+		dev.firstReading = t
+	}
+
+	if t.After(dev.lastMotion) {
+		dev.lastMotion = t
+	}
+
+	dev.recent = append(dev.recent, t)
+	dev.prune(t)
+}
+
+// Record adds motion seen by deviceName at t
+func (a *liveActivity) Record(deviceName string, t time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	a.record(deviceName, t)
+}
+
+// Get returns the last motion of deviceName, how many times motion was
+// seen in the hour before now and the time of its first current reading
+func (a *liveActivity) Get(deviceName string, now time.Time) (lastMotion time.Time, lastHour int, firstReading time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	dev, ok := a.devices[deviceName]
+
+	if !ok {
+		return time.Time{}, 0, time.Time{}
+	}
+
+	dev.prune(now)
+	return dev.lastMotion, len(dev.recent), dev.firstReading
+}
+
+// deviceStatusRow is one row of the live status table
+// CurrentSetSeconds is how long the current set has been going since it
+// was started and is nil if unknown
+// Devices that haven't started a set since set starts were saved go by
+// their first current reading instead
+type deviceStatusRow struct {
+	DeviceName        string     `json:"deviceName"`
+	Online            bool       `json:"online"`
+	Recording         bool       `json:"recording"`
+	NewSetPending     bool       `json:"newSetPending"`
+	SetNum            int        `json:"setNum"`
+	LastSeen          time.Time  `json:"lastSeen"`
+	LastSeenSeconds   float64    `json:"lastSeenSeconds"`
+	LastMotion        *time.Time `json:"lastMotion"`
+	EventsLastHour    int        `json:"eventsLastHour"`
+	CurrentSetSeconds *float64   `json:"currentSetSeconds"`
+	ClockSkewSeconds  int        `json:"clockSkewSeconds"`
+	ClockSkewed       bool       `json:"clockSkewed"`
+	ConfigVersion     int        `json:"configVersion"`
+	AppliedConfig     int        `json:"appliedConfig"`
+	ConfigDrifted     bool       `json:"configDrifted"`
+}
+
+// statusSnapshot returns the status of every device at now
+func statusSnapshot(now time.Time) []deviceStatusRow {
+	devices := registry.Snapshot()
+	rows := make([]deviceStatusRow, 0, len(devices))
+
+	for _, dev := range devices {
+		lastMotion, lastHour, firstReading := activity.Get(dev.Name, now)
+		config := configs.Resolve(dev)
+		row := deviceStatusRow{
+			DeviceName:       dev.Name,
+			Online:           dev.IsCheckedIn,
+			Recording:        dev.IsRecording,
+			NewSetPending:    dev.IsNewSet,
+			SetNum:           dev.SetNum,
+			LastSeen:         dev.LatestCheckInTime.In(setting.DisplayLocation),
+			LastSeenSeconds:  now.Sub(dev.LatestCheckInTime).Seconds(),
+			EventsLastHour:   lastHour,
+			ClockSkewSeconds: dev.ClockSkewSeconds(),
+			ClockSkewed:      dev.IsClockSkewed(),
+			ConfigVersion:    config.Version,
+			AppliedConfig:    dev.AppliedConfigVersion,
+			ConfigDrifted:    isConfigDrifted(dev, config),
+		}
+
+		if !lastMotion.IsZero() {
+			lastMotion = lastMotion.In(setting.DisplayLocation)
+			row.LastMotion = &lastMotion
+		}
+
+		setStart := firstReading
+
+		if dev.SetStartedAt != nil {
+			setStart = *dev.SetStartedAt
+		}
+
+		if !setStart.IsZero() {
+			seconds := now.Sub(setStart).Seconds()
+			row.CurrentSetSeconds = &seconds
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// statusSnapshotHandler is an api endpoint the dashboard polls for the
+// live status of every device
+func statusSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	sendPayload(w, map[string]interface{}{
+		"time":    now.In(setting.DisplayLocation),
+		"devices": statusSnapshot(now),
+	})
+}
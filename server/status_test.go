@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStatusSetDurationFromSetStart checks the current set is timed from
+// when it started, not from its first reading
+func TestStatusSetDurationFromSetStart(t *testing.T) {
+	newTestServer(t)
+	checkedIn := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+
+	if err := registry.CheckIn("kitchen", checkedIn); err != nil {
+		t.Fatal(err)
+	}
+
+	activity.Record("kitchen", checkedIn.Add(time.Hour))
+	rows := statusSnapshot(checkedIn.Add(2 * time.Hour))
+
+	if len(rows) != 1 || rows[0].CurrentSetSeconds == nil {
+		t.Fatalf("no set duration in %+v", rows)
+	}
+
+	if *rows[0].CurrentSetSeconds != (2 * time.Hour).Seconds() {
+		t.Fatalf("set has been going %vs, want %vs", *rows[0].CurrentSetSeconds, (2 * time.Hour).Seconds())
+	}
+}
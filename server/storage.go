@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// csvDateFormat and csvTimeFormat are the formats of the date and
+	// time columns of every csv file, matching what devices send
+	csvDateFormat = "2006-01-02"
+	csvTimeFormat = "15:04:05"
+
+	// currentSet is the set number used to refer to readings that have
+	// not been moved into a set yet
+	currentSet = 0
+)
+
+// reading is a single time stamp sent by a device on one of its channels
+// Value is only set for numeric channels, for binary channels a reading
+// means the channel was active
+// ReceivedAt is when the server received it, only kept with the both
+// clock_skew_mode
+type reading struct {
+	Channel    string     `json:"channel" db:"channel"`
+	Time       time.Time  `json:"time" db:"time"`
+	Value      *float64   `json:"value,omitempty" db:"value"`
+	ReceivedAt *time.Time `json:"receivedAt,omitempty" db:"received_at"`
+}
+
+// setInfo describes a finished set of a device
+type setInfo struct {
+	Number int `json:"number" db:"number"`
+}
+
+// readingStore is where readings sent by devices are kept
+// Readings are appended to the current set of a device until a new
+// set is started, at which point they are moved into a numbered set
+type readingStore interface {
+	// AppendReading adds r to the current set of its channel of deviceName
+	AppendReading(deviceName string, r reading) error
+
+	// RotateSet moves the current readings of deviceName into a new set
+	// and returns the number of the new set
+	RotateSet(deviceName string) (int, error)
+
+	// ListSets returns every finished set of deviceName, oldest first
+	ListSets(deviceName string) ([]setInfo, error)
+
+	// ReadRange returns the readings of channel in set (currentSet for the
+	// current readings) of deviceName that are at or after start and
+	// before end
+	// A zero start or end leaves that side of the range open
+	ReadRange(deviceName string, channel string, set int, start time.Time, end time.Time) ([]reading, error)
+
+	// ReadPage returns up to limit readings of channel in finished set of
+	// deviceName starting with the reading at offset, without reading
+	// the ones after the page
+	ReadPage(deviceName string, channel string, set int, offset int, limit int) ([]reading, error)
+
+	// ReplaceCurrent replaces the current motion readings of deviceName
+	// with the csv contents of r, used when a device resends its local file
+	// Times without an offset are taken to be in loc
+	ReplaceCurrent(deviceName string, r io.Reader, loc *time.Location) error
+
+	// WriteSetCSV writes channel of set of deviceName to w in csv format
+	// with times in the display timezone
+	WriteSetCSV(deviceName string, channel string, set int, w io.Writer) error
+
+	// Flush makes sure every reading appended so far is on disk
+	Flush() error
+
+	// ClearCurrent removes the current readings of every device, leaving
+	// sets untouched, used by -wipe before anything is appended
+	ClearCurrent() error
+}
+
+// initStorage returns the readingStore selected by the storage setting
+func initStorage() readingStore {
+	if setting.Storage == "sqlite" {
+		return &sqliteStore{}
+	}
+
+	return &csvStore{}
+}
+
+// formatCSVReading returns r as a line of a csv file with its times in
+// loc, sub-second precision is only written when the time has it
+func formatCSVReading(r reading, loc *time.Location) string {
+	t := r.Time.In(loc)
+	line := t.Format(csvDateFormat) + "," + t.Format(csvTimeFormat+".999999999")
+
+	if r.Value != nil {
+		line += "," + strconv.FormatFloat(*r.Value, 'f', -1, 64)
+	}
+
+	if r.ReceivedAt != nil {
+		line += "," + r.ReceivedAt.In(loc).Format(time.RFC3339Nano)
+	}
+
+	return line + " \n"
+}
+
+// parseCSVReading parses a single line of a csv file
+// The time is either an RFC 3339 time in the first column or the date and
+// time in the first two columns, taken to be in loc
+// Following columns are the value of numeric channels and the time the
+// server received the reading
+func parseCSVReading(line string, loc *time.Location) (reading, error) {
+	columns := strings.Split(strings.TrimSpace(line), ",")
+
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+
+	dateTime, err := time.Parse(time.RFC3339Nano, columns[0])
+	rest := columns[1:]
+
+	if err != nil {
+		if len(columns) < 2 {
+			return reading{}, errors.New("Improper csv line: " + line)
+		}
+
+		dateTime, err = time.ParseInLocation(csvDateFormat+" "+csvTimeFormat, columns[0]+" "+columns[1], loc)
+
+		if err != nil {
+			return reading{}, err
+		}
+
+		rest = columns[2:]
+	}
+
+	r := reading{Time: dateTime.UTC()}
+
+	if len(rest) > 0 {
+		if value, err := strconv.ParseFloat(rest[0], 64); err == nil && isFinite(value) {
+			r.Value = &value
+			rest = rest[1:]
+		}
+	}
+
+	if len(rest) > 0 && rest[0] != "" {
+		receivedAt, err := time.Parse(time.RFC3339Nano, rest[0])
+
+		if err != nil {
+			return reading{}, err
+		}
+
+		receivedAt = receivedAt.UTC()
+		r.ReceivedAt = &receivedAt
+	}
+
+	return r, nil
+}
+
+// readCSVReadings parses every line of r, skipping blank lines
+func readCSVReadings(r io.Reader, loc *time.Location) ([]reading, error) {
+	readings := make([]reading, 0)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		reading, err := parseCSVReading(scanner.Text(), loc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		readings = append(readings, reading)
+	}
+
+	return readings, scanner.Err()
+}
+
+// inRange determines if t is within start and end, where a zero start or
+// end leaves that side of the range open
+func inRange(t time.Time, start time.Time, end time.Time) bool {
+	return (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end))
+}
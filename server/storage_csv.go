@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csvStore keeps the current readings of each device in
+// <csv_directory>/<device>.csv and each finished set in
+// <sets_directory>/<device>/<set number>.csv
+// Channels other than motion are kept in
+// <csv_directory>/channels/<device>/<channel>.csv and
+// <sets_directory>/<device>/<set number>.<channel>.csv
+// Each device has its own lock so a new set being copied for one device
+// doesn't hold up readings from the others
+type csvStore struct {
+	devicesMu sync.Mutex
+	devices   map[string]*csvDevice
+}
+
+// csvDevice is the lock and the open current csv files of a device
+// Reading sets only needs the lock for reading, anything touching the
+// open files needs it for writing
+type csvDevice struct {
+	sync.RWMutex
+	appenders map[string]*csvAppender
+}
+
+// csvAppender is an open current csv file of a channel
+// Readings are buffered in writer until flushed, either by Flush or
+// before the current file is read or replaced
+type csvAppender struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// device returns the csvDevice of deviceName, creating it if needed
+func (c *csvStore) device(deviceName string) *csvDevice {
+	c.devicesMu.Lock()
+	defer c.devicesMu.Unlock()
+
+	if c.devices == nil {
+		c.devices = make(map[string]*csvDevice)
+	}
+
+	dev, ok := c.devices[deviceName]
+
+	if !ok {
+		dev = &csvDevice{appenders: make(map[string]*csvAppender)}
+		c.devices[deviceName] = dev
+	}
+
+	return dev
+}
+
+// lockDevice locks and returns the csvDevice of deviceName
+// mu is held for reading as well so backup and restore, which take it
+// for writing, wait for every device
+func (c *csvStore) lockDevice(deviceName string) *csvDevice {
+	mu.RLock()
+	dev := c.device(deviceName)
+	dev.Lock()
+	return dev
+}
+
+// unlockDevice unlocks a csvDevice locked with lockDevice
+func (c *csvStore) unlockDevice(dev *csvDevice) {
+	dev.Unlock()
+	mu.RUnlock()
+}
+
+// readLockDevice locks and returns the csvDevice of deviceName for
+// reading, so reads of the same device don't wait for each other
+func (c *csvStore) readLockDevice(deviceName string) *csvDevice {
+	mu.RLock()
+	dev := c.device(deviceName)
+	dev.RLock()
+	return dev
+}
+
+// readUnlockDevice unlocks a csvDevice locked with readLockDevice
+func (c *csvStore) readUnlockDevice(dev *csvDevice) {
+	dev.RUnlock()
+	mu.RUnlock()
+}
+
+// flushCurrent writes the buffered readings of deviceName to its current
+// files before they are read
+// It locks the device on its own so the read that follows only needs a
+// read lock, finished sets have nothing buffered and are skipped
+func (c *csvStore) flushCurrent(deviceName string, set int) error {
+	if set != currentSet {
+		return nil
+	}
+
+	dev := c.lockDevice(deviceName)
+	defer c.unlockDevice(dev)
+	return dev.flush(false)
+}
+
+// append writes line to the current file of channel at filePath, opening
+// it if it isn't open yet
+func (dev *csvDevice) append(channel string, filePath string, line string) error {
+	appender, ok := dev.appenders[channel]
+
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, fileMode)
+
+		if err != nil {
+			return err
+		}
+
+		appender = &csvAppender{file: file, writer: bufio.NewWriter(file)}
+		dev.appenders[channel] = appender
+	}
+
+	_, err := appender.writer.WriteString(line)
+	return err
+}
+
+// flush writes buffered readings to the current files and, if sync is
+// true, makes sure they reached the disk
+func (dev *csvDevice) flush(sync bool) error {
+	for _, appender := range dev.appenders {
+		if err := appender.writer.Flush(); err != nil {
+			return err
+		}
+
+		if sync {
+			if err := appender.file.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// close flushes and closes the current files so they can be moved or
+// replaced, they are opened again by the next append
+func (dev *csvDevice) close() error {
+	err := dev.flush(true)
+
+	for channel, appender := range dev.appenders {
+		if closeErr := appender.file.Close(); err == nil {
+			err = closeErr
+		}
+
+		delete(dev.appenders, channel)
+	}
+
+	return err
+}
+
+// ClearCurrent removes the current csv file of every device and channel
+func (c *csvStore) ClearCurrent() error {
+	return removeCurrentCSVFiles()
+}
+
+// Flush writes the buffered readings of every device to disk
+// It doesn't take mu so backups can flush while holding it
+func (c *csvStore) Flush() error {
+	c.devicesMu.Lock()
+	devices := make([]*csvDevice, 0, len(c.devices))
+
+	for _, dev := range c.devices {
+		devices = append(devices, dev)
+	}
+
+	c.devicesMu.Unlock()
+	var err error
+
+	for _, dev := range devices {
+		dev.Lock()
+
+		if flushErr := dev.flush(true); err == nil {
+			err = flushErr
+		}
+
+		dev.Unlock()
+	}
+
+	return err
+}
+
+func (c *csvStore) currentFilePath(deviceName string, channel string) string {
+	if channel == motionChannel {
+		return filepath.Join(setting.CsvDirectory, deviceName+".csv")
+	}
+
+	return filepath.Join(setting.CsvDirectory, "channels", deviceName, channel+".csv")
+}
+
+func (c *csvStore) setFilePath(deviceName string, channel string, set int) string {
+	if set == currentSet {
+		return c.currentFilePath(deviceName, channel)
+	}
+
+	if channel == motionChannel {
+		return filepath.Join(setting.SetsDirectory, deviceName, strconv.Itoa(set)+".csv")
+	}
+
+	return filepath.Join(setting.SetsDirectory, deviceName, strconv.Itoa(set)+"."+channel+".csv")
+}
+
+// currentChannels returns the channels of deviceName, other than motion,
+// with a current csv file
+func (c *csvStore) currentChannels(deviceName string) ([]string, error) {
+	channelFiles, err := filepath.Glob(filepath.Join(setting.CsvDirectory, "channels", deviceName, "*.csv"))
+	channels := make([]string, 0, len(channelFiles))
+
+	for _, channelFile := range channelFiles {
+		channels = append(channels, strings.TrimSuffix(filepath.Base(channelFile), ".csv"))
+	}
+
+	return channels, err
+}
+
+// AppendReading adds r to the end of the current csv file of its channel,
+// creating the file if it does not exist
+// The reading is buffered and reaches the file on the next flush
+func (c *csvStore) AppendReading(deviceName string, r reading) error {
+	dev := c.lockDevice(deviceName)
+	defer c.unlockDevice(dev)
+	return dev.append(r.Channel, c.currentFilePath(deviceName, r.Channel), formatCSVReading(r, time.UTC))
+}
+
+// copyToSet copies the current csv file of channel to set and empties it
+// A missing current file is created, so every set has a motion file
+func (c *csvStore) copyToSet(deviceName string, channel string, set int) error {
+	currentCSVFile, err := os.OpenFile(c.currentFilePath(deviceName, channel), os.O_RDONLY|os.O_CREATE, fileMode)
+
+	if err != nil {
+		return err
+	}
+
+	defer currentCSVFile.Close()
+	newFile, err := os.OpenFile(c.setFilePath(deviceName, channel, set), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+
+	if err != nil {
+		return err
+	}
+
+	defer newFile.Close()
+
+	if _, err = io.Copy(newFile, currentCSVFile); err != nil {
+		return err
+	}
+
+	// Simply truncating to empty current file
+	return os.Truncate(c.currentFilePath(deviceName, channel), 0)
+}
+
+// RotateSet copies the current csv files of deviceName to the next set
+// number in its sets directory and empties the current files
+func (c *csvStore) RotateSet(deviceName string) (int, error) {
+	dev := c.lockDevice(deviceName)
+	defer c.unlockDevice(dev)
+
+	if err := dev.close(); err != nil {
+		return 0, err
+	}
+
+	deviceSetDirectory := filepath.Join(setting.SetsDirectory, deviceName)
+
+	if err := os.MkdirAll(deviceSetDirectory, os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	sets, err := c.listSets(deviceName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Since file names are just numbers, we just simply increment
+	// from the last file name
+	setNum := 1
+
+	if len(sets) > 0 {
+		setNum = sets[len(sets)-1].Number + 1
+	}
+
+	channels, err := c.currentChannels(deviceName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, channel := range append([]string{motionChannel}, channels...) {
+		if err = c.copyToSet(deviceName, channel, setNum); err != nil {
+			return 0, err
+		}
+	}
+
+	return setNum, nil
+}
+
+// ListSets returns the sets found in the sets directory of deviceName
+func (c *csvStore) ListSets(deviceName string) ([]setInfo, error) {
+	dev := c.readLockDevice(deviceName)
+	defer c.readUnlockDevice(dev)
+	return c.listSets(deviceName)
+}
+
+// listSets is ListSets for callers already holding the device lock
+func (c *csvStore) listSets(deviceName string) ([]setInfo, error) {
+	sets := make([]setInfo, 0)
+	fileInfoArray, err := ioutil.ReadDir(filepath.Join(setting.SetsDirectory, deviceName))
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sets, nil
+		}
+		return nil, err
+	}
+
+	for _, fileInfo := range fileInfoArray {
+		setNum, err := strconv.Atoi(strings.TrimSuffix(fileInfo.Name(), ".csv"))
+
+		if err != nil || fileInfo.IsDir() {
+			continue
+		}
+
+		sets = append(sets, setInfo{Number: setNum})
+	}
+
+	// ReadDir sorts by name which puts 10.csv before 2.csv
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Number < sets[j].Number
+	})
+
+	return sets, nil
+}
+
+// ReadRange parses the csv file of set and returns the readings in range
+// Only the motion file of a finished set has to exist, other channels
+// may have been added after the set
+func (c *csvStore) ReadRange(deviceName string, channel string, set int, start time.Time, end time.Time) ([]reading, error) {
+	if err := c.flushCurrent(deviceName, set); err != nil {
+		return nil, err
+	}
+
+	dev := c.readLockDevice(deviceName)
+	defer c.readUnlockDevice(dev)
+
+	file, err := os.Open(c.setFilePath(deviceName, channel, set))
+
+	if err != nil {
+		if os.IsNotExist(err) && (set == currentSet || channel != motionChannel) {
+			return []reading{}, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+	readings, err := readCSVReadings(file, time.UTC)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inRangeReadings := make([]reading, 0, len(readings))
+
+	for _, r := range readings {
+		if inRange(r.Time, start, end) {
+			r.Channel = channel
+			inRangeReadings = append(inRangeReadings, r)
+		}
+	}
+
+	return inRangeReadings, nil
+}
+
+// ReadPage reads limit lines of the set file of channel after skipping
+// the first offset, which are counted but not parsed
+func (c *csvStore) ReadPage(deviceName string, channel string, set int, offset int, limit int) ([]reading, error) {
+	dev := c.readLockDevice(deviceName)
+	defer c.readUnlockDevice(dev)
+
+	file, err := os.Open(c.setFilePath(deviceName, channel, set))
+
+	if err != nil {
+		if os.IsNotExist(err) && channel != motionChannel {
+			return []reading{}, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+	readings := make([]reading, 0, limit)
+	scanner := bufio.NewScanner(file)
+	skipped := 0
+
+	for len(readings) < limit && scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		if skipped < offset {
+			skipped++
+			continue
+		}
+
+		r, err := parseCSVReading(scanner.Text(), time.UTC)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.Channel = channel
+		readings = append(readings, r)
+	}
+
+	return readings, scanner.Err()
+}
+
+// ReplaceCurrent overwrites the current motion csv file of deviceName with
+// the readings of r, written the same way AppendReading writes them
+func (c *csvStore) ReplaceCurrent(deviceName string, r io.Reader, loc *time.Location) error {
+	readings, err := readCSVReadings(r, loc)
+
+	if err != nil {
+		return err
+	}
+
+	dev := c.lockDevice(deviceName)
+	defer c.unlockDevice(dev)
+
+	if err = dev.close(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.currentFilePath(deviceName, motionChannel), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+
+	for _, reading := range readings {
+		if _, err = writer.WriteString(formatCSVReading(reading, time.UTC)); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// WriteSetCSV copies the csv file of set to w, reformatting it when the
+// display timezone isn't UTC
+func (c *csvStore) WriteSetCSV(deviceName string, channel string, set int, w io.Writer) error {
+	if err := c.flushCurrent(deviceName, set); err != nil {
+		return err
+	}
+
+	dev := c.readLockDevice(deviceName)
+	defer c.readUnlockDevice(dev)
+
+	file, err := os.Open(c.setFilePath(deviceName, channel, set))
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if setting.DisplayLocation == time.UTC {
+		_, err = io.Copy(w, file)
+		return err
+	}
+
+	readings, err := readCSVReadings(file, time.UTC)
+
+	if err != nil {
+		return err
+	}
+
+	for _, reading := range readings {
+		if _, err = io.WriteString(w, formatCSVReading(reading, setting.DisplayLocation)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// csvBenchmark is a csv store shared by the devices of a benchmark, with
+// global set to take one lock around every write the way every handler
+// used to hold mu, or nil to only rely on the store's per device locks
+type csvBenchmark struct {
+	reg       *deviceRegistry
+	c         *csvStore
+	global    *sync.Mutex
+	latencyMu sync.Mutex
+	latencies []time.Duration
+}
+
+// benchmarkCSVDeviceCount is how many devices send readings at once
+const benchmarkCSVDeviceCount = 64
+
+// newCSVBenchmark checks in every device and starts flushing readings and
+// check in times every 10ms as flushWrites does, and starting a new set
+// of device0 every 100ms, until the returned function is called
+func newCSVBenchmark(b *testing.B, global bool) (*csvBenchmark, func()) {
+	cb := &csvBenchmark{reg: newTestRegistry(b), c: &csvStore{}}
+	now := time.Now().UTC()
+
+	if global {
+		cb.global = &sync.Mutex{}
+	}
+
+	for i := 0; i < benchmarkCSVDeviceCount; i++ {
+		if err := cb.reg.CheckIn(fmt.Sprintf("device%d", i), now); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+
+	go func() {
+		defer close(stopped)
+		flushTicker := time.NewTicker(10 * time.Millisecond)
+		setTicker := time.NewTicker(100 * time.Millisecond)
+		defer flushTicker.Stop()
+		defer setTicker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-flushTicker.C:
+				cb.locked(func() {
+					if err := cb.c.Flush(); err != nil {
+						b.Error(err)
+					}
+
+					if err := cb.reg.FlushCheckIns(); err != nil {
+						b.Error(err)
+					}
+				})
+			case <-setTicker.C:
+				cb.locked(func() {
+					if _, err := cb.c.RotateSet("device0"); err != nil {
+						b.Error(err)
+					}
+				})
+			}
+		}
+	}()
+
+	return cb, func() {
+		b.StopTimer()
+		close(done)
+		<-stopped
+
+		if err := cb.c.Flush(); err != nil {
+			b.Fatal(err)
+		}
+
+		cb.reportLatency(b)
+	}
+}
+
+// locked runs fn holding the global lock, if there is one
+func (cb *csvBenchmark) locked(fn func()) {
+	if cb.global != nil {
+		cb.global.Lock()
+		defer cb.global.Unlock()
+	}
+
+	fn()
+}
+
+// post sends a reading from deviceName the way sensorHandler does, a
+// heartbeat followed by appending to the store, and returns how long it
+// took
+func (cb *csvBenchmark) post(deviceName string) (latency time.Duration, err error) {
+	start := time.Now()
+	cb.locked(func() {
+		t := time.Now().UTC()
+
+		if _, err = cb.reg.Heartbeat(deviceName, t, false); err == nil {
+			err = cb.c.AppendReading(deviceName, reading{Channel: motionChannel, Time: t})
+		}
+	})
+
+	return time.Since(start), err
+}
+
+// addLatencies adds the latencies measured by one device
+func (cb *csvBenchmark) addLatencies(latencies []time.Duration) {
+	cb.latencyMu.Lock()
+	defer cb.latencyMu.Unlock()
+	cb.latencies = append(cb.latencies, latencies...)
+}
+
+// reportLatency reports the median, 99th percentile and longest time a
+// post took
+func (cb *csvBenchmark) reportLatency(b *testing.B) {
+	if len(cb.latencies) == 0 {
+		return
+	}
+
+	sort.Slice(cb.latencies, func(i, j int) bool { return cb.latencies[i] < cb.latencies[j] })
+	b.ReportMetric(float64(cb.latencies[len(cb.latencies)/2]), "p50-ns")
+	b.ReportMetric(float64(cb.latencies[len(cb.latencies)*99/100]), "p99-ns")
+	b.ReportMetric(float64(cb.latencies[len(cb.latencies)-1]), "max-ns")
+}
+
+// BenchmarkCSVConcurrentDevices sends readings from 64 devices at once,
+// as fast as they can and paced at one post every 0.5s like the client,
+// while readings are flushed and device0 starts new sets in the background
+// The global-lock cases take one lock around every write the way every
+// handler used to hold mu, as a baseline for the per device locks
+func BenchmarkCSVConcurrentDevices(b *testing.B) {
+	for _, global := range []bool{false, true} {
+		lock := "per-device"
+
+		if global {
+			lock = "global-lock"
+		}
+
+		b.Run(lock, func(b *testing.B) {
+			benchmarkCSVDevices(b, global)
+		})
+
+		b.Run(lock+"-paced", func(b *testing.B) {
+			benchmarkPacedCSVDevices(b, global, 500*time.Millisecond)
+		})
+	}
+}
+
+// benchmarkCSVDevices has every device post as fast as it can, reporting
+// the time per reading across all devices
+func benchmarkCSVDevices(b *testing.B, global bool) {
+	cb, stop := newCSVBenchmark(b, global)
+	defer stop()
+	var next int64
+	b.SetParallelism(benchmarkCSVDeviceCount)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		deviceName := fmt.Sprintf("device%d", atomic.AddInt64(&next, 1)%benchmarkCSVDeviceCount)
+		latencies := make([]time.Duration, 0)
+
+		for pb.Next() {
+			latency, err := cb.post(deviceName)
+
+			if err != nil {
+				b.Error(err)
+				break
+			}
+
+			latencies = append(latencies, latency)
+		}
+
+		cb.addLatencies(latencies)
+	})
+}
+
+// benchmarkPacedCSVDevices has every device post once every interval,
+// spread evenly over it, for b.N rounds
+// The time per op is the interval, so only the latencies are of interest
+func benchmarkPacedCSVDevices(b *testing.B, global bool, interval time.Duration) {
+	cb, stop := newCSVBenchmark(b, global)
+	defer stop()
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < benchmarkCSVDeviceCount; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			deviceName := fmt.Sprintf("device%d", i)
+			offset := interval * time.Duration(i) / benchmarkCSVDeviceCount
+			latencies := make([]time.Duration, 0, b.N)
+
+			for n := 0; n < b.N; n++ {
+				time.Sleep(time.Until(start.Add(offset + interval*time.Duration(n))))
+				latency, err := cb.post(deviceName)
+
+				if err != nil {
+					b.Error(err)
+					break
+				}
+
+				latencies = append(latencies, latency)
+			}
+
+			cb.addLatencies(latencies)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// TestCSVConcurrentReadsSeeAppends reads the current set while readings
+// are appended and flushed, every read must see at least the readings
+// appended before it started
+func TestCSVConcurrentReadsSeeAppends(t *testing.T) {
+	newTestDatabase(t)
+	c := &csvStore{}
+	const appends = 200
+	var appended int64
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < appends; i++ {
+			if err := c.AppendReading("kitchen", reading{Channel: motionChannel, Time: time.Now().UTC()}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			atomic.AddInt64(&appended, 1)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < appends/4; j++ {
+				before := atomic.LoadInt64(&appended)
+				readings, err := c.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{})
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if int64(len(readings)) < before {
+					t.Errorf("read %d readings after %d were appended", len(readings), before)
+					return
+				}
+
+				if _, err = c.ListSets("kitchen"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer wg.Done()
+
+		for j := 0; j < appends/4; j++ {
+			if err := c.Flush(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	readings, err := c.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readings) != appends {
+		t.Fatalf("read %d readings, want %d", len(readings), appends)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"time"
+)
+
+// sqliteStore keeps readings in the reading table of the server database
+// where set_num is currentSet for readings that have not been moved into
+// a set yet, and every finished set in the reading_set table
+type sqliteStore struct{}
+
+// AppendReading inserts r into the current set of deviceName
+func (s *sqliteStore) AppendReading(deviceName string, r reading) error {
+	return execTXQuery(
+		"INSERT INTO reading (device_name, channel, set_num, time, value, received_at) VALUES (?,?,?,?,?,?);",
+		deviceName,
+		r.Channel,
+		currentSet,
+		r.Time.UTC(),
+		r.Value,
+		r.ReceivedAt,
+	)
+}
+
+// RotateSet moves current readings of deviceName into the next set number
+func (s *sqliteStore) RotateSet(deviceName string) (int, error) {
+	tx, err := db.Beginx()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var lastSet sql.NullInt64
+	err = tx.Get(&lastSet, "SELECT MAX(set_num) FROM reading_set WHERE device_name=?;", deviceName)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	setNum := int(lastSet.Int64) + 1
+	_, err = tx.Exec(
+		"INSERT INTO reading_set (device_name, set_num, created_at) VALUES (?,?,?);",
+		deviceName,
+		setNum,
+		time.Now().UTC(),
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE reading SET set_num=? WHERE device_name=? AND set_num=?;",
+		setNum,
+		deviceName,
+		currentSet,
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return setNum, tx.Commit()
+}
+
+// ListSets returns every set number of deviceName
+func (s *sqliteStore) ListSets(deviceName string) ([]setInfo, error) {
+	sets := make([]setInfo, 0)
+	err := db.Select(
+		&sets,
+		"SELECT set_num AS number FROM reading_set WHERE device_name=? ORDER BY set_num;",
+		deviceName,
+	)
+	return sets, err
+}
+
+// ReadRange selects the readings of channel in set in range ordered by time
+func (s *sqliteStore) ReadRange(deviceName string, channel string, set int, start time.Time, end time.Time) ([]reading, error) {
+	query := "SELECT channel, time, value, received_at FROM reading WHERE device_name=? AND channel=? AND set_num=?"
+	args := []interface{}{deviceName, channel, set}
+
+	if !start.IsZero() {
+		query += " AND time>=?"
+		args = append(args, start.UTC())
+	}
+
+	if !end.IsZero() {
+		query += " AND time<?"
+		args = append(args, end.UTC())
+	}
+
+	readings := make([]reading, 0)
+	err := db.Select(&readings, query+" ORDER BY time;", args...)
+	return readings, err
+}
+
+// ReadPage selects limit readings of channel in set ordered by time,
+// skipping the first offset
+func (s *sqliteStore) ReadPage(deviceName string, channel string, set int, offset int, limit int) ([]reading, error) {
+	readings := make([]reading, 0, limit)
+	err := db.Select(
+		&readings,
+		"SELECT channel, time, value, received_at FROM reading WHERE device_name=? AND channel=? AND set_num=? "+
+			"ORDER BY time, pk LIMIT ? OFFSET ?;",
+		deviceName,
+		channel,
+		set,
+		limit,
+		offset,
+	)
+	return readings, err
+}
+
+// ReplaceCurrent deletes the current motion readings of deviceName and
+// inserts the ones parsed from the csv contents of r
+func (s *sqliteStore) ReplaceCurrent(deviceName string, r io.Reader, loc *time.Location) error {
+	readings, err := readCSVReadings(r, loc)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"DELETE FROM reading WHERE device_name=? AND channel=? AND set_num=?;",
+		deviceName,
+		motionChannel,
+		currentSet,
+	)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, reading := range readings {
+		_, err = tx.Exec(
+			"INSERT INTO reading (device_name, channel, set_num, time, received_at) VALUES (?,?,?,?,?);",
+			deviceName,
+			motionChannel,
+			currentSet,
+			reading.Time.UTC(),
+			reading.ReceivedAt,
+		)
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// WriteSetCSV writes every reading of channel in set to w in csv format
+func (s *sqliteStore) WriteSetCSV(deviceName string, channel string, set int, w io.Writer) error {
+	readings, err := s.ReadRange(deviceName, channel, set, time.Time{}, time.Time{})
+
+	if err != nil {
+		return err
+	}
+
+	for _, reading := range readings {
+		if _, err = io.WriteString(w, formatCSVReading(reading, setting.DisplayLocation)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClearCurrent deletes the readings of every device that aren't in a set
+func (s *sqliteStore) ClearCurrent() error {
+	return execTXQuery("DELETE FROM reading WHERE set_num=?;", currentSet)
+}
+
+// Flush does nothing as every reading is written by its own transaction
+func (s *sqliteStore) Flush() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReadingStores runs the same readings through every storage backend
+// and checks they keep current readings and sets apart the same way
+func TestReadingStores(t *testing.T) {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	value := 21.5
+	receivedAt := start.Add(3 * time.Second)
+	appended := []reading{
+		{Channel: motionChannel, Time: start},
+		{Channel: motionChannel, Time: start.Add(time.Minute)},
+		{Channel: "temp", Time: start, Value: &value, ReceivedAt: &receivedAt},
+	}
+
+	for _, storage := range []string{"csv", "sqlite"} {
+		newTestServer(t)
+		setting.Storage = storage
+		store = initStorage()
+
+		for _, r := range appended {
+			if err := store.AppendReading("kitchen", r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		readings, err := store.ReadRange("kitchen", motionChannel, currentSet, start.Add(time.Second), time.Time{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(readings) != 1 || !readings[0].Time.Equal(start.Add(time.Minute)) || readings[0].Channel != motionChannel {
+			t.Errorf("%s read %+v after the first reading, want the second", storage, readings)
+		}
+
+		set, err := store.RotateSet("kitchen")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if set != 1 {
+			t.Errorf("%s rotated into set %d, want 1", storage, set)
+		}
+
+		if sets, _ := store.ListSets("kitchen"); len(sets) != 1 || sets[0].Number != 1 {
+			t.Errorf("%s listed sets %+v, want set 1", storage, sets)
+		}
+
+		if readings, _ = store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{}); len(readings) != 0 {
+			t.Errorf("%s kept current readings %+v after rotating", storage, readings)
+		}
+
+		temps, err := store.ReadRange("kitchen", "temp", 1, time.Time{}, time.Time{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(temps) != 1 || temps[0].Value == nil || *temps[0].Value != value || temps[0].ReceivedAt == nil || !temps[0].ReceivedAt.Equal(receivedAt) {
+			t.Errorf("%s read temp readings %+v from set 1", storage, temps)
+		}
+
+		var csv bytes.Buffer
+
+		if err = store.WriteSetCSV("kitchen", motionChannel, 1, &csv); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "2024-03-01,08:00:00 \n2024-03-01,08:01:00 \n"; csv.String() != want {
+			t.Errorf("%s wrote set 1 as %q, want %q", storage, csv.String(), want)
+		}
+
+		if err = store.ReplaceCurrent("kitchen", strings.NewReader("2024-03-02,10:00:00\n2024-03-02,10:05:00\n"), time.UTC); err != nil {
+			t.Fatal(err)
+		}
+
+		if readings, _ = store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{}); len(readings) != 2 {
+			t.Errorf("%s has current readings %+v after replacing them, want 2", storage, readings)
+		}
+
+		if err = store.ClearCurrent(); err != nil {
+			t.Fatal(err)
+		}
+
+		if readings, _ = store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{}); len(readings) != 0 {
+			t.Errorf("%s kept current readings %+v after clearing them", storage, readings)
+		}
+
+		if readings, _ = store.ReadRange("kitchen", motionChannel, 1, time.Time{}, time.Time{}); len(readings) != 2 {
+			t.Errorf("%s cleared set 1 along with the current readings, %d left", storage, len(readings))
+		}
+	}
+}
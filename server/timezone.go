@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// locations caches time zones by name as time.LoadLocation reads the
+// time zone database every time it is called
+var locations sync.Map
+
+// loadLocation returns the time zone called name, UTC for an empty name
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// deviceLocation returns the time zone deviceName declared, which legacy
+// devices sending local times without an offset are read in
+func deviceLocation(deviceName string) *time.Location {
+	dev, _ := registry.Get(deviceName)
+	loc, err := loadLocation(dev.Timezone)
+
+	if err != nil {
+		return time.UTC
+	}
+
+	return loc
+}
+
+// deviceTimezoneHandler is an api endpoint that sets the time zone of
+// the devices passed, e.g. "Europe/London" or empty for UTC
+func deviceTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	// Several devices can be passed, so only the password of the server
+	// is accepted
+	err := handlePostRequests(w, r, "")
+
+	if err != nil {
+		return
+	}
+
+	timezone := r.Form.Get("timezone")
+
+	if _, err = loadLocation(timezone); err != nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("Unknown time zone " + timezone))
+		return
+	}
+
+	devicesTimezone := make(map[string]string)
+
+	for _, deviceName := range r.Form["deviceName"] {
+		err = registry.SetTimezone(deviceName, timezone)
+
+		if err == errDeviceNotFound {
+			continue
+		}
+
+		if err != nil {
+			logger.WithError(err).WithField("device", deviceName).Error("Couldn't set time zone")
+			continue
+		}
+
+		devicesTimezone[deviceName] = timezone
+	}
+
+	sendPayload(w, devicesTimezone)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseCSVReadingTimes(t *testing.T) {
+	london, err := loadLocation("Europe/London")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		loc  *time.Location
+		want time.Time
+	}{
+		{"2024-07-01T09:00:00.25+02:00", time.UTC, time.Date(2024, 7, 1, 7, 0, 0, 250000000, time.UTC)},
+		{"2024-07-01T09:00:00Z", london, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)},
+		{"2024-07-01,09:00:00", london, time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC)},
+		{"2024-01-01,09:00:00", london, time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)},
+		{"2024-07-01,09:00:00", time.UTC, time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		r, err := parseCSVReading(test.line, test.loc)
+
+		if err != nil {
+			t.Errorf("%q in %v: %v", test.line, test.loc, err)
+			continue
+		}
+
+		if !r.Time.Equal(test.want) || r.Time.Location() != time.UTC {
+			t.Errorf("%q in %v read as %v, want %v", test.line, test.loc, r.Time, test.want)
+		}
+	}
+
+	if _, err = parseCSVReading("01/07/2024 09:00", time.UTC); err == nil {
+		t.Error("unknown time format parsed")
+	}
+}
+
+// TestLegacyTimeStampsInDeviceTimezone checks a legacy device sending
+// local times is read in the time zone set for it
+func TestLegacyTimeStampsInDeviceTimezone(t *testing.T) {
+	newTestServer(t)
+
+	if err := registry.CheckIn("kitchen", time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+
+	setTimezone := func(timezone string) int {
+		form := url.Values{"password": {"password"}, "deviceName": {"kitchen", "attic"}, "timezone": {timezone}}
+		return postForm(deviceTimezoneHandler, "/device-timezone/", form).Code
+	}
+
+	if status := setTimezone("Mars/Olympus"); status != http.StatusNotAcceptable {
+		t.Errorf("unknown time zone answered %d, want %d", status, http.StatusNotAcceptable)
+	}
+
+	if status := setTimezone("Europe/London"); status != http.StatusOK {
+		t.Fatalf("setting the time zone answered %d", status)
+	}
+
+	form := url.Values{"password": {"password"}, "timeStamp": {"kitchen,2024-07-01,09:00:00,true"}}
+
+	if w := postForm(sensorHandler, "/timeStamp/", form); w.Code != http.StatusOK {
+		t.Fatalf("time stamp answered %d: %s", w.Code, w.Body.String())
+	}
+
+	readings, err := store.ReadRange("kitchen", motionChannel, currentSet, time.Time{}, time.Time{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC); len(readings) != 1 || !readings[0].Time.Equal(want) {
+		t.Fatalf("saved %+v, want a reading at %v", readings, want)
+	}
+}
+
+// TestSetCSVInDisplayTimezone checks downloaded sets have their times in
+// the display timezone
+func TestSetCSVInDisplayTimezone(t *testing.T) {
+	newTestSets(t, time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	newYork, err := loadLocation("America/New_York")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setting.DisplayLocation = newYork
+	var csv bytes.Buffer
+
+	if err = store.WriteSetCSV("kitchen", motionChannel, 1, &csv); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "2024-03-01,04:00:00 \n2024-03-01,05:00:00 \n"; csv.String() != want {
+		t.Errorf("set 1 written as %q, want %q", csv.String(), want)
+	}
+}
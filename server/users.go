@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// Roles of dashboard users, each one can do everything the roles
+	// before it can
+	// viewer sees charts and downloads sets, operator also changes record
+	// mode, starts new sets and labels sets and admin also manages devices,
+	// users and configuration
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+
+	// minPasswordLength is the shortest password a user can be given
+	minPasswordLength = 8
+)
+
+// roleLevels orders roles from least to most allowed
+var roleLevels = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+// userNamePattern is what user names can be made of
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+// dummyPasswordHash is compared against when a user doesn't exist so
+// logging in as an unknown user takes as long as with a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// errUserNotFound is returned when a user name doesn't exist
+var errUserNotFound = errors.New("User does not exist")
+
+// errLastAdmin is returned when a change would leave no admin to manage
+// users
+var errLastAdmin = errors.New("At least one admin has to remain")
+
+// dashboardUser is an account that can log in to the dashboard
+type dashboardUser struct {
+	Name         string    `db:"name" json:"name"`
+	PasswordHash string    `db:"password_hash" json:"-"`
+	Role         string    `db:"role" json:"role"`
+	CreatedAt    time.Time `db:"created_at" json:"createdAt"`
+}
+
+// roleAllows determines whether role may do what required lets you do
+func roleAllows(role string, required string) bool {
+	return roleLevels[role] > 0 && roleLevels[role] >= roleLevels[required]
+}
+
+// validateUser checks a user name, role and, unless it is empty, password
+// before they are saved
+func validateUser(name string, password string, role string) error {
+	if !userNamePattern.MatchString(name) {
+		return errors.New("User name must be 1 to 32 letters, digits, '.', '_' or '-'")
+	}
+
+	if roleLevels[role] == 0 {
+		return fmt.Errorf("Role must be one of %s, %s or %s", roleViewer, roleOperator, roleAdmin)
+	}
+
+	if password != "" && len(password) < minPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", minPasswordLength)
+	}
+
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// countUsers returns how many dashboard users there are
+func countUsers() (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM dashboard_user;")
+	return count, err
+}
+
+// listUsers returns every dashboard user ordered by name
+func listUsers() ([]dashboardUser, error) {
+	users := make([]dashboardUser, 0)
+	err := db.Select(&users, "SELECT * FROM dashboard_user ORDER BY name;")
+	return users, err
+}
+
+// loadUser returns the dashboard user called name
+func loadUser(name string) (dashboardUser, error) {
+	var user dashboardUser
+	err := db.Get(&user, "SELECT * FROM dashboard_user WHERE name=?;", name)
+
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+
+	return user, err
+}
+
+// authenticateUser returns the user called name if password is theirs
+func authenticateUser(name string, password string) (dashboardUser, bool) {
+	user, err := loadUser(name)
+
+	if err != nil {
+		if err != errUserNotFound {
+			logger.WithError(err).Error("Couldn't load user")
+		}
+
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return user, false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return user, false
+	}
+
+	return user, true
+}
+
+// createUser adds a dashboard user
+func createUser(name string, password string, role string) error {
+	if password == "" {
+		return errors.New("Password is required for a new user")
+	}
+
+	if err := validateUser(name, password, role); err != nil {
+		return err
+	}
+
+	if _, err := loadUser(name); err != errUserNotFound {
+		if err == nil {
+			return fmt.Errorf("User %q already exists", name)
+		}
+
+		return err
+	}
+
+	hash, err := hashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	return execTXQuery(
+		"INSERT INTO dashboard_user (name, password_hash, role, created_at) VALUES (?,?,?,?);",
+		name, hash, role, time.Now().UTC(),
+	)
+}
+
+// remainingAdmins returns how many admins there would be without name
+func remainingAdmins(name string) (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM dashboard_user WHERE role=? AND name!=?;", roleAdmin, name)
+	return count, err
+}
+
+// updateUser changes the role of an existing user and, unless it is
+// empty, their password
+// Sessions of the user are ended so the change applies right away
+func updateUser(name string, password string, role string) error {
+	if err := validateUser(name, password, role); err != nil {
+		return err
+	}
+
+	user, err := loadUser(name)
+
+	if err != nil {
+		return err
+	}
+
+	if user.Role == roleAdmin && role != roleAdmin {
+		admins, err := remainingAdmins(name)
+
+		if err != nil {
+			return err
+		}
+
+		if admins == 0 {
+			return errLastAdmin
+		}
+	}
+
+	hash := user.PasswordHash
+
+	if password != "" {
+		hash, err = hashPassword(password)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = execTXQuery("UPDATE dashboard_user SET password_hash=?, role=? WHERE name=?;", hash, role, name)
+
+	if err != nil {
+		return err
+	}
+
+	sessions.DeleteUser(name)
+	return nil
+}
+
+// removeUser deletes a dashboard user and ends their sessions
+func removeUser(name string) error {
+	user, err := loadUser(name)
+
+	if err != nil {
+		return err
+	}
+
+	if user.Role == roleAdmin {
+		admins, err := remainingAdmins(name)
+
+		if err != nil {
+			return err
+		}
+
+		if admins == 0 {
+			return errLastAdmin
+		}
+	}
+
+	if err = execTXQuery("DELETE FROM dashboard_user WHERE name=?;", name); err != nil {
+		return err
+	}
+
+	sessions.DeleteUser(name)
+	return nil
+}
+
+// readNewPassword asks for a password twice on a terminal, or reads it
+// from the first line of stdin so it can be piped in by scripts
+func readNewPassword() (string, error) {
+	if !isInteractive() {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+		if err != nil && password == "" {
+			return "", errors.Wrap(err, "Couldn't read password from stdin")
+		}
+
+		return strings.TrimRight(password, "\r\n"), nil
+	}
+
+	fmt.Print("Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Print("Repeat password: ")
+	repeated, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(repeated) {
+		return "", errors.New("Passwords don't match")
+	}
+
+	return string(password), nil
+}
+
+// runUserCommand is the user subcommand which manages dashboard users
+// from the command line and exits, e.g. to add the first admin with
+// "server user add alice -role admin"
+// Passwords are prompted for, or read from stdin when it isn't a terminal
+func runUserCommand() {
+	usage := func() {
+		fmt.Println("Usage: server user add <name> [-role viewer|operator|admin]")
+		fmt.Println("       server user set <name> [-role viewer|operator|admin] [-reset-password], at least one of them")
+		fmt.Println("       server user remove <name>")
+		fmt.Println("       server user list")
+		os.Exit(2)
+	}
+
+	if len(subcommandArgs) == 0 {
+		usage()
+	}
+
+	action := subcommandArgs[0]
+
+	if action == "list" {
+		users, err := listUsers()
+		checkError(err, "Listing users", true)
+
+		for _, user := range users {
+			fmt.Printf("%-32s %-8s %s\n", user.Name, user.Role, user.CreatedAt.Format(time.RFC3339))
+		}
+
+		os.Exit(0)
+	}
+
+	if len(subcommandArgs) != 2 {
+		usage()
+	}
+
+	name := subcommandArgs[1]
+
+	switch action {
+	case "add":
+		password, err := readNewPassword()
+		checkError(err, "Reading password", true)
+		err = createUser(name, password, *roleFlag)
+		checkError(err, "Adding user "+name, true)
+		fmt.Printf("Added %s %s\n", *roleFlag, name)
+	case "set":
+		password, role := "", *roleFlag
+		var err error
+
+		// -role defaults to viewer for add, set keeps the current role
+		// unless it is given
+		if !flagPassed("role") {
+			if !*resetPasswordFlag {
+				usage()
+			}
+
+			user, err := loadUser(name)
+			checkError(err, "Changing user "+name, true)
+			role = user.Role
+		}
+
+		if *resetPasswordFlag {
+			password, err = readNewPassword()
+			checkError(err, "Reading password", true)
+
+			if password == "" {
+				checkError(errors.New("Password is empty"), "Reading password", true)
+			}
+		}
+
+		err = updateUser(name, password, role)
+		checkError(err, "Changing user "+name, true)
+		fmt.Printf("%s is now %s\n", name, role)
+	case "remove":
+		err := removeUser(name)
+		checkError(err, "Removing user "+name, true)
+		fmt.Println("Removed " + name)
+	default:
+		usage()
+	}
+
+	os.Exit(0)
+}
+
+// usersView renders the user management page
+func usersView(w http.ResponseWriter, r *http.Request) {
+	users, err := listUsers()
+
+	if err != nil {
+		logger.WithError(err).Error("Couldn't list users")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't list users"))
+		return
+	}
+
+	context := dashboardContext(r)
+	context["users"] = users
+	context["roles"] = []string{roleViewer, roleOperator, roleAdmin}
+	tpl.ExecuteTemplate(w, "users.html", context)
+}
+
+// userSaveHandler is an api endpoint that adds a user, or changes the
+// role and password of an existing one when exists is true
+// Leaving the password empty keeps the current one
+func userSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	password := r.Form.Get("password")
+	role := r.Form.Get("role")
+	var err error
+
+	if r.Form.Get("exists") == "true" {
+		err = updateUser(name, password, role)
+	} else {
+		err = createUser(name, password, role)
+	}
+
+	writeUserChangeResult(w, name, err)
+}
+
+// userRemoveHandler is an api endpoint that removes a user
+func userRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if err := handleDashboardPostRequests(w, r); err != nil {
+		return
+	}
+
+	name := r.Form.Get("name")
+	var err error
+
+	if name == currentSession(r).user {
+		err = errors.New("You can't remove yourself")
+	} else {
+		err = removeUser(name)
+	}
+
+	writeUserChangeResult(w, name, err)
+}
+
+// writeUserChangeResult answers a user change with the resulting users,
+// or with err
+func writeUserChangeResult(w http.ResponseWriter, name string, err error) {
+	if err == errUserNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err != nil {
+		logger.WithError(err).WithField("user", name).Warn("Couldn't change user")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	logger.WithField("user", name).Info("Changed user")
+	users, err := listUsers()
+
+	if err != nil {
+		logger.WithError(err).Error("Couldn't list users")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Couldn't list users"))
+		return
+	}
+
+	sendPayload(w, users)
+}
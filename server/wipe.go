@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// Modes that can be passed to -wipe
+const (
+	wipeDatabase = "db"
+	wipeCSV      = "csv"
+	wipeAll      = "all"
+)
+
+// wipeDescriptions is what each wipe mode deletes, shown when asking
+// the user to confirm
+var wipeDescriptions = map[string]string{
+	wipeDatabase: "the database (all devices, set numbers and statuses)",
+	wipeCSV:      "the current readings of every device",
+	wipeAll:      "the database, the current readings of every device and all sets",
+}
+
+// wipeModeFlag is the value of -wipe
+// It can still be passed bare, as before it took a mode, which means all
+type wipeModeFlag string
+
+func (m *wipeModeFlag) String() string {
+	if m == nil {
+		return ""
+	}
+
+	return string(*m)
+}
+
+func (m *wipeModeFlag) Set(value string) error {
+	switch value {
+	case "true":
+		value = wipeAll
+	case "false":
+		value = ""
+	}
+
+	*m = wipeModeFlag(value)
+	return nil
+}
+
+// IsBoolFlag lets -wipe be passed without a mode
+func (m *wipeModeFlag) IsBoolFlag() bool {
+	return true
+}
+
+// joinWipeMode turns "-wipe <mode>" in args into "-wipe=<mode>", as the
+// flag package only takes the value of flags that can be passed bare
+// after an equals sign
+func joinWipeMode(args []string) []string {
+	joined := make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		if (args[i] == "-wipe" || args[i] == "--wipe") && i+1 < len(args) {
+			if _, ok := wipeDescriptions[args[i+1]]; ok {
+				joined = append(joined, args[i]+"="+args[i+1])
+				i++
+				continue
+			}
+		}
+
+		joined = append(joined, args[i])
+	}
+
+	return joined
+}
+
+// confirmWipe asks the user if they are sure they want to wipe unless
+// -yes was passed
+func confirmWipe(mode string) bool {
+	if *yesFlag {
+		return true
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("You are about to wipe " + wipeDescriptions[mode] + ".  A backup will be made first.  Are you sure you want to continue? (y/n)")
+	text, _ := reader.ReadString('\n')
+	text = strings.TrimRight(text, "\r\n")
+	return text == "y" || text == "Y"
+}
+
+// removeDirectoryContents removes everything in directory except for
+// the paths in keep, leaving directory itself in place
+func removeDirectoryContents(directory string, keep ...string) error {
+	// Extra saftey to make sure we don't delete home directory
+	homeDir, _ := homedir.Dir()
+
+	if directory == homeDir || directory == "/" {
+		return errors.New("Can't delete " + directory + ", thats dangerous!")
+	}
+
+	fileInfoArray, err := ioutil.ReadDir(directory)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+FileLoop:
+	for _, fileInfo := range fileInfoArray {
+		filePath := filepath.Join(directory, fileInfo.Name())
+
+		for _, keepPath := range keep {
+			if filePath == keepPath {
+				continue FileLoop
+			}
+		}
+
+		if err = os.RemoveAll(filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeCurrentCSVFiles removes the current csv files of every device and
+// channel, leaving sets untouched
+func removeCurrentCSVFiles() error {
+	csvFiles, err := filepath.Glob(filepath.Join(setting.CsvDirectory, "*.csv"))
+
+	if err != nil {
+		return err
+	}
+
+	for _, csvFile := range csvFiles {
+		if err = os.Remove(csvFile); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(setting.CsvDirectory, "channels"))
+}
+
+// wipeData backs up and then deletes data based on mode
+// server.ini and previous backups are never deleted
+func wipeData(mode string) {
+	if _, ok := wipeDescriptions[mode]; !ok {
+		checkError(errors.New(mode), "-wipe must be one of db, csv or all", true)
+	}
+
+	if !confirmWipe(mode) {
+		fmt.Println("Files not deleted")
+		return
+	}
+
+	archivePath, err := writeBackupArchive("wipe-" + mode)
+	checkError(err, "Couldn't write backup, nothing was deleted", true)
+	fmt.Println("Backup written to " + archivePath)
+	logger.WithField("backup", archivePath).WithField("mode", mode).Warn("Wiping data")
+
+	switch mode {
+	case wipeDatabase:
+		err = os.Remove(setting.ServerDBFile)
+
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	case wipeCSV:
+		// The current readings are in the database with the sqlite
+		// storage, so it has to be opened first
+		initDatabase()
+		err = initStorage().ClearCurrent()
+	case wipeAll:
+		if err = os.Remove(setting.ServerDBFile); err != nil && !os.IsNotExist(err) {
+			break
+		}
+		if err = removeCurrentCSVFiles(); err != nil {
+			break
+		}
+		err = removeDirectoryContents(setting.SetsDirectory, backupDirectory())
+	}
+
+	checkError(err, "Couldn't wipe "+wipeDescriptions[mode], true)
+	initDataDirectories()
+	fmt.Println("Wiped " + wipeDescriptions[mode])
+}